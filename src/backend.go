@@ -1,5 +1,18 @@
 package main
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
 /*
  Backend interface
 */
@@ -8,9 +21,9 @@ type BackendDatabase interface {
 	Set([]byte, []byte) error
 	Add([]byte, []byte) error
 	Replace([]byte, []byte) error
-	Incr([]byte, uint) (int, error)
-	Decr([]byte, uint) (int, error)
-	Increment([]byte, int, bool) (int, error)
+	Incr([]byte, uint64) (uint64, error)
+	Decr([]byte, uint64) (uint64, error)
+	Increment([]byte, int64, bool) (uint64, error)
 	Put([]byte, []byte, bool, bool) error
 	Get([]byte) ([]byte, error)
 	Range([]byte, int, []byte, bool) (map[string][]byte, error)
@@ -20,4 +33,148 @@ type BackendDatabase interface {
 	GetDbPath() string
 	Flush() error
 	BucketStats() error
+	Version() string
+	SetVerbosity(int)
+}
+
+/*
+BackendConfig is handed to the factory of a backend by OpenBackend. Filename is
+the database file, a directory for badger. MaxKeys sizes the backend, the bloom
+filters of boltdb and the capacity of inmem. Options are the boltdb options, its
+MaxKeysPerBucket defaulting to MaxKeys
+*/
+type BackendConfig struct {
+	Filename string
+	MaxKeys  int
+	Options  BackendOptions
+}
+
+// BackendFactory opens a backend registered with RegisterBackend
+type BackendFactory func(config BackendConfig) (BackendDatabase, error)
+
+var (
+	backendsLock sync.RWMutex
+	backends     = make(map[string]BackendFactory)
+)
+
+/*
+RegisterBackend makes a backend available to OpenBackend under name, from the
+init of the file implementing it. Registering a name twice or a nil factory
+panics, like database/sql drivers
+*/
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	if factory == nil {
+		panic("RegisterBackend factory is nil for backend " + name)
+	}
+	if _, dup := backends[name]; dup {
+		panic("RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = factory
+}
+
+// Backends returns the names of the registered backends, sorted
+func Backends() []string {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenBackend opens the backend registered as name with config
+func OpenBackend(name string, config BackendConfig) (BackendDatabase, error) {
+	backendsLock.RLock()
+	factory := backends[name]
+	backendsLock.RUnlock()
+	if factory == nil {
+		return nil, fmt.Errorf("Unknown backend %q, registered: %s", name, strings.Join(Backends(), ", "))
+	}
+	return factory(config)
+}
+
+// DelayedFlusher is implemented by backends supporting flush_all with a delay
+type DelayedFlusher interface {
+	FlushAfter(delay int) error
+}
+
+// StatsJSONer is implemented by backends reporting their stats, or more, as JSON too, see dbstats json
+type StatsJSONer interface {
+	StatsJSON() ([]byte, error)
+}
+
+// Appender is implemented by backends supporting append and prepend, keeping the expiration of the key
+type Appender interface {
+	Append(key []byte, data []byte) error
+	Prepend(key []byte, data []byte) error
+}
+
+/*
+Counters follow memcached semantics: values are unsigned 64 bit, incr wraps
+around at 2^64 and decr stops at 0. Incr/Decr deltas above math.MaxInt64 are
+capped, since Increment takes a signed delta
+*/
+
+/*
+ErrNotNumeric is returned by Increment when the stored value isn't a counter, the
+memcached "cannot increment or decrement non-numeric value" error
+*/
+var ErrNotNumeric = errors.New("Cannot increment or decrement non-numeric value")
+
+// ErrKeyNotFound is returned by operations that need an existing key, Incr and Decr of a missing one
+var ErrKeyNotFound = errors.New("Key not found")
+
+/*
+parseCounter reads a stored counter. Like memcached, spaces, tabs and line breaks
+around the digits are tolerated, values stored by hand with a trailing newline
+still count; anything else, signs included, is ErrNotNumeric. The counter is
+written back without them
+*/
+func parseCounter(v []byte) (uint64, error) {
+	i, err := strconv.ParseUint(string(bytes.Trim(v, " \t\r\n")), 10, 64)
+	if err != nil {
+		return 0, ErrNotNumeric
+	}
+	return i, nil
+}
+
+// signedDelta converts an Incr/Decr amount to an Increment delta
+func signedDelta(value uint64, decr bool) int64 {
+	d := int64(math.MaxInt64)
+	if value < math.MaxInt64 {
+		d = int64(value)
+	}
+	if decr {
+		return -d
+	}
+	return d
+}
+
+// applyDelta adds delta to a counter value, wrapping on incr and stopping at 0 on decr
+func applyDelta(current uint64, delta int64) uint64 {
+	if delta < 0 {
+		d := uint64(-delta)
+		if d > current {
+			return 0
+		}
+		return current - d
+	}
+	return current + uint64(delta)
+}
+
+// printableKey formats a key for errors and logs, binary keys are quoted
+func printableKey(key []byte) string {
+	if !utf8.Valid(key) {
+		return strconv.Quote(string(key))
+	}
+	for _, r := range string(key) {
+		if !unicode.IsPrint(r) {
+			return strconv.Quote(string(key))
+		}
+	}
+	return string(key)
 }
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"math/rand"
+	"strings"
+	"testing"
 	"time"
 )
 
@@ -30,3 +32,47 @@ func randInt(min int, max int) int {
 func errUnexpected(msg interface{}) string {
 	return fmt.Sprintf("Unexpected response: %#v\n", msg)
 }
+
+func TestBackendRegistry(t *testing.T) {
+	if got := strings.Join(Backends(), ","); got != "badger,boltdb,inmem,leveldb" {
+		t.Error(errUnexpected(got))
+	}
+	if _, err := OpenBackend("nosuch", BackendConfig{}); err == nil {
+		t.Error("expected error for an unknown backend")
+	}
+
+	var opened BackendConfig
+	RegisterBackend("test", func(config BackendConfig) (BackendDatabase, error) {
+		opened = config
+		return vleveldb, nil
+	})
+	defer func() {
+		backendsLock.Lock()
+		delete(backends, "test")
+		backendsLock.Unlock()
+	}()
+	db, err := OpenBackend("test", BackendConfig{Filename: "beano.db", MaxKeys: 10})
+	if err != nil || db != BackendDatabase(vleveldb) || opened.Filename != "beano.db" || opened.MaxKeys != 10 {
+		t.Error(errUnexpected(opened))
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected a panic registering twice")
+			}
+		}()
+		RegisterBackend("test", func(config BackendConfig) (BackendDatabase, error) { return nil, nil })
+	}()
+
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	bolt, err := OpenBackend("boltdb", BackendConfig{Filename: filename, MaxKeys: 1000, Options: BackendOptions{Tombstones: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+	be := bolt.(*KVBoltDBBackend)
+	if be.maxKeysPerBucket != 1000 || !be.opts.Tombstones {
+		t.Error(errUnexpected(be.opts))
+	}
+}
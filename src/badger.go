@@ -18,6 +18,12 @@ type badgerBackend struct {
 	dbMutex *sync.RWMutex
 }
 
+func init() {
+	RegisterBackend("badger", func(config BackendConfig) (BackendDatabase, error) {
+		return NewBadgerBackend(config.Filename)
+	})
+}
+
 /*
 NewbadgerBackend receives a dirname with path and creates a new Backend instance
 */
@@ -68,22 +74,22 @@ func (be badgerBackend) Replace(key []byte, value []byte) error {
 Incr data, yields error if the represented value doesnt maps to int.
 Starts from 0, no negative values
 */
-func (be badgerBackend) Incr(key []byte, value uint) (int, error) {
-	return be.Increment(key, int(value), false)
+func (be badgerBackend) Incr(key []byte, value uint64) (uint64, error) {
+	return be.Increment(key, signedDelta(value, false), false)
 }
 
 /*
 Decr data, yields error if the represented value doesnt maps to int.
 Stops at 0, no negative values
 */
-func (be badgerBackend) Decr(key []byte, value uint) (int, error) {
-	return be.Increment(key, int(value)*-1, false)
+func (be badgerBackend) Decr(key []byte, value uint64) (uint64, error) {
+	return be.Increment(key, signedDelta(value, true), false)
 }
 
 /*
 Increment - Generic get and set for incr/decr tx
 */
-func (be badgerBackend) Increment(key []byte, value int, createIfNotExists bool) (int, error) {
+func (be badgerBackend) Increment(key []byte, value int64, createIfNotExists bool) (uint64, error) {
 	be.dbMutex.Lock()
 	defer be.dbMutex.Unlock()
 
@@ -94,7 +100,7 @@ func (be badgerBackend) Increment(key []byte, value int, createIfNotExists bool)
 
 	if err != nil {
 		if err == badger.ErrKeyNotFound && createIfNotExists == false {
-			return -1, fmt.Errorf("Key %s do not exists, createIfNotExists set to false - %s", string(key), err)
+			return 0, ErrKeyNotFound
 		} else {
 			return 0, err
 		}
@@ -106,16 +112,16 @@ func (be badgerBackend) Increment(key []byte, value int, createIfNotExists bool)
 		return 0, err
 	}
 
-	i, err := strconv.Atoi(string(itemValue))
+	i, err := parseCounter(itemValue)
 	if err != nil {
-		return -1, fmt.Errorf("Data cannot be incr/decr for key %s - %s", string(key), string(itemValue))
+		return 0, err
 	}
 
-	i = i + value
-	s := fmt.Sprintf("%d", i)
+	i = applyDelta(i, value)
+	s := strconv.FormatUint(i, 10)
 	err = txn.Set(key, []byte(s))
 	if err != nil {
-		return -1, fmt.Errorf("Error key %s - %s", string(key), err)
+		return 0, fmt.Errorf("Error key %s - %s", string(key), err)
 	}
 
 	if err := txn.Commit(nil); err != nil {
@@ -258,6 +264,12 @@ Stats returns db statuses
 */
 func (be badgerBackend) Stats() string { return "" }
 
+// Version returns the build version
+func (be badgerBackend) Version() string { return buildVersion }
+
+// SetVerbosity adjusts the log level, memcached verbosity levels
+func (be badgerBackend) SetVerbosity(level int) { setVerbosity(level) }
+
 /*
 GetDbPath returns the filesystem path for the database
 */
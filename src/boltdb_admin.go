@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The admin shell takes line commands on a unix socket, apart from the memcached
+traffic, and answers in text. Access is controlled by the socket file mode,
+0600 by default, so only the user running beano can connect. Commands:
+
+	help                   the list of commands
+	stats                  the value size histogram
+	bucketstats            items and bytes of every bucket
+	compact <bucket>       CompactBucket
+	compactexpirations     CompactExpirationIndex, answers the entries dropped
+	flush                  empties the current bucket
+	dump [limit]           metadump lines of the current bucket
+	check                  the integrity check
+	verifybloom            stored keys missing from the current bloom filter
+	backup <path>          writes a copy of the database to path
+	quit                   closes the connection
+
+Successful commands answer OK or their output lines followed by END, failures
+a single ERROR line
+*/
+
+// adminCommands is the help text of the admin shell
+var adminCommands = []string{
+	"help",
+	"stats",
+	"bucketstats",
+	"compact <bucket>",
+	"compactexpirations",
+	"flush",
+	"dump [limit]",
+	"check",
+	"verifybloom",
+	"backup <path>",
+	"quit",
+}
+
+// adminSocketMode is the file mode of the admin socket
+const adminSocketMode os.FileMode = 0600
+
+// AdminCommand runs an admin shell command line and returns its response
+func (be *KVBoltDBBackend) AdminCommand(line string) string {
+	lines, err := be.adminCommand(strings.Fields(line))
+	if err != nil {
+		return fmt.Sprintf("ERROR %s\n", err)
+	}
+	if lines == nil {
+		return "OK\n"
+	}
+	return strings.Join(append(lines, "END"), "\n") + "\n"
+}
+
+// adminCommand runs args, a nil result with no error answers OK
+func (be *KVBoltDBBackend) adminCommand(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Empty command")
+	}
+	switch args[0] {
+	case "help":
+		return append([]string(nil), adminCommands...), nil
+	case "stats":
+		if stats := be.Stats(); stats != "" {
+			return strings.Split(stats, "\n"), nil
+		}
+		return []string{}, nil
+	case "bucketstats":
+		stats, err := be.AllBucketStats()
+		if err != nil {
+			return nil, err
+		}
+		lines := []string{}
+		for name, st := range stats {
+			lines = append(lines, fmt.Sprintf("bucket=%s items=%d bytes=%d", name, st.Items, st.Bytes))
+		}
+		sort.Strings(lines)
+		return lines, nil
+	case "compact":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("Usage: compact <bucket>")
+		}
+		return nil, be.CompactBucket(args[1])
+	case "compactexpirations":
+		removed, err := be.CompactExpirationIndex()
+		if err != nil {
+			return nil, err
+		}
+		return []string{fmt.Sprintf("removed=%d", removed)}, nil
+	case "flush":
+		return nil, be.Flush()
+	case "dump":
+		limit := 0
+		if len(args) > 1 {
+			var err error
+			if limit, err = strconv.Atoi(args[1]); err != nil {
+				return nil, fmt.Errorf("Invalid limit %q", args[1])
+			}
+		}
+		metas, err := be.CacheDump(limit)
+		if err != nil {
+			return nil, err
+		}
+		lines := []string{}
+		for _, m := range metas {
+			lines = append(lines, m.String())
+		}
+		return lines, nil
+	case "check":
+		lines := []string{}
+		for _, err := range be.Check() {
+			lines = append(lines, err.Error())
+		}
+		return lines, nil
+	case "verifybloom":
+		missed, err := be.VerifyBloom()
+		if err != nil {
+			return nil, err
+		}
+		lines := []string{}
+		for _, k := range missed {
+			lines = append(lines, printableKey(k))
+		}
+		return lines, nil
+	case "backup":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("Usage: backup <path>")
+		}
+		return nil, be.backupFile(args[1])
+	}
+	return nil, fmt.Errorf("Unknown command %q", args[0])
+}
+
+// backupFile writes a Backup to a new file at path
+func (be *KVBoltDBBackend) backupFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := be.Backup(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// AdminServer serves the admin shell of a backend on a unix socket
+type AdminServer struct {
+	be       *KVBoltDBBackend
+	listener *net.UnixListener
+	path     string
+}
+
+/*
+ServeAdmin listens for admin shell connections on the unix socket path. The
+socket is bound in a private directory and moved to path once it has its mode,
+so nobody connects before. A socket left at path by a process gone is replaced,
+one something still listens on fails it. Close stops it and removes the socket
+*/
+func (be *KVBoltDBBackend) ServeAdmin(path string) (*AdminServer, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".beano-admin")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, "sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: private, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// bound to private, Close would unlink the wrong name
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(private, adminSocketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(private, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	s := &AdminServer{be: be, listener: listener, path: path}
+	go s.serve()
+	return s, nil
+}
+
+// removeStaleSocket removes the socket at path if nothing listens on it
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("Admin socket %s in use", path)
+	}
+	log.Warning("Removing stale admin socket %s", path)
+	return os.Remove(path)
+}
+
+func (s *AdminServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle answers the commands of conn until it sends quit or disconnects
+func (s *AdminServer) handle(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "quit" {
+			return
+		}
+		if _, err := conn.Write([]byte(s.be.AdminCommand(line))); err != nil {
+			return
+		}
+	}
+}
+
+// Close stops accepting connections and removes the socket, open ones are served until they quit
+func (s *AdminServer) Close() error {
+	err := s.listener.Close()
+	os.Remove(s.path)
+	return err
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+ApplyReplicationRecord applies a record from a primary's replication stream with
+last write wins: the record is applied only if it is newer than the local copy of
+the key, comparing modification times and then CAS. Stale and duplicate records
+are skipped, so records can be applied more than once and out of order. Deletes
+always leave a tombstone so an older set arriving late doesn't bring the key back.
+The reaper purges it after TombstoneGrace, without the Tombstones option too: the
+first one applied marks the database, see markTombstones, so it's also looked for
+after a restart. Applied records keep the primary's CAS and modification time and
+aren't published to this backend's own stream
+*/
+func (be *KVBoltDBBackend) ApplyReplicationRecord(rec Record) error {
+	applied, err := be.applyRecord(rec, false)
+	if err != nil {
+		return err
+	}
+	if applied {
+		replicationApplied.Inc(1)
+	} else {
+		replicationSkipped.Inc(1)
+	}
+	return nil
+}
+
+// applyRecord stores rec verbatim if it's newer than the local copy or force is set
+func (be *KVBoltDBBackend) applyRecord(rec Record, force bool) (bool, error) {
+	applied, err := be.applyRecords([]Record{rec}, force)
+	return applied == 1, err
+}
+
+/*
+applyRecords stores the records of recs newer than their local copy, or all with
+force, in a single transaction, returning how many were. The records must be of
+a same bucket, one failing its checks fails them all
+*/
+func (be *KVBoltDBBackend) applyRecords(recs []Record, force bool) (int, error) {
+	if err := be.allowOp(OpApply); err != nil {
+		return 0, err
+	}
+	if err := be.enterWrite(); err != nil {
+		return 0, err
+	}
+	defer be.writes.leave()
+	var ivs []*InternalValue
+	for _, rec := range recs {
+		if rec.Op == RecordExpire {
+			// the key carries its expiration, the local reaper deletes it
+			continue
+		}
+		if rec.Op != RecordSet && rec.Op != RecordDelete {
+			return 0, fmt.Errorf("Unknown replication op %q for key %s", rec.Op, printableKey(rec.Key))
+		}
+		if rec.Bucket == "" || rec.Bucket == metaBucketName {
+			return 0, fmt.Errorf("Invalid replication bucket %q for key %s", rec.Bucket, printableKey(rec.Key))
+		}
+		if rec.Bucket != recs[0].Bucket {
+			return 0, fmt.Errorf("Records of buckets %q and %q applied together", recs[0].Bucket, rec.Bucket)
+		}
+		if len(rec.Source) > maxSourceSize {
+			return 0, fmt.Errorf("Replicated source of key %s is %d bytes, up to %d are stored", printableKey(rec.Key), len(rec.Source), maxSourceSize)
+		}
+		ivs = append(ivs, &InternalValue{
+			key:        rec.Key,
+			flags:      rec.Flags,
+			expiration: rec.Expiration,
+			cas:        rec.CAS,
+			modified:   rec.Modified,
+			tombstone:  rec.Op == RecordDelete,
+			ctype:      rec.ContentType,
+			kind:       rec.Kind,
+			source:     rec.Source,
+			value:      rec.Value,
+		})
+	}
+	if len(ivs) == 0 {
+		return 0, nil
+	}
+	if err := be.flushPending(); err != nil {
+		return 0, err
+	}
+	if err := be.rlock(); err != nil {
+		return 0, err
+	}
+	defer be.dbMutex.RUnlock()
+
+	bucketName := recs[0].Bucket
+	db, err := be.dbFor(bucketName)
+	if err != nil {
+		return 0, err
+	}
+	var applied []*InternalValue
+	err = be.updateOn(db, func(tx *bolt.Tx) error {
+		applied = nil
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		for _, iv := range ivs {
+			ok, err := be.applyValue(tx, bucketName, bucket, iv, force)
+			if err != nil {
+				return err
+			}
+			if ok {
+				applied = append(applied, iv)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	bf := be.keyCache[bucketName]
+	now := time.Now()
+	for _, iv := range applied {
+		if iv.tombstone && atomic.CompareAndSwapInt32(&be.tombstoned, 0, 1) {
+			// without the Tombstones option the reaper has to look for them now
+			be.wakeReaper()
+		}
+		if bf != nil {
+			if iv.tombstone {
+				bf.Remove(iv.key)
+			} else {
+				bf.Add(iv.key)
+			}
+		}
+		if !iv.tombstone && iv.expiration != 0 && !iv.expired(now) {
+			if err := be.indexExpiration(bucketName, iv.key, iv.expiration); err != nil {
+				log.Error("Error indexing expiration of key %s - %s", printableKey(iv.key), err)
+			}
+		}
+	}
+	return len(applied), nil
+}
+
+// applyValue stores iv in bucket of tx if it's newer than the local copy or force is set
+func (be *KVBoltDBBackend) applyValue(tx *bolt.Tx, bucketName string, bucket *bolt.Bucket, iv *InternalValue, force bool) (bool, error) {
+	if raw := bucket.Get(iv.key); raw != nil {
+		local, err := decodeValue(iv.key, raw)
+		if err != nil {
+			return false, err
+		}
+		if !force && !newerThan(iv, local) {
+			return false, nil
+		}
+	}
+	// keep the bucket sequence ahead of replicated CAS values
+	if seq := bucket.Sequence(); iv.cas > 0 && uint64(iv.cas) > seq {
+		if err := bucket.SetSequence(uint64(iv.cas)); err != nil {
+			return false, err
+		}
+	}
+	if err := be.indexChange(tx, bucketName, bucket, iv); err != nil {
+		return false, err
+	}
+	if err := be.indexValue(tx, bucketName, iv); err != nil {
+		return false, err
+	}
+	if !iv.tombstone {
+		if err := be.noteAppliedWrite(tx, bucketName, iv.modified); err != nil {
+			return false, err
+		}
+	}
+	stored := *iv
+	if iv.tombstone {
+		stored.value = nil
+	} else if err := be.seal(&stored); err != nil {
+		return false, err
+	}
+	row := encodeValue(&stored)
+	if err := bucket.Put(iv.key, row); err != nil {
+		return false, err
+	}
+	if err := be.logChange(tx, bucketName, iv.key, row); err != nil {
+		return false, err
+	}
+	if iv.tombstone {
+		if err := untagKey(tx, bucketName, iv.key); err != nil {
+			return false, err
+		}
+		if err := be.markTombstones(tx); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// newerThan tells if iv wins over local, by modification time and then CAS
+func newerThan(iv *InternalValue, local *InternalValue) bool {
+	if iv.modified != local.modified {
+		return iv.modified > local.modified
+	}
+	return iv.cas > local.cas
+}
+
+/*
+ExportKey returns the stored record of key in the current bucket with all its
+metadata (flags, expiration, CAS, modification time, content type) and the CRC-32
+of the value, for ImportKey in another instance. Values are exported decrypted.
+Returns ErrKeyNotFound if the key doesn't exist, ErrWrongType for sets and
+hashes, whose members live outside the record
+*/
+func (be *KVBoltDBBackend) ExportKey(key []byte) (Record, error) {
+	key = be.normalizeKey(key)
+	if err := be.flushPending(); err != nil {
+		return Record{}, err
+	}
+	if err := be.rlock(); err != nil {
+		return Record{}, err
+	}
+	defer be.dbMutex.RUnlock()
+
+	var rec Record
+	err := be.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(be.bucketName))
+		if bucket == nil {
+			return ErrKeyNotFound
+		}
+		iv, err := be.liveValue(bucket, key)
+		if err != nil {
+			return err
+		}
+		if iv == nil {
+			return ErrKeyNotFound
+		}
+		if iv.kind == ValueSet || iv.kind == ValueHash {
+			return ErrWrongType
+		}
+		rec = iv.record(be.bucketName)
+		rec.Checksum, rec.HasChecksum = crc32.ChecksumIEEE(rec.Value), true
+		return nil
+	})
+	return rec, err
+}
+
+/*
+ImportKey stores a record from ExportKey verbatim, metadata included, replacing
+the local copy whatever its age. rec.Bucket defaults to the current bucket. With
+HasChecksum the checksum must match the value
+*/
+func (be *KVBoltDBBackend) ImportKey(rec Record) error {
+	if rec.HasChecksum && crc32.ChecksumIEEE(rec.Value) != rec.Checksum {
+		return fmt.Errorf("Checksum mismatch importing key %s", printableKey(rec.Key))
+	}
+	if rec.Bucket == "" {
+		be.dbMutex.RLock()
+		rec.Bucket = be.bucketName
+		be.dbMutex.RUnlock()
+	}
+	_, err := be.applyRecord(rec, true)
+	return err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// AdaptiveBatchDelay bounds defaults
+const (
+	DefaultBatchDelayMin = 100 * time.Microsecond
+	DefaultBatchDelayMax = bolt.DefaultMaxBatchDelay
+)
+
+// batchTuneWindow is how often the delay is reconsidered, batchTuneCalls the writes it needs to be
+const (
+	batchTuneWindow = 250 * time.Millisecond
+	batchTuneCalls  = 20
+)
+
+/*
+batchTuner picks the BatchDelay of batched writes from what they went through
+over the last batchTuneWindow: the fill, how many writes share a commit, and
+their average latency, the wait for company included. Writers mostly alone, less
+than 2 a commit, wasted their wait: the delay is halved. Else it climbs, moving
+the delay the same way, halved or half longer, while the latency doesn't get
+worse by more than 5%, and turning back when it does or at a bound. With too
+few writes to tell it stays. bolt reads MaxBatchDelay under a lock of its own,
+the batched writes hold lock shared so it's only changed between batches
+*/
+type batchTuner struct {
+	lock        sync.RWMutex
+	min, max    time.Duration
+	delay       int64
+	stats       sync.Mutex
+	lastTx      *bolt.Tx
+	calls       int
+	batches     int
+	latency     time.Duration
+	since       time.Time
+	lastLatency time.Duration
+	growing     bool
+}
+
+func newBatchTuner(opts BackendOptions) (*batchTuner, error) {
+	t := &batchTuner{min: opts.BatchDelayMin, max: opts.BatchDelayMax, since: time.Now()}
+	if t.min <= 0 {
+		t.min = DefaultBatchDelayMin
+	}
+	if t.max <= 0 {
+		t.max = DefaultBatchDelayMax
+	}
+	if t.min > t.max {
+		return nil, fmt.Errorf("BatchDelayMin %s above BatchDelayMax %s", t.min, t.max)
+	}
+	t.delay = int64(t.clamp(opts.BatchDelay))
+	return t, nil
+}
+
+func (t *batchTuner) clamp(delay time.Duration) time.Duration {
+	if delay < t.min {
+		return t.min
+	}
+	if delay > t.max {
+		return t.max
+	}
+	return delay
+}
+
+// current returns the delay in use
+func (t *batchTuner) current() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.delay))
+}
+
+// counted is called by each write of a batch with its transaction, one per commit
+func (t *batchTuner) counted(tx *bolt.Tx) {
+	t.stats.Lock()
+	if tx != t.lastTx {
+		t.lastTx = tx
+		t.batches++
+	}
+	t.stats.Unlock()
+}
+
+// observe counts a batched write that took latency, returns the delay to switch to, 0 to keep it
+func (t *batchTuner) observe(latency time.Duration) time.Duration {
+	t.stats.Lock()
+	defer t.stats.Unlock()
+	t.calls++
+	t.latency += latency
+	if time.Since(t.since) < batchTuneWindow {
+		return 0
+	}
+	calls, batches, average := t.calls, t.batches, t.latency/time.Duration(t.calls)
+	t.calls, t.batches, t.latency, t.since = 0, 0, 0, time.Now()
+	if calls < batchTuneCalls || batches == 0 {
+		return 0
+	}
+	delay := t.current()
+	if calls < 2*batches {
+		t.growing = false
+	} else if t.lastLatency > 0 && average > t.lastLatency+t.lastLatency/20 {
+		// the last move made it worse
+		t.growing = !t.growing
+	}
+	t.lastLatency = average
+	next := t.clamp(delay / 2)
+	if t.growing {
+		next = t.clamp(delay + delay/2)
+	}
+	if next == delay {
+		t.growing = !t.growing
+		return 0
+	}
+	return next
+}
+
+// batchAdaptive is db.Batch of fn, observed by the AdaptiveBatchDelay tuner
+func (be *KVBoltDBBackend) batchAdaptive(fn func(tx *bolt.Tx) error) error {
+	t := be.batchTuner
+	start := time.Now()
+	t.lock.RLock()
+	err := be.db.Batch(func(tx *bolt.Tx) error {
+		t.counted(tx)
+		return fn(tx)
+	})
+	t.lock.RUnlock()
+	if next := t.observe(time.Since(start)); next != 0 {
+		t.lock.Lock()
+		atomic.StoreInt64(&t.delay, int64(next))
+		for _, db := range be.databases() {
+			db.MaxBatchDelay = next
+		}
+		t.lock.Unlock()
+		log.Debug("Batch delay now %s", next)
+	}
+	return err
+}
+
+// BatchDelay returns the delay batched writes wait for company, the one chosen with AdaptiveBatchDelay
+func (be *KVBoltDBBackend) BatchDelay() time.Duration {
+	if be.batchTuner != nil {
+		return be.batchTuner.current()
+	}
+	if be.opts.BatchDelay > 0 {
+		return be.opts.BatchDelay
+	}
+	return bolt.DefaultMaxBatchDelay
+}
+
+// batchDelayStats returns the delay of batched writes for Stats, with BatchWrites
+func (be *KVBoltDBBackend) batchDelayStats() []stat {
+	if !be.opts.BatchWrites {
+		return nil
+	}
+	return []stat{{"batch_delay_us", int64(be.BatchDelay() / time.Microsecond)}}
+}
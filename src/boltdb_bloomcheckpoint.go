@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+Bloom checkpoints save the bloom filter of every loaded bucket to the metadata
+bucket of its database, every BloomCheckpointInterval and after every
+BloomCheckpointWrites writes, so opening a bucket doesn't have to scan all its
+keys. A checkpoint is the flate compressed counters of the filter and a mark,
+the time it was copied: loading one replays the change index from the mark,
+adding the keys written since that are still stored. The copy is taken under the
+exclusive lock, every write is either in it or stamped after the mark.
+
+The mark is moved back by replicated records older than it, which are indexed
+with the primary's modification time, and by clock steps up to bloomReplaySlack.
+Opening a bucket without checkpoints enabled drops its checkpoint, the writes of
+that session could be missing from the change index
+*/
+const (
+	bloomCheckpointPrefix     = "bloom_checkpoint:"
+	bloomCheckpointMarkPrefix = "bloom_checkpoint_mark:"
+)
+
+// bloomReplaySlack is replayed before the mark of a checkpoint, for clock steps
+const bloomReplaySlack = time.Minute
+
+// checkpointing tells if bloom checkpoints are enabled
+func (be *KVBoltDBBackend) checkpointing() bool {
+	return !be.opts.NoBloom && (be.opts.BloomCheckpointInterval > 0 || be.opts.BloomCheckpointWrites > 0)
+}
+
+/*
+encode writes the shard count and, for each shard, its key count and counters.
+Shards are locked one at a time, the filter must not change meanwhile
+*/
+func (bf BloomFilterKeys) encode(w io.Writer) error {
+	var n [8]byte
+	binary.BigEndian.PutUint32(n[:4], uint32(len(bf.shards)))
+	if _, err := w.Write(n[:4]); err != nil {
+		return err
+	}
+	for _, sh := range bf.shards {
+		sh.bloomLock.Lock()
+		binary.BigEndian.PutUint64(n[:], uint64(*sh.count))
+		_, err := w.Write(n[:])
+		if err == nil {
+			err = sh.cache.writeTo(w)
+		}
+		sh.bloomLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decode loads a filter written by encode into bf, sized the same way
+func (bf BloomFilterKeys) decode(r io.Reader) error {
+	var n [8]byte
+	if _, err := io.ReadFull(r, n[:4]); err != nil {
+		return err
+	}
+	if shards := binary.BigEndian.Uint32(n[:4]); int(shards) != len(bf.shards) {
+		return fmt.Errorf("Filter of %d shards, expected %d", shards, len(bf.shards))
+	}
+	for _, sh := range bf.shards {
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return err
+		}
+		sh.bloomLock.Lock()
+		*sh.count = int(binary.BigEndian.Uint64(n[:]))
+		err := sh.cache.readFrom(r)
+		sh.bloomLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+loadBloom builds the bloom filter of a bucket being opened: from its checkpoint
+when there is a usable one, else scanning its keys with buildBloom
+*/
+func (be *KVBoltDBBackend) loadBloom(db *bolt.DB, bucketName string, maxKeys int) (*BloomFilterKeys, error) {
+	if !be.checkpointing() {
+		if err := discardBloomCheckpoint(db, bucketName); err != nil {
+			return nil, err
+		}
+		return be.buildBloom(db, bucketName, maxKeys)
+	}
+	bf, replayed, err := be.restoreBloom(db, bucketName, maxKeys)
+	if err != nil {
+		log.Warning("Bucket %s bloom checkpoint unusable, scanning keys - %s", bucketName, err)
+	}
+	if bf == nil {
+		// the next checkpoint saves the scanned filter, even without writes
+		atomic.AddInt64(&be.checkpointWrites, 1)
+		return be.buildBloom(db, bucketName, maxKeys)
+	}
+	log.Info("Bucket %s bloom filter restored from checkpoint, %d changes replayed", bucketName, replayed)
+	return bf, nil
+}
+
+/*
+restoreBloom loads the checkpoint of a bucket and replays the changes since its
+mark. Returns a nil filter when there is no checkpoint
+*/
+func (be *KVBoltDBBackend) restoreBloom(db *bolt.DB, bucketName string, maxKeys int) (*BloomFilterKeys, int, error) {
+	var bf *BloomFilterKeys
+	replayed := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucketName))
+		if meta == nil {
+			return nil
+		}
+		data := meta.Get([]byte(bloomCheckpointPrefix + bucketName))
+		mark := meta.Get([]byte(bloomCheckpointMarkPrefix + bucketName))
+		if data == nil || len(mark) != 8 {
+			return nil
+		}
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		restored := NewShardedBloomFilterKeysWithHash(maxKeys, be.opts.BloomShards, be.opts.BloomHash)
+		if err := restored.decode(r); err != nil {
+			return err
+		}
+		bf = restored
+
+		bucket := tx.Bucket([]byte(bucketName))
+		changes := meta.Bucket([]byte(changesBucketPrefix + bucketName))
+		if bucket == nil || changes == nil {
+			return nil
+		}
+		from := int64(binary.BigEndian.Uint64(mark)) - int64(bloomReplaySlack)
+		if from < 0 {
+			from = 0
+		}
+		c := changes.Cursor()
+		for k, _ := c.Seek(changeIndexKey(from, nil)); k != nil; k, _ = c.Next() {
+			replayed++
+			raw := bucket.Get(k[8:])
+			if raw == nil {
+				continue
+			}
+			if iv, err := decodeValue(k[8:], raw); err != nil || iv.tombstone {
+				continue
+			}
+			bf.Add(k[8:])
+		}
+		return nil
+	})
+	if err != nil || bf == nil {
+		return nil, 0, err
+	}
+	return bf, replayed, nil
+}
+
+// dropBloomCheckpoint deletes the checkpoint of bucketName
+func dropBloomCheckpoint(tx *bolt.Tx, bucketName string) error {
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		return nil
+	}
+	// bolt refuses to delete a missing key that sorts right before a nested bucket
+	for _, k := range []string{bloomCheckpointPrefix + bucketName, bloomCheckpointMarkPrefix + bucketName} {
+		if meta.Get([]byte(k)) == nil {
+			continue
+		}
+		if err := meta.Delete([]byte(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardBloomCheckpoint deletes the checkpoint of bucketName from db, if it has one
+func discardBloomCheckpoint(db *bolt.DB, bucketName string) error {
+	found := false
+	db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket([]byte(metaBucketName)); meta != nil {
+			found = meta.Get([]byte(bloomCheckpointMarkPrefix+bucketName)) != nil
+		}
+		return nil
+	})
+	if !found {
+		return nil
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return dropBloomCheckpoint(tx, bucketName)
+	})
+}
+
+/*
+noteAppliedWrite keeps the checkpoint of bucketName valid for a replicated write
+indexed at modified: with checkpoints the mark moves back before it, without the
+checkpoint is dropped
+*/
+func (be *KVBoltDBBackend) noteAppliedWrite(tx *bolt.Tx, bucketName string, modified int64) error {
+	be.countCheckpointWrite()
+	meta := tx.Bucket([]byte(metaBucketName))
+	var mark []byte
+	if meta != nil {
+		mark = meta.Get([]byte(bloomCheckpointMarkPrefix + bucketName))
+	}
+	if !be.checkpointing() {
+		if mark == nil {
+			return nil
+		}
+		return dropBloomCheckpoint(tx, bucketName)
+	}
+
+	be.checkpointLock.Lock()
+	if floor, ok := be.checkpointFloors[bucketName]; !ok || modified < floor {
+		be.checkpointFloors[bucketName] = modified
+	}
+	be.checkpointLock.Unlock()
+	if len(mark) != 8 || int64(binary.BigEndian.Uint64(mark)) <= modified {
+		return nil
+	}
+	var lowered [8]byte
+	binary.BigEndian.PutUint64(lowered[:], uint64(modified))
+	return meta.Put([]byte(bloomCheckpointMarkPrefix+bucketName), lowered[:])
+}
+
+// countCheckpointWrite counts a write, starting a checkpoint every BloomCheckpointWrites
+func (be *KVBoltDBBackend) countCheckpointWrite() {
+	if be.checkpointKick == nil {
+		return
+	}
+	n := atomic.AddInt64(&be.checkpointWrites, 1)
+	if be.opts.BloomCheckpointWrites > 0 && n == int64(be.opts.BloomCheckpointWrites) {
+		select {
+		case be.checkpointKick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+/*
+CheckpointBlooms saves a checkpoint of the bloom filter of every loaded bucket
+now. The filters are copied under the exclusive lock, briefly stopping every
+operation, and compressed and stored while operations go on
+*/
+func (be *KVBoltDBBackend) CheckpointBlooms() error {
+	be.dbMutex.Lock()
+	if be.closed {
+		be.dbMutex.Unlock()
+		return ErrBackendClosed
+	}
+	mark := time.Now().UnixNano()
+	filters := make(map[string][]byte, len(be.keyCache))
+	for name, bf := range be.keyCache {
+		if bf.Pessimistic() {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := bf.encode(&buf); err != nil {
+			be.dbMutex.Unlock()
+			return err
+		}
+		filters[name] = buf.Bytes()
+	}
+	atomic.StoreInt64(&be.checkpointWrites, 0)
+	be.checkpointLock.Lock()
+	be.checkpointFloors = make(map[string]int64)
+	be.checkpointLock.Unlock()
+	be.dbMutex.Unlock()
+
+	if err := be.rlock(); err != nil {
+		return err
+	}
+	defer be.dbMutex.RUnlock()
+	for name, raw := range filters {
+		var data bytes.Buffer
+		w, _ := flate.NewWriter(&data, flate.BestSpeed)
+		w.Write(raw)
+		if err := w.Close(); err != nil {
+			return err
+		}
+		db, err := be.dbFor(name)
+		if err != nil {
+			return err
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+			if err != nil {
+				return err
+			}
+			if err := meta.Put([]byte(bloomCheckpointPrefix+name), data.Bytes()); err != nil {
+				return err
+			}
+			// replicated writes applied since the copy may predate the mark
+			bucketMark := mark
+			be.checkpointLock.Lock()
+			if floor, ok := be.checkpointFloors[name]; ok && floor < bucketMark {
+				bucketMark = floor
+			}
+			be.checkpointLock.Unlock()
+			var m [8]byte
+			binary.BigEndian.PutUint64(m[:], uint64(bucketMark))
+			return meta.Put([]byte(bloomCheckpointMarkPrefix+name), m[:])
+		})
+		if err != nil {
+			return fmt.Errorf("Error saving bloom checkpoint of bucket %s - %s", name, err)
+		}
+	}
+	return nil
+}
+
+// startCheckpointer starts the goroutine saving bloom checkpoints
+func (be *KVBoltDBBackend) startCheckpointer() {
+	be.checkpointFloors = make(map[string]int64)
+	be.checkpointKick = make(chan struct{}, 1)
+	be.checkpointStop = make(chan struct{})
+	be.checkpointDone = make(chan struct{})
+	stop, done, kick := be.checkpointStop, be.checkpointDone, be.checkpointKick
+	go func() {
+		defer close(done)
+		var tick <-chan time.Time
+		if be.opts.BloomCheckpointInterval > 0 {
+			ticker := time.NewTicker(be.opts.BloomCheckpointInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick:
+				if atomic.LoadInt64(&be.checkpointWrites) == 0 {
+					continue
+				}
+			case <-kick:
+			}
+			if err := be.CheckpointBlooms(); err != nil && err != ErrBackendClosed {
+				log.Error("Bloom checkpoint: %s", err)
+			}
+		}
+	}()
+}
+
+// stopCheckpointer stops the checkpoint goroutine and waits for a running checkpoint
+func (be *KVBoltDBBackend) stopCheckpointer() {
+	if be.checkpointStop == nil {
+		return
+	}
+	close(be.checkpointStop)
+	<-be.checkpointDone
+	be.checkpointStop = nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+)
+
+/*
+countingFilter is a counting bloom filter with 4 bit counters, two per byte, so
+keys can be removed. A counter that reaches 15 sticks there: it can't tell how
+many keys share it anymore, removing one of them must not zero it. Positions are
+derived from the two halves of the key 64 bit hash, FNV-1a unless a hash is
+given, and the counters can be saved and loaded as they are, see
+BloomFilterKeys.encode. A given hash keeps state: the filter isn't safe for
+concurrent use
+*/
+type countingFilter struct {
+	m        uint32
+	k        uint32
+	counters []byte
+	hash     hash.Hash64
+}
+
+// counterMax is the value where a counter saturates
+const counterMax = 0xf
+
+/*
+newCountingFilter sizes a filter for n keys at a false positive rate of p, h is
+the key hash, nil for FNV-1a
+*/
+func newCountingFilter(n int, p float64, h hash.Hash64) *countingFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint32(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Ceil(math.Ln2 * float64(m) / float64(n)))
+	if k < 1 {
+		k = 1
+	}
+	return &countingFilter{m: m, k: k, counters: make([]byte, (m+1)/2), hash: h}
+}
+
+// sum hashes key
+func (f *countingFilter) sum(key []byte) uint64 {
+	if f.hash != nil {
+		f.hash.Reset()
+		f.hash.Write(key)
+		return f.hash.Sum64()
+	}
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
+
+// positions calls fn with the counter index of each of the k hashes of key
+func (f *countingFilter) positions(key []byte, fn func(i uint32)) {
+	h := f.sum(key)
+	a, b := uint64(uint32(h)), uint64(uint32(h>>32)%f.m)
+	// a second hash multiple of m would put the k hashes on one counter
+	if b == 0 {
+		b = 1
+	}
+	for i := uint64(0); i < uint64(f.k); i++ {
+		fn(uint32((a + b*i) % uint64(f.m)))
+	}
+}
+
+func (f *countingFilter) counter(i uint32) byte {
+	return f.counters[i/2] >> (4 * (i % 2)) & counterMax
+}
+
+func (f *countingFilter) setCounter(i uint32, v byte) {
+	shift := 4 * (i % 2)
+	f.counters[i/2] = f.counters[i/2]&^(counterMax<<shift) | v<<shift
+}
+
+func (f *countingFilter) Add(key []byte) {
+	f.positions(key, func(i uint32) {
+		if c := f.counter(i); c < counterMax {
+			f.setCounter(i, c+1)
+		}
+	})
+}
+
+// Remove a key that tests positive, removing one never added would drop others
+func (f *countingFilter) Remove(key []byte) {
+	if !f.Test(key) {
+		return
+	}
+	f.positions(key, func(i uint32) {
+		if c := f.counter(i); c < counterMax {
+			f.setCounter(i, c-1)
+		}
+	})
+}
+
+func (f *countingFilter) Test(key []byte) bool {
+	found := true
+	f.positions(key, func(i uint32) {
+		if f.counter(i) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+func (f *countingFilter) Reset() {
+	for i := range f.counters {
+		f.counters[i] = 0
+	}
+}
+
+// hashProbe is hashed into saved filters, to tell the hash they were built with. Its version is the one of positions
+var hashProbe = []byte("beano bloom hash probe 2")
+
+// writeTo writes the filter dimensions, the hash of hashProbe and the counters to w
+func (f *countingFilter) writeTo(w io.Writer) error {
+	var dims [16]byte
+	binary.BigEndian.PutUint32(dims[:4], f.m)
+	binary.BigEndian.PutUint32(dims[4:8], f.k)
+	binary.BigEndian.PutUint64(dims[8:], f.sum(hashProbe))
+	if _, err := w.Write(dims[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.counters)
+	return err
+}
+
+// readFrom loads counters written by writeTo, the dimensions and hash must match the filter
+func (f *countingFilter) readFrom(r io.Reader) error {
+	var dims [16]byte
+	if _, err := io.ReadFull(r, dims[:]); err != nil {
+		return err
+	}
+	if m, k := binary.BigEndian.Uint32(dims[:4]), binary.BigEndian.Uint32(dims[4:8]); m != f.m || k != f.k {
+		return fmt.Errorf("Filter of %d counters and %d hashes, expected %d and %d", m, k, f.m, f.k)
+	}
+	if binary.BigEndian.Uint64(dims[8:]) != f.sum(hashProbe) {
+		return fmt.Errorf("Filter built with another hash")
+	}
+	_, err := io.ReadFull(r, f.counters)
+	return err
+}
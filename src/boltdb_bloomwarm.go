@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// warmBloomBatch is the number of keys warmBloom reads per transaction
+const warmBloomBatch = 10000
+
+// buildBloom is scanBloom, or warmBloom with the AsyncBloom option
+func (be *KVBoltDBBackend) buildBloom(db *bolt.DB, bucketName string, maxKeys int) (*BloomFilterKeys, error) {
+	if !be.opts.AsyncBloom || be.opts.NoBloom {
+		return be.scanBloom(db, bucketName, maxKeys)
+	}
+	return be.warmBloom(bucketName, maxKeys), nil
+}
+
+/*
+warmBloom returns the bloom filter of bucketName warming up: it tests positive,
+so lookups go to bolt, while a goroutine adds the keys on disk, warmBloomBatch
+per read transaction so a long scan doesn't hold back the remaps of writers.
+Writes add their keys meanwhile and removals are skipped, the scan may add the
+key later: a key deleted during the warm up is a false positive until rebuilt.
+A failed scan is logged and leaves the filter pessimistic
+*/
+func (be *KVBoltDBBackend) warmBloom(bucketName string, maxKeys int) *BloomFilterKeys {
+	bf := NewShardedBloomFilterKeysWithHash(maxKeys, be.opts.BloomShards, be.opts.BloomHash)
+	bf.warming = new(int32)
+	*bf.warming = 1
+	go func() {
+		start := time.Now()
+		var from []byte
+		for {
+			next, err := be.warmBatch(bucketName, bf, from)
+			if err == ErrBackendClosed {
+				return
+			}
+			if err != nil {
+				log.Error("Bucket %s bloom filter warm up failed, lookups keep going to bolt - %s", bucketName, err)
+				return
+			}
+			if next == nil {
+				break
+			}
+			from = next
+		}
+		atomic.StoreInt32(bf.warming, 0)
+		log.Info("Bucket %s bloom filter warmed up in %s", bucketName, time.Since(start))
+	}()
+	return bf
+}
+
+// warmBatch adds to bf up to warmBloomBatch keys after from, returns the last one read, nil at the end
+func (be *KVBoltDBBackend) warmBatch(bucketName string, bf *BloomFilterKeys, from []byte) ([]byte, error) {
+	if err := be.rlock(); err != nil {
+		return nil, err
+	}
+	defer be.dbMutex.RUnlock()
+	db, err := be.dbFor(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	var next []byte
+	err = db.View(func(tx *bolt.Tx) error {
+		next = nil
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		k, v := c.First()
+		if from != nil {
+			if k, v = c.Seek(from); bytes.Equal(k, from) {
+				k, v = c.Next()
+			}
+		}
+		for n := 0; k != nil && n < warmBloomBatch; k, v = c.Next() {
+			iv, err := decodeValue(k, v)
+			if err != nil {
+				return err
+			}
+			if !iv.tombstone {
+				bf.Add(k)
+			}
+			next = cloneValue(k)
+			n++
+		}
+		if k == nil {
+			next = nil
+		}
+		return nil
+	})
+	return next, err
+}
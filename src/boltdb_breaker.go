@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+ErrCircuitOpen is returned by writes while the circuit breaker is open, after
+BreakerThreshold write transactions in a row failed, see checkBreaker
+*/
+var ErrCircuitOpen = errors.New("Circuit open, the backend is failing writes")
+
+// DefaultBreakerRetry is the BreakerRetry default
+const DefaultBreakerRetry = 5 * time.Second
+
+// guardBreaker wraps fn to keep its error, so checkBreaker can tell bolt's failures from fn's
+func guardBreaker(fn func(tx *bolt.Tx) error, fnErr *error) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		*fnErr = fn(tx)
+		return *fnErr
+	}
+}
+
+/*
+checkBreaker counts the outcome err of a write transaction whose fn returned
+fnErr, for the circuit breaker: the transactions of the writes enterWrite gates
+that bolt fails, to begin, commit or sync them, not the ones the operation itself
+aborts like a CAS mismatch or a wrong type. BreakerThreshold failures in a row
+open it, writes then fail at once with ErrCircuitOpen instead of queueing on
+bolt's write lock, see enterBreaker. The first write to commit closes it again
+*/
+func (be *KVBoltDBBackend) checkBreaker(err error, fnErr error) {
+	threshold := be.opts.BreakerThreshold
+	if threshold <= 0 {
+		return
+	}
+	if err == nil {
+		atomic.StoreInt32(&be.breakerFailures, 0)
+		if atomic.SwapInt64(&be.breakerOpenAt, 0) != 0 {
+			log.Info("Write committed, circuit closed")
+		}
+		return
+	}
+	// bolt's Batch runs fn again alone when it fails with the others, fnErr is of the last run
+	if err == fnErr {
+		return
+	}
+	if atomic.AddInt32(&be.breakerFailures, 1) < int32(threshold) {
+		return
+	}
+	if atomic.SwapInt64(&be.breakerOpenAt, time.Now().UnixNano()) == 0 {
+		atomic.AddInt64(&be.breakerTrips, 1)
+		log.Error("%d writes failed in a row, circuit open - %s", threshold, err)
+	}
+}
+
+/*
+enterBreaker fails writes with ErrCircuitOpen while the circuit is open, letting
+a single one through every BreakerRetry to find out whether the backend recovered
+*/
+func (be *KVBoltDBBackend) enterBreaker() error {
+	at := atomic.LoadInt64(&be.breakerOpenAt)
+	if at == 0 {
+		return nil
+	}
+	retry := be.opts.BreakerRetry
+	if retry <= 0 {
+		retry = DefaultBreakerRetry
+	}
+	// at isn't reloaded, a write closing the circuit meanwhile must not reopen it
+	if !probeWrite(&be.breakerOpenAt, at, retry) {
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// CircuitOpen tells whether writes fail with ErrCircuitOpen
+func (be *KVBoltDBBackend) CircuitOpen() bool {
+	return atomic.LoadInt64(&be.breakerOpenAt) != 0
+}
+
+// breakerStats returns the counters of the circuit breaker for Stats, none without BreakerThreshold
+func (be *KVBoltDBBackend) breakerStats() []stat {
+	if be.opts.BreakerThreshold <= 0 {
+		return nil
+	}
+	open := int64(0)
+	if be.CircuitOpen() {
+		open = 1
+	}
+	return []stat{
+		{"breaker_open", open},
+		{"breaker_failures", int64(atomic.LoadInt32(&be.breakerFailures))},
+		{"breaker_trips", atomic.LoadInt64(&be.breakerTrips)},
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+With the BucketFiles option every bucket is stored in a bolt file of its own,
+next to the database file, with its tags, change index and collections. Writes to
+different buckets, like the reaper's or replicated records, don't wait for each
+other's write lock, at the cost of a file handle per bucket. The database file
+keeps the bucket configs and the expiration index is shared. Bucket files are
+opened on first use and stay open until Close. Backup copies the current bucket
+only and Reopen isn't supported
+*/
+
+// bucketFileSuffix separates the database filename from the bucket name
+const bucketFileSuffix = ".bucket."
+
+// bucketFilename is the file of bucket with BucketFiles, the name is path escaped
+func bucketFilename(filename string, bucket string) string {
+	return filename + bucketFileSuffix + url.PathEscape(bucket)
+}
+
+// bucketFileTimeout bounds the wait for the file lock of a bucket file being opened
+const bucketFileTimeout = 5 * time.Second
+
+/*
+dbFor returns the database holding bucket, opening its file with BucketFiles.
+The file is opened out of filesLock, the other buckets go on meanwhile, and
+callers after the same bucket wait for the first one
+*/
+func (be *KVBoltDBBackend) dbFor(bucket string) (*bolt.DB, error) {
+	if !be.opts.BucketFiles {
+		return be.main, nil
+	}
+	for {
+		be.filesLock.Lock()
+		if db := be.files[bucket]; db != nil {
+			be.filesLock.Unlock()
+			return db, nil
+		}
+		opening := be.opening[bucket]
+		if opening == nil {
+			break
+		}
+		be.filesLock.Unlock()
+		// the file is open or failed to, look again
+		<-opening
+	}
+	if be.opening == nil {
+		be.opening = make(map[string]chan struct{})
+	}
+	opened := make(chan struct{})
+	be.opening[bucket] = opened
+	be.filesLock.Unlock()
+
+	o := bolt.Options{}
+	if be.opts.BoltOptions != nil {
+		o = *be.opts.BoltOptions
+	}
+	if o.Timeout == 0 {
+		o.Timeout = bucketFileTimeout
+	}
+	db, err := bolt.Open(bucketFilename(be.filename, bucket), 0644, &o)
+	if err == nil {
+		be.tuneDB(db)
+		be.loadTombstoneMark(db)
+	}
+	be.filesLock.Lock()
+	delete(be.opening, bucket)
+	if err == nil {
+		be.files[bucket] = db
+	}
+	be.filesLock.Unlock()
+	close(opened)
+	return db, err
+}
+
+// bucketFileExists tells if bucket can have keys: with BucketFiles, if its file is open or on disk
+func (be *KVBoltDBBackend) bucketFileExists(bucket string) bool {
+	if !be.opts.BucketFiles {
+		return true
+	}
+	be.filesLock.Lock()
+	open := be.files[bucket] != nil
+	be.filesLock.Unlock()
+	if open {
+		return true
+	}
+	_, err := os.Stat(bucketFilename(be.filename, bucket))
+	return err == nil
+}
+
+// databases returns the database file and the open bucket files, sorted by bucket
+func (be *KVBoltDBBackend) databases() []*bolt.DB {
+	be.filesLock.Lock()
+	defer be.filesLock.Unlock()
+	names := make([]string, 0, len(be.files))
+	for name := range be.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dbs := []*bolt.DB{be.main}
+	for _, name := range names {
+		dbs = append(dbs, be.files[name])
+	}
+	return dbs
+}
+
+// bucketFileNames returns the buckets with a file on disk, open or not
+func (be *KVBoltDBBackend) bucketFileNames() ([]string, error) {
+	if !be.opts.BucketFiles {
+		return nil, nil
+	}
+	prefix := be.filename + bucketFileSuffix
+	paths, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, path := range paths {
+		if name, err := url.PathUnescape(strings.TrimPrefix(path, prefix)); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// closeBucketFiles closes the open bucket files
+func (be *KVBoltDBBackend) closeBucketFiles() {
+	be.filesLock.Lock()
+	defer be.filesLock.Unlock()
+	for name, db := range be.files {
+		db.Close()
+		delete(be.files, name)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+KeyMeta describes a stored key as memcached's lru_crawler metadump does.
+Expiration is a unix timestamp, 0 when the key never expires
+*/
+type KeyMeta struct {
+	Key         []byte
+	Size        int
+	Flags       int32
+	Expiration  int
+	CAS         int64
+	Modified    time.Time
+	ContentType ContentType
+	Source      []byte
+}
+
+/*
+String formats m as a metadump line, e.g.
+key=beano exp=-1 la=1500000000 cas=3 fetch=no cls=1 size=7
+beano has no slab classes, cls is always 1
+*/
+func (m KeyMeta) String() string {
+	exp := -1
+	if m.Expiration != 0 {
+		exp = m.Expiration
+	}
+	return fmt.Sprintf("key=%s exp=%d la=%d cas=%d fetch=no cls=1 size=%d",
+		url.QueryEscape(string(m.Key)), exp, m.Modified.Unix(), m.CAS, m.Size)
+}
+
+// errDumpLimit stops CacheDump once limit keys were collected
+var errDumpLimit = errors.New("cachedump limit reached")
+
+/*
+CacheDump returns the metadata of up to limit keys of the current bucket, all
+of them if limit <= 0. Expired and deleted keys are skipped
+*/
+func (be *KVBoltDBBackend) CacheDump(limit int) ([]KeyMeta, error) {
+	var ret []KeyMeta
+	err := be.CacheDumpFunc(func(m KeyMeta) error {
+		ret = append(ret, m)
+		if limit > 0 && len(ret) == limit {
+			return errDumpLimit
+		}
+		return nil
+	})
+	if err != nil && err != errDumpLimit {
+		return nil, err
+	}
+	return ret, nil
+}
+
+/*
+CacheDumpFunc streams the metadata of the live keys of the current bucket to fn
+in key order, within a single read transaction. An error from fn stops the dump
+and is returned
+*/
+func (be *KVBoltDBBackend) CacheDumpFunc(fn func(KeyMeta) error) error {
+	if err := be.flushPending(); err != nil {
+		return err
+	}
+	if err := be.rlock(); err != nil {
+		return err
+	}
+	defer be.dbMutex.RUnlock()
+	now := time.Now()
+	return be.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(be.bucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			iv, err := decodeValue(k, v)
+			if err != nil {
+				return err
+			}
+			if iv.tombstone || iv.expired(now) {
+				return nil
+			}
+			return fn(be.keyMeta(iv))
+		})
+	})
+}
+
+// keyMeta returns the metadata of a stored value
+func (be *KVBoltDBBackend) keyMeta(iv *InternalValue) KeyMeta {
+	return KeyMeta{
+		Key:         append([]byte(nil), iv.key...),
+		Size:        be.plainSize(iv),
+		Flags:       iv.flags,
+		Expiration:  iv.expiration,
+		CAS:         iv.cas,
+		Modified:    iv.modifiedTime(),
+		ContentType: iv.ctype,
+		Source:      append([]byte(nil), iv.source...),
+	}
+}
+
+/*
+Meta returns the metadata of key without its value, nil when the key doesn't
+exist
+*/
+func (be *KVBoltDBBackend) Meta(key []byte) (*KeyMeta, error) {
+	key = be.normalizeKey(key)
+	if err := be.flushPending(); err != nil {
+		return nil, err
+	}
+	if err := be.rlock(); err != nil {
+		return nil, err
+	}
+	defer be.dbMutex.RUnlock()
+	var ret *KeyMeta
+	err := be.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(be.bucketName))
+		if bucket == nil {
+			return nil
+		}
+		raw := bucket.Get(key)
+		if raw == nil {
+			return nil
+		}
+		iv, err := decodeValue(key, raw)
+		if err != nil || iv.tombstone || iv.expired(time.Now()) {
+			return err
+		}
+		m := be.keyMeta(iv)
+		ret = &m
+		return nil
+	})
+	return ret, err
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+With ChangeLog every write and delete of a bucket is appended, in its write
+transaction, to a log kept in a nested bucket of the metadata bucket, keyed by
+the big endian sequence of the log bucket: the Cursor of the change. Entries hold
+the key, as a uvarint length and its bytes, and the row as stored, so encrypted
+values stay encrypted. ChangeFeed reads it back. Like the replication stream,
+Flush and the keys deleted by the reaper aren't logged. The reaper drops the
+entries older than ChangeLogRetention, when set, the log grows forever otherwise
+*/
+const changeLogBucketPrefix = "changelog:"
+
+// changeFeedBatch is the number of changes a feed reads per transaction
+const changeFeedBatch = 100
+
+/*
+Cursor is the position of a change in the log of its bucket. Cursors of a bucket
+grow by one with every logged change, the first one is 1
+*/
+type Cursor uint64
+
+// Change is a mutation read from the change log, at Cursor
+type Change struct {
+	Cursor Cursor
+	Record
+}
+
+/*
+ErrCursorTrimmed is returned by ChangeFeed when changes after the cursor were
+already dropped by the ChangeLogRetention, the feed can't be resumed without gaps
+*/
+var ErrCursorTrimmed = errors.New("Changes after the cursor were trimmed from the log")
+
+// changeFeed is a running ChangeFeed, stop ends it
+type changeFeed struct {
+	ch   chan Change
+	stop chan struct{}
+}
+
+func changeLogKey(cursor Cursor) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(cursor))
+	return k
+}
+
+// logChange appends the change of key to the log of bucketName, row is the value as stored
+func (be *KVBoltDBBackend) logChange(tx *bolt.Tx, bucketName string, key []byte, row []byte) error {
+	if !be.opts.ChangeLog {
+		return nil
+	}
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+	if err != nil {
+		return err
+	}
+	changes, err := meta.CreateBucketIfNotExists([]byte(changeLogBucketPrefix + bucketName))
+	if err != nil {
+		return err
+	}
+	seq, err := changes.NextSequence()
+	if err != nil {
+		return err
+	}
+	entry := appendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(key)+len(row)), uint64(len(key)))
+	entry = append(append(entry, key...), row...)
+	if err := changes.Put(changeLogKey(Cursor(seq)), entry); err != nil {
+		return err
+	}
+	tx.OnCommit(be.notifyFeeds)
+	return nil
+}
+
+// decodeChange parses a log entry
+func decodeChange(k []byte, entry []byte) (*InternalValue, error) {
+	n, size := binary.Uvarint(entry)
+	if size <= 0 || n > uint64(len(entry)-size) {
+		return nil, fmt.Errorf("Truncated change log entry %d", binary.BigEndian.Uint64(k))
+	}
+	key := entry[size : size+int(n)]
+	return decodeValue(key, entry[size+int(n):])
+}
+
+/*
+trimmedUpTo returns the last cursor dropped from the log: the one before the
+first entry, or the last one given when the log is empty
+*/
+func trimmedUpTo(changes *bolt.Bucket) Cursor {
+	if k, _ := changes.Cursor().First(); k != nil {
+		return Cursor(binary.BigEndian.Uint64(k)) - 1
+	}
+	return Cursor(changes.Sequence())
+}
+
+// trimChangeLog drops the changes of bucketName older than the ChangeLogRetention
+func (be *KVBoltDBBackend) trimChangeLog(tx *bolt.Tx, bucketName string, now time.Time) error {
+	if be.opts.ChangeLogRetention <= 0 {
+		return nil
+	}
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		return nil
+	}
+	changes := meta.Bucket([]byte(changeLogBucketPrefix + bucketName))
+	if changes == nil {
+		return nil
+	}
+	deadline := now.Add(-be.opts.ChangeLogRetention).UnixNano()
+	var doomed [][]byte
+	c := changes.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if iv, err := decodeChange(k, v); err == nil && iv.modified >= deadline {
+			break
+		}
+		doomed = append(doomed, append([]byte(nil), k...))
+	}
+	for _, k := range doomed {
+		if err := changes.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyFeeds wakes the feeds waiting for new changes
+func (be *KVBoltDBBackend) notifyFeeds() {
+	be.feedLock.Lock()
+	defer be.feedLock.Unlock()
+	if be.feedSignal != nil {
+		close(be.feedSignal)
+		be.feedSignal = nil
+	}
+}
+
+// feedSignaled returns a channel closed at the next logged change
+func (be *KVBoltDBBackend) feedSignaled() <-chan struct{} {
+	be.feedLock.Lock()
+	defer be.feedLock.Unlock()
+	if be.feedSignal == nil {
+		be.feedSignal = make(chan struct{})
+	}
+	return be.feedSignal
+}
+
+/*
+ChangeFeed returns the changes of the current bucket logged after from, oldest
+first, then the new ones as they commit. from is the Cursor of the last change
+seen, 0 for the oldest change kept. Returns ErrCursorTrimmed if changes after
+from are no longer logged. The channel is closed by CloseChangeFeed, by Close,
+and when the feed falls behind the retention; a consumer that stops reading
+holds its feed, not the writers. Requires the ChangeLog option
+*/
+func (be *KVBoltDBBackend) ChangeFeed(from Cursor) (<-chan Change, error) {
+	if !be.opts.ChangeLog {
+		return nil, fmt.Errorf("ChangeFeed needs the ChangeLog option")
+	}
+	if err := be.flushPending(); err != nil {
+		return nil, err
+	}
+	if err := be.rlock(); err != nil {
+		return nil, err
+	}
+	defer be.dbMutex.RUnlock()
+	bucketName := be.bucketName
+	err := be.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucketName))
+		if meta == nil {
+			return nil
+		}
+		if changes := meta.Bucket([]byte(changeLogBucketPrefix + bucketName)); changes != nil && from > 0 && from < trimmedUpTo(changes) {
+			return ErrCursorTrimmed
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	feed := &changeFeed{ch: make(chan Change, changeFeedBatch), stop: make(chan struct{})}
+	be.feedLock.Lock()
+	if be.feeds == nil {
+		be.feeds = make(map[<-chan Change]*changeFeed)
+	}
+	be.feeds[feed.ch] = feed
+	be.feedLock.Unlock()
+	go be.runFeed(bucketName, from, feed)
+	return feed.ch, nil
+}
+
+// CloseChangeFeed ends a feed returned by ChangeFeed, its channel is closed
+func (be *KVBoltDBBackend) CloseChangeFeed(ch <-chan Change) {
+	be.feedLock.Lock()
+	defer be.feedLock.Unlock()
+	if feed := be.feeds[ch]; feed != nil {
+		close(feed.stop)
+		delete(be.feeds, ch)
+	}
+}
+
+// closeChangeFeeds ends every feed, for Close
+func (be *KVBoltDBBackend) closeChangeFeeds() {
+	be.feedLock.Lock()
+	defer be.feedLock.Unlock()
+	for ch, feed := range be.feeds {
+		close(feed.stop)
+		delete(be.feeds, ch)
+	}
+}
+
+// runFeed sends the changes of bucketName after cursor to feed until it's stopped
+func (be *KVBoltDBBackend) runFeed(bucketName string, cursor Cursor, feed *changeFeed) {
+	defer close(feed.ch)
+	defer be.CloseChangeFeed(feed.ch)
+	for {
+		// taken before reading, a change committed meanwhile isn't missed
+		signaled := be.feedSignaled()
+		changes, err := be.readChanges(bucketName, cursor)
+		if err != nil {
+			if err != ErrBackendClosed {
+				log.Error("Change feed of bucket %s stopped at %d - %s", bucketName, cursor, err)
+			}
+			return
+		}
+		for _, change := range changes {
+			select {
+			case feed.ch <- change:
+				cursor = change.Cursor
+			case <-feed.stop:
+				return
+			}
+		}
+		if len(changes) == changeFeedBatch {
+			continue
+		}
+		select {
+		case <-signaled:
+		case <-feed.stop:
+			return
+		}
+	}
+}
+
+// readChanges returns up to changeFeedBatch changes of bucketName after cursor
+func (be *KVBoltDBBackend) readChanges(bucketName string, cursor Cursor) ([]Change, error) {
+	if err := be.rlock(); err != nil {
+		return nil, err
+	}
+	defer be.dbMutex.RUnlock()
+	db, err := be.dbFor(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	var ret []Change
+	err = db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucketName))
+		if meta == nil {
+			return nil
+		}
+		changes := meta.Bucket([]byte(changeLogBucketPrefix + bucketName))
+		if changes == nil {
+			return nil
+		}
+		if cursor > 0 && cursor < trimmedUpTo(changes) {
+			return ErrCursorTrimmed
+		}
+		c := changes.Cursor()
+		for k, v := c.Seek(changeLogKey(cursor + 1)); k != nil && len(ret) < changeFeedBatch; k, v = c.Next() {
+			iv, err := decodeChange(k, v)
+			if err != nil {
+				return err
+			}
+			if err := be.open(iv); err != nil {
+				return err
+			}
+			ret = append(ret, Change{Cursor: Cursor(binary.BigEndian.Uint64(k)), Record: iv.record(bucketName)})
+		}
+		return nil
+	})
+	return ret, err
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+With ChangeIndex every write and delete records the key in a time ordered index,
+a nested bucket of the metadata bucket per data bucket, keyed by the big endian
+modification time followed by the key. A key keeps a single entry, its last
+change: the previous one is removed when the key is written again
+*/
+const changesBucketPrefix = "changes:"
+
+func changeIndexKey(modified int64, key []byte) []byte {
+	k := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(k, uint64(modified))
+	copy(k[8:], key)
+	return k
+}
+
+// indexChange records that iv is the last change of its key, iv must not be stored yet
+func (be *KVBoltDBBackend) indexChange(tx *bolt.Tx, bucketName string, bucket *bolt.Bucket, iv *InternalValue) error {
+	if !be.opts.ChangeIndex {
+		return nil
+	}
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+	if err != nil {
+		return err
+	}
+	changes, err := meta.CreateBucketIfNotExists([]byte(changesBucketPrefix + bucketName))
+	if err != nil {
+		return err
+	}
+	if raw := bucket.Get(iv.key); raw != nil {
+		if old, err := decodeValue(iv.key, raw); err == nil && old.modified != 0 {
+			if err := changes.Delete(changeIndexKey(old.modified, iv.key)); err != nil {
+				return err
+			}
+		}
+	}
+	return changes.Put(changeIndexKey(iv.modified, iv.key), nil)
+}
+
+// dropChanges deletes the change index of bucketName
+func dropChanges(tx *bolt.Tx, bucketName string) error {
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil || meta.Bucket([]byte(changesBucketPrefix+bucketName)) == nil {
+		return nil
+	}
+	return meta.DeleteBucket([]byte(changesBucketPrefix + bucketName))
+}
+
+/*
+ChangedSince returns, oldest first, up to limit keys of the current bucket
+written or deleted after t (all of them if limit <= 0). Deleted keys are
+included, a Get tells them apart. Requires the ChangeIndex option, keys written
+before it was enabled are not indexed
+*/
+func (be *KVBoltDBBackend) ChangedSince(t time.Time, limit int) ([][]byte, error) {
+	if err := be.flushPending(); err != nil {
+		return nil, err
+	}
+	if err := be.rlock(); err != nil {
+		return nil, err
+	}
+	defer be.dbMutex.RUnlock()
+
+	var ret [][]byte
+	err := be.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucketName))
+		if meta == nil {
+			return nil
+		}
+		changes := meta.Bucket([]byte(changesBucketPrefix + be.bucketName))
+		if changes == nil {
+			return nil
+		}
+		from := int64(0)
+		if t.After(time.Unix(0, 0)) {
+			from = t.UnixNano() + 1
+		}
+		c := changes.Cursor()
+		for k, _ := c.Seek(changeIndexKey(from, nil)); k != nil; k, _ = c.Next() {
+			ret = append(ret, append([]byte(nil), k[8:]...))
+			if limit > 0 && len(ret) == limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+/*
+reapChanges drops the change entries older than deadline of keys that are no
+longer stored, so deleted keys don't stay in the index forever
+*/
+func reapChanges(tx *bolt.Tx, bucketName string, bucket *bolt.Bucket, deadline int64) error {
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		return nil
+	}
+	changes := meta.Bucket([]byte(changesBucketPrefix + bucketName))
+	if changes == nil {
+		return nil
+	}
+	var doomed [][]byte
+	c := changes.Cursor()
+	for k, _ := c.First(); k != nil && int64(binary.BigEndian.Uint64(k[:8])) < deadline; k, _ = c.Next() {
+		if bucket.Get(k[8:]) == nil {
+			doomed = append(doomed, append([]byte(nil), k...))
+		}
+	}
+	for _, k := range doomed {
+		if err := changes.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+KeyAgeRange returns the modification times of the least and most recently
+written keys of the current bucket, from the ends of the change index, with no
+scan of the bucket. Deleted and expired keys are skipped. Zero times for an
+empty bucket. Requires the ChangeIndex option
+*/
+func (be *KVBoltDBBackend) KeyAgeRange() (time.Time, time.Time, error) {
+	var oldest, newest time.Time
+	if !be.opts.ChangeIndex {
+		return oldest, newest, fmt.Errorf("KeyAgeRange needs the ChangeIndex option")
+	}
+	if err := be.flushPending(); err != nil {
+		return oldest, newest, err
+	}
+	if err := be.rlock(); err != nil {
+		return oldest, newest, err
+	}
+	defer be.dbMutex.RUnlock()
+
+	err := be.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(be.bucketName))
+		meta := tx.Bucket([]byte(metaBucketName))
+		if bucket == nil || meta == nil {
+			return nil
+		}
+		changes := meta.Bucket([]byte(changesBucketPrefix + be.bucketName))
+		if changes == nil {
+			return nil
+		}
+		now := time.Now()
+		live := func(k []byte) bool {
+			raw := bucket.Get(k[8:])
+			if raw == nil {
+				return false
+			}
+			iv, err := decodeValue(k[8:], raw)
+			return err == nil && !iv.tombstone && !iv.expired(now)
+		}
+		c := changes.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if live(k) {
+				oldest = time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))
+				break
+			}
+		}
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			if live(k) {
+				newest = time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return oldest, newest, nil
+}
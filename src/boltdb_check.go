@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// checkProgressEvery is how many keys Check decodes between progress logs
+const checkProgressEvery = 100000
+
+/*
+Check verifies the database: bolt's consistency checker runs on the data file and
+the expiration index, then every stored row is decoded to catch bad headers.
+Progress is logged per bucket and every checkProgressEvery keys. Returns every
+error found, none when the database is sound
+*/
+func (be *KVBoltDBBackend) Check() []error {
+	if err := be.rlock(); err != nil {
+		return []error{err}
+	}
+	defer be.dbMutex.RUnlock()
+
+	var errs []error
+	dbs := be.databases()
+	for _, db := range append(dbs, be.expirationdb) {
+		db.View(func(tx *bolt.Tx) error {
+			for err := range tx.Check() {
+				errs = append(errs, fmt.Errorf("%s: %s", db.Path(), err))
+			}
+			return nil
+		})
+	}
+
+	for _, db := range dbs {
+		db.View(func(tx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+				if string(name) == metaBucketName {
+					return nil
+				}
+				keys := 0
+				bucket.ForEach(func(k, v []byte) error {
+					if _, err := decodeValue(k, v); err != nil {
+						errs = append(errs, fmt.Errorf("Bucket %s: %s", string(name), err))
+					}
+					keys++
+					if keys%checkProgressEvery == 0 {
+						log.Info("Check: bucket %s, %d keys checked", string(name), keys)
+					}
+					return nil
+				})
+				log.Info("Check: bucket %s done, %d keys", string(name), keys)
+				return nil
+			})
+		})
+	}
+	return errs
+}
+
+/*
+VerifyBloom scans the current bucket and returns the stored keys its bloom filter
+tests as absent. Any is a bug: Get trusts a negative test and would miss the key.
+False positives are expected and not reported, neither are tombstones and
+expired keys, which read as misses anyway. The scan runs under the exclusive
+lock, so no write is between its commit and its bloom update, and every
+operation waits for it
+*/
+func (be *KVBoltDBBackend) VerifyBloom() ([][]byte, error) {
+	if err := be.flushPending(); err != nil {
+		return nil, err
+	}
+	be.dbMutex.Lock()
+	defer be.dbMutex.Unlock()
+	if be.closed {
+		return nil, ErrBackendClosed
+	}
+
+	bf := be.keyCache[be.bucketName]
+	if bf == nil || bf.Pessimistic() {
+		return nil, nil
+	}
+	var falseNegatives [][]byte
+	now := time.Now()
+	err := be.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(be.bucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			iv, err := decodeValue(k, v)
+			if err != nil {
+				return err
+			}
+			if !iv.tombstone && !iv.expired(now) && !bf.Test(k) {
+				falseNegatives = append(falseNegatives, cloneValue(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(falseNegatives) > 0 {
+		log.Error("Bloom filter of bucket %s misses %d stored keys", be.bucketName, len(falseNegatives))
+	}
+	return falseNegatives, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+With CoalesceInterval set, Set doesn't write right away: the latest value of each
+key is buffered and a background goroutine writes the whole buffer in a single
+transaction every interval, so a key updated hundreds of times per second costs
+one write per interval. Reads look at the buffer first. Every other operation
+flushes the buffer before running, so it sees the buffered writes in order.
+Buffered writes are lost if the process dies before the flush
+*/
+type coalescer struct {
+	lock      sync.Mutex
+	pending   map[string]map[string]*InternalValue
+	flushing  map[string]map[string]*InternalValue
+	flushLock sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{pending: make(map[string]map[string]*InternalValue)}
+}
+
+// bufferSet buffers the latest value of key in the current bucket
+func (be *KVBoltDBBackend) bufferSet(key []byte, value []byte) error {
+	if err := be.rlock(); err != nil {
+		return err
+	}
+	defer be.dbMutex.RUnlock()
+	cfg := be.BucketConfigFor(be.bucketName)
+	if limit := cfg.MaxValueSize; limit > 0 && len(value) > limit {
+		return fmt.Errorf("Value for key %s is %d bytes, bucket %s accepts up to %d", printableKey(key), len(value), be.bucketName, limit)
+	}
+	iv := &InternalValue{
+		key:        cloneValue(key),
+		expiration: be.expirationFor(cfg.DefaultTTL, time.Now()),
+		value:      cloneValue(value),
+	}
+
+	be.coalesce.lock.Lock()
+	defer be.coalesce.lock.Unlock()
+	bucket := be.coalesce.pending[be.bucketName]
+	if bucket == nil {
+		bucket = make(map[string]*InternalValue)
+		be.coalesce.pending[be.bucketName] = bucket
+	}
+	bucket[string(key)] = iv
+	return nil
+}
+
+// buffered returns the value of key waiting to be flushed, if any
+func (be *KVBoltDBBackend) buffered(key []byte) (*InternalValue, bool) {
+	if be.coalesce == nil {
+		return nil, false
+	}
+	be.coalesce.lock.Lock()
+	defer be.coalesce.lock.Unlock()
+	if iv, ok := be.coalesce.pending[be.bucketName][string(key)]; ok {
+		return iv, true
+	}
+	iv, ok := be.coalesce.flushing[be.bucketName][string(key)]
+	return iv, ok
+}
+
+/*
+flushPending writes the buffered values, a transaction per bucket. Flushes run
+one at a time: the buffer is swapped out for an empty one and its values stay
+visible to reads until their transaction commits, those that fail to are put
+back unless a newer Set replaced them. Callers must not hold dbMutex
+*/
+func (be *KVBoltDBBackend) flushPending() error {
+	c := be.coalesce
+	if c == nil {
+		return nil
+	}
+	c.flushLock.Lock()
+	defer c.flushLock.Unlock()
+	c.lock.Lock()
+	flushing := c.pending
+	if len(flushing) == 0 {
+		c.lock.Unlock()
+		return nil
+	}
+	c.flushing, c.pending = flushing, make(map[string]map[string]*InternalValue)
+	c.lock.Unlock()
+	defer c.unflush()
+
+	if err := be.rlock(); err != nil {
+		return err
+	}
+	defer be.dbMutex.RUnlock()
+	for name, pending := range flushing {
+		db, err := be.dbFor(name)
+		if err == nil {
+			err = be.updateOn(db, func(tx *bolt.Tx) error {
+				bucket, err := tx.CreateBucketIfNotExists([]byte(name))
+				if err != nil {
+					return err
+				}
+				bf := be.keyCache[name]
+				for _, iv := range pending {
+					if bf != nil {
+						bf.Add(iv.key)
+					}
+					// putValue fills cas and modified, keep the buffered copy untouched
+					stored := *iv
+					if err := be.putValue(tx, name, bucket, &stored); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		if err == ErrDiskFull {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("Error flushing buffered writes - %s", err)
+		}
+
+		c.lock.Lock()
+		delete(c.flushing, name)
+		c.lock.Unlock()
+		for _, iv := range pending {
+			if iv.expiration == 0 {
+				continue
+			}
+			if err := be.indexExpiration(name, iv.key, iv.expiration); err != nil {
+				log.Error("Error indexing expiration of key %s - %s", printableKey(iv.key), err)
+			}
+		}
+	}
+	return nil
+}
+
+// unflush puts back the values of a flush that didn't commit, unless Set again since
+func (c *coalescer) unflush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for name, flushing := range c.flushing {
+		bucket := c.pending[name]
+		if bucket == nil {
+			bucket = make(map[string]*InternalValue, len(flushing))
+			c.pending[name] = bucket
+		}
+		for k, iv := range flushing {
+			if _, newer := bucket[k]; !newer {
+				bucket[k] = iv
+			}
+		}
+	}
+	c.flushing = nil
+}
+
+func (be *KVBoltDBBackend) startCoalescer() {
+	be.coalesce.stop = make(chan struct{})
+	be.coalesce.done = make(chan struct{})
+	go func() {
+		defer close(be.coalesce.done)
+		ticker := time.NewTicker(be.opts.CoalesceInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-be.coalesce.stop:
+				return
+			case <-ticker.C:
+				if err := be.flushPending(); err != nil {
+					log.Error("Coalescer: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopCoalescer stops the flush goroutine and writes what is still buffered
+func (be *KVBoltDBBackend) stopCoalescer() {
+	if be.coalesce == nil || be.coalesce.stop == nil {
+		return
+	}
+	close(be.coalesce.stop)
+	<-be.coalesce.done
+	be.coalesce.stop = nil
+	if err := be.flushPending(); err != nil {
+		log.Error("Coalescer: %s", err)
+	}
+}
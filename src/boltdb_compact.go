@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// compactSuffix names the temporary bucket used by CompactBucket
+const compactSuffix = ".compacting"
+
+/*
+CompactBucket rewrites a single bucket with only its live contents, dropping
+expired keys, so the pages held by deleted keys go back to bolt's freelist.
+bolt can't rename buckets, so the live rows are copied to a temporary bucket
+and back under the original name within the same transaction: while it runs
+the bucket takes twice its space in the file. Tombstones are kept until the
+reaper purges them. Lighter than a whole database compaction, but operations
+wait for it
+*/
+func (be *KVBoltDBBackend) CompactBucket(name string) error {
+	if err := be.allowOp(OpCompact); err != nil {
+		return err
+	}
+	if name == metaBucketName {
+		return fmt.Errorf("Bucket %s is reserved", name)
+	}
+	if err := be.flushPending(); err != nil {
+		return err
+	}
+	// exclusive: keyCache is written, and the scan replacing the bloom filter
+	// must not miss a write committed while it runs
+	be.dbMutex.Lock()
+	defer be.dbMutex.Unlock()
+	if be.closed {
+		return ErrBackendClosed
+	}
+
+	db, err := be.dbFor(name)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	live := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(name))
+		if bucket == nil {
+			return fmt.Errorf("Bucket %q not found!", name)
+		}
+		tmpName := []byte(name + compactSuffix)
+		tmp, err := tx.CreateBucket(tmpName)
+		if err != nil {
+			return err
+		}
+		err = copyBucket(tmp, bucket, func(k, v []byte) bool {
+			iv, err := decodeValue(k, v)
+			return err != nil || !iv.expired(now)
+		})
+		if err != nil {
+			return err
+		}
+		sequence := bucket.Sequence()
+
+		if err := tx.DeleteBucket([]byte(name)); err != nil {
+			return err
+		}
+		bucket, err = tx.CreateBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+		// CAS values come from the bucket sequence, it must keep growing
+		if err := bucket.SetSequence(sequence); err != nil {
+			return err
+		}
+		if err := copyBucket(bucket, tmp, nil); err != nil {
+			return err
+		}
+		live = bucket.Stats().KeyN
+		return tx.DeleteBucket(tmpName)
+	})
+	if err != nil {
+		return err
+	}
+
+	if be.keyCache[name] != nil {
+		bf, err := be.scanBloom(db, name, be.BucketConfigFor(name).MaxKeys)
+		if err != nil {
+			return err
+		}
+		be.keyCache[name] = bf
+	}
+	log.Info("Compacted bucket %s, %d keys kept", name, live)
+	return nil
+}
+
+// copyBucket copies the rows of src accepted by keep (all when nil) into dst
+func copyBucket(dst *bolt.Bucket, src *bolt.Bucket, keep func(k, v []byte) bool) error {
+	return src.ForEach(func(k, v []byte) error {
+		if keep != nil && !keep(k, v) {
+			return nil
+		}
+		return dst.Put(k, v)
+	})
+}
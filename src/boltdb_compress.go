@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+)
+
+/*
+With the Compress option values are gzipped before they're encrypted and stored,
+when ShouldCompress accepts them and the compressed form is smaller. The row
+header flags compressed values and records their uncompressed size, so reads
+know to inflate them and sizes are reported without it
+*/
+const (
+	// compressMinSize is the size under which DefaultShouldCompress doesn't bother
+	compressMinSize = 256
+	// compressProbeSize is the prefix of a value DefaultShouldCompress samples
+	compressProbeSize = 4096
+	// compressMaxEntropy is the entropy, in bits per byte, above which a sample is taken as compressed already
+	compressMaxEntropy = 7.0
+)
+
+/*
+DefaultShouldCompress is the probe of the Compress option without ShouldCompress.
+It skips values under compressMinSize and measures the byte entropy of the first
+compressProbeSize bytes: compressed, encrypted or random data is close to 8 bits
+per byte and isn't worth the CPU, text and most structured data are well below
+*/
+func DefaultShouldCompress(value []byte) bool {
+	if len(value) < compressMinSize {
+		return false
+	}
+	sample := value
+	if len(sample) > compressProbeSize {
+		sample = sample[:compressProbeSize]
+	}
+	var counts [256]int
+	for _, b := range sample {
+		counts[b]++
+	}
+	entropy := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(sample))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy < compressMaxEntropy
+}
+
+// compress gzips iv.value in place when the Compress option and the probe say so and it shrinks
+func (be *KVBoltDBBackend) compress(iv *InternalValue) error {
+	if !be.opts.Compress || iv.plainLen > 0 || len(iv.value) == 0 {
+		return nil
+	}
+	probe := be.opts.ShouldCompress
+	if probe == nil {
+		probe = DefaultShouldCompress
+	}
+	if !probe(iv.value) {
+		return nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(iv.value); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if buf.Len() >= len(iv.value) {
+		return nil
+	}
+	iv.plainLen, iv.value = len(iv.value), buf.Bytes()
+	return nil
+}
+
+// decompress inflates a compressed iv.value in place, plain values are left untouched
+func decompress(iv *InternalValue) error {
+	if iv.plainLen == 0 {
+		return nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(iv.value))
+	if err != nil {
+		return fmt.Errorf("Corrupt compressed value for key %s", printableKey(iv.key))
+	}
+	value := make([]byte, iv.plainLen)
+	if _, err := io.ReadFull(zr, value); err != nil {
+		return fmt.Errorf("Corrupt compressed value for key %s", printableKey(iv.key))
+	}
+	iv.plainLen, iv.value = 0, value
+	return nil
+}
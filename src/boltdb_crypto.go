@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// nonceSize is the AES-GCM standard nonce size stored with encrypted values
+const nonceSize = 12
+
+/*
+ErrDecrypt is returned when a stored value can't be decrypted, usually because
+the encryption key changed or is missing
+*/
+var ErrDecrypt = errors.New("Value decryption failed, wrong or missing encryption key")
+
+// newValueCipher builds the AES-256-GCM cipher used for values
+func newValueCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, nonceSize)
+}
+
+/*
+seal compresses iv.value in place with the Compress option, then encrypts it
+with a fresh nonce. The key is authenticated as additional data so a value can't
+be moved to another key. No encryption without a cipher
+*/
+func (be *KVBoltDBBackend) seal(iv *InternalValue) error {
+	if iv.tombstone {
+		return nil
+	}
+	if err := be.compress(iv); err != nil {
+		return err
+	}
+	if be.aead == nil {
+		return nil
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	iv.nonce = nonce
+	iv.value = be.aead.Seal(nil, nonce, iv.value, iv.key)
+	return nil
+}
+
+// open decrypts and decompresses iv.value in place. Plain values are left untouched
+func (be *KVBoltDBBackend) open(iv *InternalValue) error {
+	if iv.nonce != nil {
+		if be.aead == nil {
+			return ErrDecrypt
+		}
+		value, err := be.aead.Open(nil, iv.nonce, iv.value, iv.key)
+		if err != nil {
+			return ErrDecrypt
+		}
+		iv.nonce, iv.value = nil, value
+	}
+	return decompress(iv)
+}
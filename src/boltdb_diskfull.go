@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+ErrDiskFull is returned by writes while the backend is read only because a
+commit failed for lack of disk space, see checkDiskFull
+*/
+var ErrDiskFull = errors.New("Disk full, the backend is read only")
+
+// DefaultDiskFullRetry is the DiskFullRetry default
+const DefaultDiskFullRetry = 10 * time.Second
+
+/*
+isDiskFull tells an ENOSPC error. bolt formats some of the errors it gets from
+the file, the error text is all that's left of them
+*/
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || strings.Contains(err.Error(), syscall.ENOSPC.Error())
+}
+
+/*
+checkDiskFull is called with the outcome of every write transaction. A disk full
+error turns the backend read only and is returned as ErrDiskFull, a commit makes
+it writable again
+*/
+func (be *KVBoltDBBackend) checkDiskFull(err error) error {
+	if err == nil {
+		if atomic.CompareAndSwapInt32(&be.diskFull, 1, 0) {
+			log.Info("Disk space available again, writes resumed")
+		}
+		return nil
+	}
+	if !isDiskFull(err) {
+		return err
+	}
+	atomic.StoreInt64(&be.diskFullAt, time.Now().UnixNano())
+	if atomic.SwapInt32(&be.diskFull, 1) == 0 {
+		log.Error("Disk full, the backend is read only until space is freed - %s", err)
+	}
+	return ErrDiskFull
+}
+
+/*
+enterDiskFull fails writes with ErrDiskFull while the disk is full, letting a
+single one through every DiskFullRetry, never when negative, to find out whether
+space was freed
+*/
+func (be *KVBoltDBBackend) enterDiskFull() error {
+	if atomic.LoadInt32(&be.diskFull) == 0 {
+		return nil
+	}
+	retry := be.opts.DiskFullRetry
+	if retry == 0 {
+		retry = DefaultDiskFullRetry
+	}
+	if !probeWrite(&be.diskFullAt, atomic.LoadInt64(&be.diskFullAt), retry) {
+		return ErrDiskFull
+	}
+	return nil
+}
+
+/*
+probeWrite lets a single write through every retry to probe a failing backend:
+at is the time of the last probe, loaded from last, and the write that passes
+once retry elapsed moves last to now. A 0 at lets the next write through, with
+a negative retry it's the only way through
+*/
+func probeWrite(last *int64, at int64, retry time.Duration) bool {
+	now := time.Now().UnixNano()
+	if at != 0 && (retry < 0 || now-at < int64(retry)) {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(last, at, now)
+}
+
+// DiskFull tells whether writes fail with ErrDiskFull
+func (be *KVBoltDBBackend) DiskFull() bool {
+	return atomic.LoadInt32(&be.diskFull) != 0
+}
+
+/*
+RetryDiskFull lets the next write through to find out whether space was freed,
+without waiting for DiskFullRetry. The backend stays read only if it fails
+*/
+func (be *KVBoltDBBackend) RetryDiskFull() {
+	atomic.StoreInt64(&be.diskFullAt, 0)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+/*
+Durability is a per write hint of how it commits. DurabilityDefault follows the
+backend options: batched with BatchWrites, fsynced unless NoSync.
+DurabilitySync waits for the write to reach the disk even on a NoSync backend.
+DurabilityBatch shares the commit with concurrent writers, like BatchWrites.
+DurabilityNoSync only skips the fsync on a NoSync backend: bolt's sync setting is
+per database, a single commit can't skip it without racing concurrent commits,
+so on a syncing backend the write is synced
+*/
+type Durability int
+
+// Durability hints
+const (
+	DurabilityDefault Durability = iota
+	DurabilitySync
+	DurabilityNoSync
+	DurabilityBatch
+)
+
+// updateWith runs fn in a write transaction committed as d says, see update
+func (be *KVBoltDBBackend) updateWith(d Durability, fn func(tx *bolt.Tx) error) error {
+	return be.checkedCommit(func(fn func(tx *bolt.Tx) error) error { return be.commitWith(d, fn) }, fn)
+}
+
+// updateOn runs fn in a write transaction of db, for the writes that don't commit through updateWith
+func (be *KVBoltDBBackend) updateOn(db *bolt.DB, fn func(tx *bolt.Tx) error) error {
+	return be.checkedCommit(db.Update, fn)
+}
+
+/*
+checkedCommit commits fn with commit and hands the outcome to checkBreaker and
+checkDiskFull, the writes they count are the ones enterWrite gates
+*/
+func (be *KVBoltDBBackend) checkedCommit(commit func(fn func(tx *bolt.Tx) error) error, fn func(tx *bolt.Tx) error) error {
+	var fnErr error
+	err := commit(guardBreaker(fn, &fnErr))
+	be.checkBreaker(err, fnErr)
+	return be.checkDiskFull(err)
+}
+
+func (be *KVBoltDBBackend) commitWith(d Durability, fn func(tx *bolt.Tx) error) error {
+	if d == DurabilityDefault && be.opts.BatchWrites {
+		d = DurabilityBatch
+	}
+	switch d {
+	case DurabilityBatch:
+		if be.batchTuner != nil {
+			return be.batchAdaptive(fn)
+		}
+		return be.db.Batch(fn)
+	case DurabilitySync:
+		if err := be.db.Update(fn); err != nil {
+			return err
+		}
+		if be.opts.NoSync {
+			return be.db.Sync()
+		}
+		return nil
+	}
+	return be.db.Update(fn)
+}
+
+// PutWithDurability is Put committed as d says
+func (be *KVBoltDBBackend) PutWithDurability(key []byte, value []byte, replace bool, passthru bool, d Durability) error {
+	_, err := be.putCAS(key, value, replace, passthru, d)
+	return err
+}
+
+// DeleteWithDurability is Delete committed as d says
+func (be *KVBoltDBBackend) DeleteWithDurability(key []byte, only_if_exists bool, d Durability) (bool, error) {
+	return be.delete(key, only_if_exists, d)
+}
+
+// IncrementWithDurability is Increment committed as d says
+func (be *KVBoltDBBackend) IncrementWithDurability(key []byte, value int64, create_if_not_exists bool, d Durability) (uint64, error) {
+	ret, _, _, err := be.increment(key, value, create_if_not_exists, d, -1)
+	return ret, err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+FilterExisting returns the candidates stored in the current bucket, live values
+of any kind, in the order given. The bloom filter drops most of the missing keys
+without a lookup, the positives are confirmed in a single read transaction, so a
+large candidate set costs one transaction however many keys it holds
+*/
+func (be *KVBoltDBBackend) FilterExisting(candidates [][]byte) ([][]byte, error) {
+	if err := be.rlock(); err != nil {
+		return nil, err
+	}
+	defer be.dbMutex.RUnlock()
+
+	now := time.Now()
+	live := make([]bool, len(candidates))
+	keys := make([][]byte, len(candidates))
+	var positives []int
+	bf := be.keyCache[be.bucketName]
+	for i, key := range candidates {
+		keys[i] = be.normalizeKey(key)
+		if iv, ok := be.buffered(keys[i]); ok {
+			live[i] = !iv.expired(now)
+		} else if bf.Test(keys[i]) {
+			positives = append(positives, i)
+		}
+	}
+	if len(positives) > 0 {
+		err := be.db.View(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(be.bucketName))
+			if bucket == nil {
+				return nil
+			}
+			for _, i := range positives {
+				var err error
+				if live[i], err = isLive(bucket, keys[i], now); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ret := make([][]byte, 0, len(positives))
+	for i, key := range candidates {
+		if live[i] {
+			ret = append(ret, key)
+		}
+	}
+	return ret, nil
+}
+
+// isLive tells whether bucket holds a live value for key, without decrypting it
+func isLive(bucket *bolt.Bucket, key []byte, now time.Time) (bool, error) {
+	raw := bucket.Get(key)
+	if raw == nil {
+		return false, nil
+	}
+	iv, err := decodeValue(key, raw)
+	if err != nil {
+		return false, err
+	}
+	return !iv.tombstone && !iv.expired(now), nil
+}
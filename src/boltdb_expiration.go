@@ -0,0 +1,704 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+Expirations are stored in the value header, so an expired key is a miss as soon
+as its time passes. To reclaim the space without scanning every bucket the
+reaper reads an index kept in a separate bolt file (the expirationdb), with one
+bucket per data bucket and keys made of the big endian expiration followed by
+the key. The index is written after the data transaction commits, so it can
+hold stale entries: the reaper only deletes a key if its header still carries
+the indexed expiration
+*/
+
+// expirationDBSuffix is appended to the database filename for the expiration index
+const expirationDBSuffix = ".expiration"
+
+// maxRelativeExpiration is memcached's limit for relative expirations, 30 days
+const maxRelativeExpiration = 60 * 60 * 24 * 30
+
+/*
+absoluteExpiration converts a memcached exptime to unix seconds. 0 never
+expires, up to 30 days it is relative to now, beyond it is a unix timestamp.
+Negative values are already expired
+*/
+func absoluteExpiration(exptime int, now time.Time) int {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return int(now.Unix())
+	case exptime <= maxRelativeExpiration:
+		return int(now.Unix()) + exptime
+	}
+	return exptime
+}
+
+/*
+expirationFor is absoluteExpiration for a write, moved by the ExpirationJitter.
+The jittered TTL is at least a second
+*/
+func (be *KVBoltDBBackend) expirationFor(exptime int, now time.Time) int {
+	expiration := absoluteExpiration(exptime, now)
+	ttl := expiration - int(now.Unix())
+	spread := ttl * be.opts.ExpirationJitter / 100
+	if spread <= 0 {
+		return expiration
+	}
+	ttl += rand.Intn(2*spread+1) - spread
+	if ttl < 1 {
+		ttl = 1
+	}
+	return int(now.Unix()) + ttl
+}
+
+// expired tells if iv has an expiration at or before now
+func (iv *InternalValue) expired(now time.Time) bool {
+	return iv.expiration != 0 && int64(iv.expiration) <= now.Unix()
+}
+
+func expirationIndexKey(expiration int, key []byte) []byte {
+	k := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(k, uint64(expiration))
+	copy(k[8:], key)
+	return k
+}
+
+// indexExpiration records that key in bucketName expires at expiration
+func (be *KVBoltDBBackend) indexExpiration(bucketName string, key []byte, expiration int) error {
+	be.wakeReaper()
+	return be.expirationdb.Update(func(tx *bolt.Tx) error {
+		index, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		return index.Put(expirationIndexKey(expiration, key), nil)
+	})
+}
+
+// hasExpirations tells whether the expiration index has an entry
+func (be *KVBoltDBBackend) hasExpirations() bool {
+	found := false
+	be.expirationdb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, index *bolt.Bucket) error {
+			if k, _ := index.Cursor().First(); k != nil {
+				found = true
+			}
+			return nil
+		})
+	})
+	return found
+}
+
+// flushAfterBatch is the number of keys FlushAfter reads per transaction
+const flushAfterBatch = 1000
+
+/*
+FlushAfter is memcached's flush_all with a delay: every key of the current bucket
+written before the call expires in delay seconds, unless it expires sooner, and
+the reaper deletes them. Keys written after the call are unaffected. The bucket
+is rewritten in transactions of flushAfterBatch keys, so other writes go on
+meanwhile. Unlike Flush it is a write: every transaction passes the write gate,
+so PauseWrites holds the rewrite between batches. A delay of 0 or less is Flush.
+Like Flush it isn't replicated
+*/
+func (be *KVBoltDBBackend) FlushAfter(delay int) error {
+	if err := be.allowOp(OpFlush); err != nil {
+		return err
+	}
+	if delay <= 0 {
+		return be.Flush()
+	}
+	bucketName, err := be.startFlushAfter()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	expiration := absoluteExpiration(delay, start)
+	var from []byte
+	for {
+		next, err := be.expireBatch(bucketName, from, start, expiration)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		from = next
+	}
+}
+
+// startFlushAfter writes the buffered Sets, so they count as written before the flush
+func (be *KVBoltDBBackend) startFlushAfter() (string, error) {
+	if err := be.enterWrite(); err != nil {
+		return "", err
+	}
+	defer be.writes.leave()
+	if !be.allowWrite() {
+		return "", ErrRateLimited
+	}
+	if err := be.flushPending(); err != nil {
+		return "", err
+	}
+	if err := be.rlock(); err != nil {
+		return "", err
+	}
+	defer be.dbMutex.RUnlock()
+	return be.bucketName, nil
+}
+
+/*
+expireBatch sets expiration on up to flushAfterBatch keys of bucketName after
+from, the ones written before start that don't expire sooner, and indexes them.
+Returns the last key read, nil at the end of the bucket
+*/
+func (be *KVBoltDBBackend) expireBatch(bucketName string, from []byte, start time.Time, expiration int) ([]byte, error) {
+	if err := be.enterWrite(); err != nil {
+		return nil, err
+	}
+	defer be.writes.leave()
+	if err := be.rlock(); err != nil {
+		return nil, err
+	}
+	defer be.dbMutex.RUnlock()
+	db, err := be.dbFor(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	var next []byte
+	err = be.updateOn(db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		k, v := c.First()
+		if from != nil {
+			if k, v = c.Seek(from); bytes.Equal(k, from) {
+				k, v = c.Next()
+			}
+		}
+		var rows [][2][]byte
+		for ; k != nil && len(rows) < flushAfterBatch; k, v = c.Next() {
+			iv, err := decodeValue(k, v)
+			if err != nil {
+				return err
+			}
+			next = cloneValue(k)
+			if iv.tombstone || iv.expired(start) || iv.modified > start.UnixNano() {
+				continue
+			}
+			if iv.expiration != 0 && iv.expiration <= expiration {
+				continue
+			}
+			iv.key = next
+			iv.expiration = expiration
+			rows = append(rows, [2][]byte{next, encodeValue(iv)})
+		}
+		if k == nil {
+			next = nil
+		}
+		// bolt cursors can't be used across a Put
+		for _, row := range rows {
+			if err := bucket.Put(row[0], row[1]); err != nil {
+				return err
+			}
+			keys = append(keys, row[0])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// under the lock, CompactExpirationIndex can swap the index file
+	return next, be.indexExpirations(bucketName, keys, expiration)
+}
+
+// indexExpirations records that keys in bucketName expire at expiration
+func (be *KVBoltDBBackend) indexExpirations(bucketName string, keys [][]byte, expiration int) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	be.wakeReaper()
+	return be.expirationdb.Update(func(tx *bolt.Tx) error {
+		index, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := index.Put(expirationIndexKey(expiration, key), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type expiredEntry struct {
+	bucket     string
+	key        []byte
+	expiration int
+	indexKey   []byte
+}
+
+// notifyExpired publishes the expiration of e once tx commits, with the ExpireEvents option
+func (be *KVBoltDBBackend) notifyExpired(tx *bolt.Tx, e expiredEntry, now time.Time) {
+	if !be.opts.ExpireEvents || be.opts.Replicate == nil {
+		return
+	}
+	rec := Record{Op: RecordExpire, Bucket: e.bucket, Key: e.key, Expiration: e.expiration, Modified: now.UnixNano()}
+	tx.OnCommit(func() {
+		be.opts.Replicate(rec)
+	})
+}
+
+/*
+reapExpired deletes the keys whose expiration passed, using the expiration index.
+Returns the number of keys deleted
+*/
+func (be *KVBoltDBBackend) reapExpired(now time.Time) (int, error) {
+	if err := be.rlock(); err != nil {
+		return 0, err
+	}
+	defer be.dbMutex.RUnlock()
+
+	var entries []expiredEntry
+	limit := uint64(now.Unix())
+	err := be.expirationdb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, index *bolt.Bucket) error {
+			c := index.Cursor()
+			for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k[:8]) <= limit; k, _ = c.Next() {
+				entries = append(entries, expiredEntry{
+					bucket:     string(name),
+					key:        append([]byte(nil), k[8:]...),
+					expiration: int(binary.BigEndian.Uint64(k[:8])),
+					indexKey:   append([]byte(nil), k...),
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	// entries come grouped by bucket, each bucket is reaped in its database
+	deleted := 0
+	for start := 0; start < len(entries); {
+		end := start + 1
+		for end < len(entries) && entries[end].bucket == entries[start].bucket {
+			end++
+		}
+		n, err := be.reapEntries(entries[start:end], now)
+		if err != nil {
+			return 0, err
+		}
+		deleted += n
+		start = end
+	}
+
+	err = be.expirationdb.Update(func(tx *bolt.Tx) error {
+		for _, e := range entries {
+			if index := tx.Bucket([]byte(e.bucket)); index != nil {
+				if err := index.Delete(e.indexKey); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// reapEntries deletes the expired keys of entries, all of the same bucket
+func (be *KVBoltDBBackend) reapEntries(entries []expiredEntry, now time.Time) (int, error) {
+	db, err := be.dbFor(entries[0].bucket)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		deleted = 0
+		var reaped [][]byte
+		for _, e := range entries {
+			bucket := tx.Bucket([]byte(e.bucket))
+			if bucket == nil {
+				continue
+			}
+			raw := bucket.Get(e.key)
+			if raw == nil {
+				continue
+			}
+			iv, err := decodeValue(e.key, raw)
+			if err != nil || iv.tombstone || iv.expiration != e.expiration {
+				continue
+			}
+			// cleaned up like deleteKey, without tombstone nor replication
+			if err := be.dropKeyState(tx, e.bucket, e.key); err != nil {
+				return err
+			}
+			be.trackValueSize(tx, bucket, &InternalValue{key: e.key, tombstone: true})
+			if err := bucket.Delete(e.key); err != nil {
+				return err
+			}
+			reaped = append(reaped, e.key)
+			be.notifyExpired(tx, e, now)
+			deleted++
+		}
+		// counters removed by a pass rolled back would be removed again by the next
+		if bf := be.keyCache[entries[0].bucket]; bf != nil {
+			tx.OnCommit(func() {
+				for _, key := range reaped {
+					bf.Remove(key)
+				}
+			})
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+/*
+ExpiredKeys returns, oldest expiration first, up to limit keys of the current
+bucket that expired but the reaper didn't delete yet (all of them if limit <= 0),
+to see the lag of lazy deletion. It reads the expiration index and deletes nothing.
+Index entries whose key was rewritten or deleted since are skipped
+*/
+func (be *KVBoltDBBackend) ExpiredKeys(limit int) ([][]byte, error) {
+	if err := be.flushPending(); err != nil {
+		return nil, err
+	}
+	if err := be.rlock(); err != nil {
+		return nil, err
+	}
+	defer be.dbMutex.RUnlock()
+
+	var entries []expiredEntry
+	now := uint64(time.Now().Unix())
+	err := be.expirationdb.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(be.bucketName))
+		if index == nil {
+			return nil
+		}
+		c := index.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k[:8]) <= now; k, _ = c.Next() {
+			entries = append(entries, expiredEntry{
+				key:        append([]byte(nil), k[8:]...),
+				expiration: int(binary.BigEndian.Uint64(k[:8])),
+			})
+		}
+		return nil
+	})
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+
+	var keys [][]byte
+	err = be.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(be.bucketName))
+		if bucket == nil {
+			return nil
+		}
+		for _, e := range entries {
+			raw := bucket.Get(e.key)
+			if raw == nil {
+				continue
+			}
+			iv, err := decodeValue(e.key, raw)
+			if err != nil || iv.tombstone || iv.expiration != e.expiration {
+				continue
+			}
+			keys = append(keys, e.key)
+			if limit > 0 && len(keys) == limit {
+				break
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+/*
+CompactExpirationIndex drops the entries of the expiration index that no longer
+match their key, deleted or rewritten with another expiration since, then
+rewrites the index file with the entries left so it shrinks. Returns the number
+of entries dropped. The entries are checked while other operations go on, only
+the rewrite of the file, much smaller than the data, makes them wait
+*/
+func (be *KVBoltDBBackend) CompactExpirationIndex() (int, error) {
+	if err := be.allowOp(OpCompact); err != nil {
+		return 0, err
+	}
+	if err := be.flushPending(); err != nil {
+		return 0, err
+	}
+	if err := be.rlock(); err != nil {
+		return 0, err
+	}
+	stale, err := be.staleExpirations(nil)
+	be.dbMutex.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	be.dbMutex.Lock()
+	defer be.dbMutex.Unlock()
+	if be.closed {
+		return 0, ErrBackendClosed
+	}
+	// keys written meanwhile can match their entry again
+	if stale, err = be.staleExpirations(stale); err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entries := range stale {
+		removed += len(entries)
+	}
+	if err := be.rewriteExpirationIndex(stale); err != nil {
+		return 0, err
+	}
+	log.Info("Compacted the expiration index, %d stale entries dropped", removed)
+	return removed, nil
+}
+
+/*
+staleExpirations returns, by bucket, the index keys of the expiration entries
+whose key is gone, a tombstone or has another expiration. With candidates only
+those are checked again, else the whole index is read
+*/
+func (be *KVBoltDBBackend) staleExpirations(candidates map[string]map[string]bool) (map[string]map[string]bool, error) {
+	stale := make(map[string]map[string]bool)
+	err := be.expirationdb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, index *bolt.Bucket) error {
+			bucketName := string(name)
+			if candidates != nil && candidates[bucketName] == nil {
+				return nil
+			}
+			var bucket *bolt.Bucket
+			if be.bucketFileExists(bucketName) {
+				db, err := be.dbFor(bucketName)
+				if err != nil {
+					return err
+				}
+				dataTx, err := db.Begin(false)
+				if err != nil {
+					return err
+				}
+				defer dataTx.Rollback()
+				bucket = dataTx.Bucket(name)
+			}
+			return index.ForEach(func(k, _ []byte) error {
+				if candidates != nil && !candidates[bucketName][string(k)] {
+					return nil
+				}
+				if !staleExpiration(bucket, k) {
+					return nil
+				}
+				if stale[bucketName] == nil {
+					stale[bucketName] = make(map[string]bool)
+				}
+				stale[bucketName][string(k)] = true
+				return nil
+			})
+		})
+	})
+	return stale, err
+}
+
+// staleExpiration tells if the index entry k doesn't match its key in bucket, nil when missing
+func staleExpiration(bucket *bolt.Bucket, k []byte) bool {
+	if bucket == nil {
+		return true
+	}
+	raw := bucket.Get(k[8:])
+	if raw == nil {
+		return true
+	}
+	iv, err := decodeValue(k[8:], raw)
+	if err != nil {
+		// the reaper won't touch it either
+		return false
+	}
+	return iv.tombstone || iv.expiration != int(binary.BigEndian.Uint64(k[:8]))
+}
+
+// rewriteExpirationIndex copies the index without the stale entries to a new file, and swaps it in
+func (be *KVBoltDBBackend) rewriteExpirationIndex(stale map[string]map[string]bool) error {
+	path := be.filename + expirationDBSuffix
+	tmpPath := path + compactSuffix
+	os.Remove(tmpPath)
+	dst, err := bolt.Open(tmpPath, 0644, nil)
+	if err != nil {
+		return err
+	}
+	err = be.expirationdb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, index *bolt.Bucket) error {
+			return dst.Update(func(dstTx *bolt.Tx) error {
+				copied, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(copied, index, func(k, _ []byte) bool {
+					return !stale[string(name)][string(k)]
+				})
+			})
+		})
+	})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error copying the expiration index - %s", err)
+	}
+
+	be.expirationdb.Close()
+	renameErr := os.Rename(tmpPath, path)
+	if renameErr != nil {
+		os.Remove(tmpPath)
+	}
+	// the old file is opened again when the rename failed
+	expirationdb, err := bolt.Open(path, 0644, &bolt.Options{Timeout: reopenTimeout})
+	if err != nil {
+		return fmt.Errorf("Error opening the expiration index - %s", err)
+	}
+	be.expirationdb = expirationdb
+	if renameErr != nil {
+		return fmt.Errorf("Error replacing the expiration index - %s", renameErr)
+	}
+	return nil
+}
+
+/*
+RepairExpirationIndex makes the expiration index match the data after a crash,
+which can leave it behind the commits of the data: the entries of keys deleted or
+rewritten since are removed, and the keys of every bucket whose header carries an
+expiration without an entry, which the reaper would never delete, are indexed
+again. Returns the number of entries removed. Unlike CompactExpirationIndex the
+file isn't rewritten, only the removal of the entries makes other operations wait.
+RepairExpirationsOnOpen runs it before the backend is returned
+*/
+func (be *KVBoltDBBackend) RepairExpirationIndex() (int, error) {
+	if err := be.flushPending(); err != nil {
+		return 0, err
+	}
+	if err := be.rlock(); err != nil {
+		return 0, err
+	}
+	stale, err := be.staleExpirations(nil)
+	reindexed := 0
+	if err == nil {
+		reindexed, err = be.indexMissingExpirations()
+	}
+	be.dbMutex.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	be.dbMutex.Lock()
+	defer be.dbMutex.Unlock()
+	if be.closed {
+		return 0, ErrBackendClosed
+	}
+	// keys written meanwhile can match their entry again
+	if stale, err = be.staleExpirations(stale); err != nil {
+		return 0, err
+	}
+	removed := 0
+	err = be.expirationdb.Update(func(tx *bolt.Tx) error {
+		removed = 0
+		for bucketName, entries := range stale {
+			index := tx.Bucket([]byte(bucketName))
+			for k := range entries {
+				if err := index.Delete([]byte(k)); err != nil {
+					return err
+				}
+				removed++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	log.Info("Repaired the expiration index, %d orphaned entries removed, %d keys indexed again", removed, reindexed)
+	return removed, nil
+}
+
+// indexMissingExpirations indexes the keys of every bucket with an expiration and no index entry
+func (be *KVBoltDBBackend) indexMissingExpirations() (int, error) {
+	// bucket files not opened yet are opened to be checked too
+	names, err := be.bucketFileNames()
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		if _, err := be.dbFor(name); err != nil {
+			return 0, err
+		}
+	}
+
+	var missing []expiredEntry
+	for _, db := range be.databases() {
+		err := db.View(func(tx *bolt.Tx) error {
+			return be.expirationdb.View(func(indexTx *bolt.Tx) error {
+				return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+					if string(name) == metaBucketName {
+						return nil
+					}
+					index := indexTx.Bucket(name)
+					return bucket.ForEach(func(k, v []byte) error {
+						if v == nil {
+							return nil
+						}
+						iv, err := decodeValue(k, v)
+						if err != nil || iv.tombstone || iv.expiration == 0 {
+							return nil
+						}
+						// entries have no value, bolt's Get can't tell them from missing ones
+						if index != nil {
+							indexKey := expirationIndexKey(iv.expiration, k)
+							if found, _ := index.Cursor().Seek(indexKey); bytes.Equal(found, indexKey) {
+								return nil
+							}
+						}
+						missing = append(missing, expiredEntry{bucket: string(name), key: cloneValue(k), expiration: iv.expiration})
+						return nil
+					})
+				})
+			})
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	be.wakeReaper()
+	err = be.expirationdb.Update(func(tx *bolt.Tx) error {
+		for _, e := range missing {
+			index, err := tx.CreateBucketIfNotExists([]byte(e.bucket))
+			if err != nil {
+				return err
+			}
+			if err := index.Put(expirationIndexKey(e.expiration, e.key), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(missing), err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+A key fingerprint is the sorted list of the 64 bit FNV-1a hashes of the live keys
+of a bucket, big endian, 8 bytes each. Two replicas exchange fingerprints instead
+of their keys to find which keys one has and the other misses: at 8 bytes a key
+the list is much smaller than the keyspace and merging two sorted lists is linear.
+Hash collisions can hide a missing key, with 64 bits they are negligible below
+billions of keys
+*/
+
+const fingerprintHashSize = 8
+
+// keyHash is the fingerprint hash of key
+func keyHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+/*
+KeyFingerprint returns the fingerprint of the live keys of the current bucket,
+see DiffFingerprints
+*/
+func (be *KVBoltDBBackend) KeyFingerprint() ([]byte, error) {
+	if err := be.flushPending(); err != nil {
+		return nil, err
+	}
+	if err := be.rlock(); err != nil {
+		return nil, err
+	}
+	defer be.dbMutex.RUnlock()
+
+	var hashes []uint64
+	now := time.Now()
+	err := be.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(be.bucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			iv, err := decodeValue(k, v)
+			if err != nil {
+				return err
+			}
+			if !iv.tombstone && !iv.expired(now) {
+				hashes = append(hashes, keyHash(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	fp := make([]byte, len(hashes)*fingerprintHashSize)
+	for i, h := range hashes {
+		binary.BigEndian.PutUint64(fp[i*fingerprintHashSize:], h)
+	}
+	return fp, nil
+}
+
+/*
+DiffFingerprints compares two fingerprints and returns the key hashes only a
+holds and the ones only b holds
+*/
+func DiffFingerprints(a, b []byte) (onlyA []uint64, onlyB []uint64, err error) {
+	if len(a)%fingerprintHashSize != 0 || len(b)%fingerprintHashSize != 0 {
+		return nil, nil, fmt.Errorf("Malformed key fingerprint")
+	}
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) == 0 || len(a) > 0 && bytes.Compare(a[:fingerprintHashSize], b[:fingerprintHashSize]) < 0:
+			onlyA = append(onlyA, binary.BigEndian.Uint64(a))
+			a = a[fingerprintHashSize:]
+		case len(a) == 0 || bytes.Compare(a[:fingerprintHashSize], b[:fingerprintHashSize]) > 0:
+			onlyB = append(onlyB, binary.BigEndian.Uint64(b))
+			b = b[fingerprintHashSize:]
+		default:
+			a, b = a[fingerprintHashSize:], b[fingerprintHashSize:]
+		}
+	}
+	return onlyA, onlyB, nil
+}
+
+/*
+KeysMissingFrom returns the live keys of the current bucket that are not in the
+remote fingerprint, the keys to push to that replica in an anti-entropy repair
+*/
+func (be *KVBoltDBBackend) KeysMissingFrom(remote []byte) ([][]byte, error) {
+	local, err := be.KeyFingerprint()
+	if err != nil {
+		return nil, err
+	}
+	onlyLocal, _, err := DiffFingerprints(local, remote)
+	if err != nil || len(onlyLocal) == 0 {
+		return nil, err
+	}
+	missing := make(map[uint64]bool, len(onlyLocal))
+	for _, h := range onlyLocal {
+		missing[h] = true
+	}
+
+	var keys [][]byte
+	err = be.CacheDumpFunc(func(m KeyMeta) error {
+		if missing[keyHash(m.Key)] {
+			keys = append(keys, m.Key)
+		}
+		return nil
+	})
+	return keys, err
+}
@@ -0,0 +1,81 @@
+package main
+
+import "sync"
+
+// loadCall is a loader run in progress, waited on by concurrent misses
+type loadCall struct {
+	wg    sync.WaitGroup
+	value []byte
+	err   error
+}
+
+// loadGroup runs one loader per key at a time
+type loadGroup struct {
+	lock  sync.Mutex
+	calls map[string]*loadCall
+}
+
+func newLoadGroup() *loadGroup {
+	return &loadGroup{calls: make(map[string]*loadCall)}
+}
+
+// do runs fn for key, or waits for the run already in progress and shares its result
+func (g *loadGroup) do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.lock.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		c.wg.Wait()
+		return c.value, c.err
+	}
+	c := &loadCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.lock.Unlock()
+	// a panicking fn must not leave its waiters, or the next misses, blocked
+	defer c.wg.Done()
+	defer func() {
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+	}()
+
+	c.value, c.err = fn()
+	return c.value, c.err
+}
+
+/*
+GetOrSet returns the value of key or, on a miss, calls loader and stores the value
+it returns with its expiration (memcached exptime). Concurrent misses on the same
+key wait for a single loader run and get its value. The loader runs without
+holding any database lock, if it fails nothing is stored and its error returned
+*/
+func (be *KVBoltDBBackend) GetOrSet(key []byte, loader func() ([]byte, int, error)) ([]byte, error) {
+	key = be.normalizeKey(key)
+	v, err := be.Get(key)
+	if err != nil || v != nil {
+		return v, err
+	}
+
+	be.dbMutex.RLock()
+	bucket := be.bucketName
+	be.dbMutex.RUnlock()
+
+	value, err := be.loads.do(bucket+"\x00"+string(key), func() ([]byte, error) {
+		// a run that just finished may have stored it
+		if v, err := be.Get(key); err != nil || v != nil {
+			return v, err
+		}
+		value, expiration, err := loader()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := be.putEx(&InternalValue{key: key, expiration: expiration, value: value}, false, true, nil); err != nil {
+			return nil, err
+		}
+		return value, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cloneValue(value), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+/*
+A hash maps fields to values under one key, each field a row of the nested
+members bucket of the key, so setting a field doesn't rewrite the others. Field
+values carry the value header and are encrypted like scalars, with key and field
+authenticated together. A key holds one kind of value: hash operations on a
+scalar, list or set key fail with ErrWrongType, as does a Get of a hash key. Set
+replaces a hash with a scalar
+*/
+
+// sealField encodes value for field of the hash at key
+func (be *KVBoltDBBackend) sealField(key []byte, field []byte, value []byte) ([]byte, error) {
+	iv := &InternalValue{key: pairKey(key, field), value: value}
+	if err := be.seal(iv); err != nil {
+		return nil, err
+	}
+	return encodeValue(iv), nil
+}
+
+// openField decodes the stored value of field of the hash at key, the result references raw
+func (be *KVBoltDBBackend) openField(key []byte, field []byte, raw []byte) ([]byte, error) {
+	iv, err := decodeValue(pairKey(key, field), raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := be.open(iv); err != nil {
+		return nil, err
+	}
+	return iv.value, nil
+}
+
+// HashSet sets field of the hash at key, creating it. Returns false if the field already existed
+func (be *KVBoltDBBackend) HashSet(key []byte, field []byte, value []byte) (bool, error) {
+	key = be.normalizeKey(key)
+	created := false
+	err := be.updateCollection(key, ValueHash, hashesBucketPrefix, true, func(fields *bolt.Bucket) error {
+		sealed, err := be.sealField(key, field, value)
+		if err != nil {
+			return err
+		}
+		created = fields.Get(field) == nil
+		return fields.Put(field, sealed)
+	})
+	return created, err
+}
+
+// HashGet returns the value of field of the hash at key, nil if either is missing
+func (be *KVBoltDBBackend) HashGet(key []byte, field []byte) ([]byte, error) {
+	key = be.normalizeKey(key)
+	var ret []byte
+	err := be.viewCollection(key, ValueHash, hashesBucketPrefix, func(fields *bolt.Bucket) error {
+		if fields == nil {
+			return nil
+		}
+		raw := fields.Get(field)
+		if raw == nil {
+			return nil
+		}
+		v, err := be.openField(key, field, raw)
+		if err != nil {
+			return err
+		}
+		ret = cloneValue(v)
+		return nil
+	})
+	return ret, err
+}
+
+// HashGetAll returns every field of the hash at key, an empty map if it doesn't exist
+func (be *KVBoltDBBackend) HashGetAll(key []byte) (map[string][]byte, error) {
+	key = be.normalizeKey(key)
+	ret := make(map[string][]byte)
+	err := be.viewCollection(key, ValueHash, hashesBucketPrefix, func(fields *bolt.Bucket) error {
+		if fields == nil {
+			return nil
+		}
+		return fields.ForEach(func(field, raw []byte) error {
+			v, err := be.openField(key, field, raw)
+			if err != nil {
+				return err
+			}
+			ret[string(field)] = cloneValue(v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// HashDel deletes field of the hash at key, returns false if it didn't exist. The last field deletes the key
+func (be *KVBoltDBBackend) HashDel(key []byte, field []byte) (bool, error) {
+	key = be.normalizeKey(key)
+	deleted := false
+	err := be.updateCollection(key, ValueHash, hashesBucketPrefix, false, func(fields *bolt.Bucket) error {
+		deleted = fields != nil && fields.Get(field) != nil
+		if !deleted {
+			return nil
+		}
+		return fields.Delete(field)
+	})
+	return deleted, err
+}
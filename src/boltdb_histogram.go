@@ -0,0 +1,207 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+valueSizes is a histogram of the stored value sizes, bucketed by powers of two:
+slot i counts the values with bits.Len(size) == i, slot 0 the empty ones. It
+tracks writes and deletes, keys dropped by expiration, Flush or the reaper are
+only accounted for by ScanValueSizes
+*/
+type valueSizes [65]int64
+
+func sizeSlot(size int) int {
+	return bits.Len(uint(size))
+}
+
+func (h *valueSizes) add(size int, n int64) {
+	atomic.AddInt64(&h[sizeSlot(size)], n)
+}
+
+/*
+trackValueSize accounts for iv replacing the row currently stored for its key,
+once tx commits
+*/
+func (be *KVBoltDBBackend) trackValueSize(tx *bolt.Tx, bucket *bolt.Bucket, iv *InternalValue) {
+	if be.valueSizes == nil {
+		return
+	}
+	oldSize := -1
+	if raw := bucket.Get(iv.key); raw != nil {
+		if old, err := decodeValue(iv.key, raw); err == nil && !old.tombstone {
+			oldSize = be.plainSize(old)
+		}
+	}
+	newSize := -1
+	if !iv.tombstone {
+		newSize = len(iv.value)
+	}
+	tx.OnCommit(func() {
+		if oldSize >= 0 {
+			be.valueSizes.add(oldSize, -1)
+		}
+		if newSize >= 0 {
+			be.valueSizes.add(newSize, 1)
+		}
+	})
+}
+
+// plainSize is the size of a stored value without the encryption overhead, uncompressed
+func (be *KVBoltDBBackend) plainSize(iv *InternalValue) int {
+	if iv.plainLen > 0 {
+		return iv.plainLen
+	}
+	if iv.nonce != nil && be.aead != nil {
+		return len(iv.value) - be.aead.Overhead()
+	}
+	return len(iv.value)
+}
+
+/*
+ScanValueSizes rebuilds the value size histogram from every bucket, for existing
+databases or after expirations and flushes made it drift
+*/
+func (be *KVBoltDBBackend) ScanValueSizes() error {
+	if be.valueSizes == nil {
+		return fmt.Errorf("Value size histogram is disabled")
+	}
+	if err := be.rlock(); err != nil {
+		return err
+	}
+	defer be.dbMutex.RUnlock()
+
+	var h valueSizes
+	for _, db := range be.databases() {
+		err := db.View(func(tx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+				if string(name) == metaBucketName {
+					return nil
+				}
+				return bucket.ForEach(func(k, v []byte) error {
+					if iv, err := decodeValue(k, v); err == nil && !iv.tombstone {
+						h[sizeSlot(be.plainSize(iv))]++
+					}
+					return nil
+				})
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i := range h {
+		atomic.StoreInt64(&be.valueSizes[i], h[i])
+	}
+	return nil
+}
+
+// ValueSizes returns the histogram counts, nil when disabled
+func (be *KVBoltDBBackend) ValueSizes() []int64 {
+	if be.valueSizes == nil {
+		return nil
+	}
+	ret := make([]int64, len(be.valueSizes))
+	for i := range be.valueSizes {
+		ret[i] = atomic.LoadInt64(&be.valueSizes[i])
+	}
+	return ret
+}
+
+// valueSizeStats returns the non empty slots as value_size_<upper bound> counters
+func valueSizeStats(h []int64) []stat {
+	var stats []stat
+	for i, n := range h {
+		if n == 0 {
+			continue
+		}
+		var upper uint64
+		if i > 0 {
+			upper = 1<<uint(i) - 1
+		}
+		stats = append(stats, stat{fmt.Sprintf("value_size_%d", upper), n})
+	}
+	return stats
+}
+
+// KeySize is a key and the size in bytes of its value
+type KeySize struct {
+	Key  []byte
+	Size int
+}
+
+// keySizeHeap is a min heap of KeySize by size, the smallest of the top keys on top
+type keySizeHeap []KeySize
+
+func (h keySizeHeap) Len() int            { return len(h) }
+func (h keySizeHeap) Less(i, j int) bool  { return h[i].Size < h[j].Size }
+func (h keySizeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keySizeHeap) Push(x interface{}) { *h = append(*h, x.(KeySize)) }
+func (h *keySizeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+/*
+TopKeysBySize returns the n keys of the current bucket with the largest values,
+largest first, to find what takes the space. Sizes are the plain value sizes,
+without header or encryption overhead, the stored row of sets and hashes is their
+marker. Tombstones and expired keys are skipped. It reads every key but keeps n at
+most in memory
+*/
+func (be *KVBoltDBBackend) TopKeysBySize(n int) ([]KeySize, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	if err := be.flushPending(); err != nil {
+		return nil, err
+	}
+	if err := be.rlock(); err != nil {
+		return nil, err
+	}
+	defer be.dbMutex.RUnlock()
+
+	top := make(keySizeHeap, 0, n)
+	now := time.Now()
+	err := be.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(be.bucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			iv, err := decodeValue(k, v)
+			if err != nil {
+				return err
+			}
+			if iv.tombstone || iv.expired(now) {
+				return nil
+			}
+			size := be.plainSize(iv)
+			if len(top) == n {
+				if size <= top[0].Size {
+					return nil
+				}
+				heap.Pop(&top)
+			}
+			heap.Push(&top, KeySize{Key: cloneValue(k), Size: size})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]KeySize, len(top))
+	for i := len(ret) - 1; i >= 0; i-- {
+		ret[i] = heap.Pop(&top).(KeySize)
+	}
+	return ret, nil
+}
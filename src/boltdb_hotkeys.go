@@ -0,0 +1,161 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// hotKeysDepth and hotKeysWidth size the count-min sketch, 1MB of counters
+const (
+	hotKeysDepth = 4
+	hotKeysWidth = 1 << 16
+)
+
+/*
+hotKeys counts the Gets of every key in a count-min sketch kept in memory: each
+key bumps one counter per row and its count is the smallest of them, never less
+than the real one, more when colliding with hotter keys. The sketch doesn't know
+the keys, so the hottest ones, up to capacity, are kept aside in a min heap with
+their count. floor is the count of the coldest of them once full, a Get of a key
+counted below it doesn't take the lock
+*/
+type hotKeys struct {
+	sketch   [hotKeysDepth][hotKeysWidth]uint32
+	capacity int
+	floor    uint32
+	lock     sync.Mutex
+	top      keyHitsHeap
+}
+
+// KeyHits is a key of Bucket and the Gets it got, approximate, see HotKeys
+type KeyHits struct {
+	Bucket string
+	Key    []byte
+	Hits   uint64
+}
+
+// keyHitsHeap is a min heap of KeyHits by hits, index keeps their position by hotKeyID
+type keyHitsHeap struct {
+	hits  []KeyHits
+	index map[string]int
+}
+
+func (h *keyHitsHeap) Len() int           { return len(h.hits) }
+func (h *keyHitsHeap) Less(i, j int) bool { return h.hits[i].Hits < h.hits[j].Hits }
+func (h *keyHitsHeap) Swap(i, j int) {
+	h.hits[i], h.hits[j] = h.hits[j], h.hits[i]
+	h.index[hotKeyID(h.hits[i].Bucket, h.hits[i].Key)] = i
+	h.index[hotKeyID(h.hits[j].Bucket, h.hits[j].Key)] = j
+}
+func (h *keyHitsHeap) Push(x interface{}) {
+	kh := x.(KeyHits)
+	h.index[hotKeyID(kh.Bucket, kh.Key)] = len(h.hits)
+	h.hits = append(h.hits, kh)
+}
+func (h *keyHitsHeap) Pop() interface{} {
+	x := h.hits[len(h.hits)-1]
+	h.hits = h.hits[:len(h.hits)-1]
+	delete(h.index, hotKeyID(x.Bucket, x.Key))
+	return x
+}
+
+func hotKeyID(bucket string, key []byte) string {
+	return bucket + "\x00" + string(key)
+}
+
+func newHotKeys(capacity int) *hotKeys {
+	h := &hotKeys{capacity: capacity}
+	h.top.index = make(map[string]int)
+	return h
+}
+
+// hit counts a Get of key in bucket
+func (h *hotKeys) hit(bucket string, key []byte) {
+	hash := fnv.New64a()
+	hash.Write([]byte(bucket))
+	hash.Write([]byte{0})
+	hash.Write(key)
+	sum := hash.Sum64()
+	// one hash split in two makes the index of every row, h1 + i*h2
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	var count uint32
+	for i := range h.sketch {
+		n := atomic.AddUint32(&h.sketch[i][(h1+uint32(i)*h2)%hotKeysWidth], 1)
+		if i == 0 || n < count {
+			count = n
+		}
+	}
+	if count <= atomic.LoadUint32(&h.floor) {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	id := hotKeyID(bucket, key)
+	if i, ok := h.top.index[id]; ok {
+		h.top.hits[i].Hits = uint64(count)
+		heap.Fix(&h.top, i)
+	} else if h.top.Len() < h.capacity {
+		heap.Push(&h.top, KeyHits{Bucket: bucket, Key: cloneValue(key), Hits: uint64(count)})
+	} else if uint64(count) > h.top.hits[0].Hits {
+		heap.Pop(&h.top)
+		heap.Push(&h.top, KeyHits{Bucket: bucket, Key: cloneValue(key), Hits: uint64(count)})
+	}
+	if h.top.Len() == h.capacity {
+		atomic.StoreUint32(&h.floor, uint32(h.top.hits[0].Hits))
+	}
+}
+
+// reset forgets every count
+func (h *hotKeys) reset() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i := range h.sketch {
+		for j := range h.sketch[i] {
+			atomic.StoreUint32(&h.sketch[i][j], 0)
+		}
+	}
+	h.top.hits = nil
+	h.top.index = make(map[string]int)
+	atomic.StoreUint32(&h.floor, 0)
+}
+
+/*
+HotKeys returns the n most read keys, of every bucket, hottest first. Gets are
+counted in memory, hits and misses alike, since the open or the last
+ResetHotKeys. Counts are approximate and can only be too high, the keys read
+less often than the TrackHotKeys hottest ones aren't known. Requires the
+TrackHotKeys option
+*/
+func (be *KVBoltDBBackend) HotKeys(n int) ([]KeyHits, error) {
+	if be.hotKeys == nil {
+		return nil, fmt.Errorf("HotKeys needs the TrackHotKeys option")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	h := be.hotKeys
+	h.lock.Lock()
+	ret := make([]KeyHits, len(h.top.hits))
+	copy(ret, h.top.hits)
+	h.lock.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Hits > ret[j].Hits })
+	if n < len(ret) {
+		ret = ret[:n]
+	}
+	for i := range ret {
+		ret[i].Key = cloneValue(ret[i].Key)
+	}
+	return ret, nil
+}
+
+// ResetHotKeys starts counting the Gets for HotKeys over
+func (be *KVBoltDBBackend) ResetHotKeys() {
+	if be.hotKeys != nil {
+		be.hotKeys.reset()
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+Secondary indexes map an attribute extracted from values to the keys holding it.
+For every data bucket the metadata bucket holds two buckets, each with a nested
+bucket per index: attribute to keys, entries made with pairKey, and key to
+attribute, so a write finds the entry to replace. Entries are written in the
+transaction of the value and removed in the one deleting the key, the reaper's
+and FlushExcept's included. Extractors are code: CreateIndex registers one for
+the life of the backend and must be called again after every open. Attributes
+are stored as extracted, so indexes aren't supported with EncryptionKey
+*/
+const (
+	indexBucketPrefix     = "index:"
+	indexKeysBucketPrefix = "indexkeys:"
+)
+
+// valueIndexes returns the attribute to keys and key to attribute buckets of index name
+func valueIndexes(tx *bolt.Tx, bucketName string, name string, create bool) (*bolt.Bucket, *bolt.Bucket, error) {
+	var attrs, keys *bolt.Bucket
+	for i, prefix := range []string{indexBucketPrefix, indexKeysBucketPrefix} {
+		var index *bolt.Bucket
+		if create {
+			meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+			if err != nil {
+				return nil, nil, err
+			}
+			parent, err := meta.CreateBucketIfNotExists([]byte(prefix + bucketName))
+			if err != nil {
+				return nil, nil, err
+			}
+			if index, err = parent.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return nil, nil, err
+			}
+		} else if meta := tx.Bucket([]byte(metaBucketName)); meta != nil {
+			if parent := meta.Bucket([]byte(prefix + bucketName)); parent != nil {
+				index = parent.Bucket([]byte(name))
+			}
+		}
+		if i == 0 {
+			attrs = index
+		} else {
+			keys = index
+		}
+	}
+	return attrs, keys, nil
+}
+
+// unindexKeyIn removes key from index name
+func unindexKeyIn(tx *bolt.Tx, bucketName string, name string, key []byte) error {
+	attrs, keys, err := valueIndexes(tx, bucketName, name, false)
+	if err != nil || attrs == nil || keys == nil {
+		return err
+	}
+	attr := keys.Get(key)
+	if attr == nil {
+		return nil
+	}
+	if err := attrs.Delete(pairKey(attr, key)); err != nil {
+		return err
+	}
+	return keys.Delete(key)
+}
+
+// unindexKey removes key from every registered index
+func (be *KVBoltDBBackend) unindexKey(tx *bolt.Tx, bucketName string, key []byte) error {
+	for name := range be.indexes {
+		if err := unindexKeyIn(tx, bucketName, name, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+indexValue makes iv, about to be stored, the entry of its key in every registered
+index. Tombstones, collections and values the extractor returns nil for leave no
+entry
+*/
+func (be *KVBoltDBBackend) indexValue(tx *bolt.Tx, bucketName string, iv *InternalValue) error {
+	for name, extract := range be.indexes {
+		if err := indexValueIn(tx, bucketName, name, extract, iv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexValueIn is indexValue for index name only
+func indexValueIn(tx *bolt.Tx, bucketName string, name string, extract func([]byte) []byte, iv *InternalValue) error {
+	if err := unindexKeyIn(tx, bucketName, name, iv.key); err != nil {
+		return err
+	}
+	if iv.tombstone || iv.kind != ValueScalar {
+		return nil
+	}
+	attr := extract(iv.value)
+	if attr == nil {
+		return nil
+	}
+	attrs, keys, err := valueIndexes(tx, bucketName, name, true)
+	if err != nil {
+		return err
+	}
+	if err := attrs.Put(pairKey(attr, iv.key), nil); err != nil {
+		return err
+	}
+	return keys.Put(iv.key, attr)
+}
+
+// dropIndexes deletes every secondary index of bucketName
+func dropIndexes(tx *bolt.Tx, bucketName string) error {
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		return nil
+	}
+	for _, name := range []string{indexBucketPrefix + bucketName, indexKeysBucketPrefix + bucketName} {
+		if meta.Bucket([]byte(name)) == nil {
+			continue
+		}
+		if err := meta.DeleteBucket([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+CreateIndex registers the secondary index name, extractor returning the attribute
+of a value or nil to leave it out, and rebuilds it over every bucket, one
+transaction per database, while other operations wait. Replacing the extractor
+of an existing index rebuilds it the same way. It fails with EncryptionKey, the
+attributes would be stored in the clear
+*/
+func (be *KVBoltDBBackend) CreateIndex(name string, extractor func(value []byte) []byte) error {
+	if name == "" {
+		return fmt.Errorf("Empty index name")
+	}
+	if be.aead != nil {
+		return fmt.Errorf("CreateIndex isn't supported with EncryptionKey")
+	}
+	if err := be.flushPending(); err != nil {
+		return err
+	}
+	be.dbMutex.Lock()
+	defer be.dbMutex.Unlock()
+	if be.closed {
+		return ErrBackendClosed
+	}
+
+	// every bucket file is opened, buckets not in use yet included
+	files, err := be.bucketFileNames()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range files {
+		if _, err := be.dbFor(bucket); err != nil {
+			return err
+		}
+	}
+	for _, db := range be.databases() {
+		err := db.Update(func(tx *bolt.Tx) error {
+			var names [][]byte
+			tx.ForEach(func(bucketName []byte, _ *bolt.Bucket) error {
+				if string(bucketName) != metaBucketName {
+					names = append(names, append([]byte(nil), bucketName...))
+				}
+				return nil
+			})
+			for _, bucketName := range names {
+				if err := be.rebuildIndex(tx, string(bucketName), name, extractor); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Error building index %s - %s", name, err)
+		}
+	}
+	if be.indexes == nil {
+		be.indexes = make(map[string]func([]byte) []byte)
+	}
+	be.indexes[name] = extractor
+	return nil
+}
+
+// rebuildIndex drops index name of bucketName and indexes its stored values again
+func (be *KVBoltDBBackend) rebuildIndex(tx *bolt.Tx, bucketName string, name string, extractor func([]byte) []byte) error {
+	for _, prefix := range []string{indexBucketPrefix, indexKeysBucketPrefix} {
+		if meta := tx.Bucket([]byte(metaBucketName)); meta != nil {
+			if parent := meta.Bucket([]byte(prefix + bucketName)); parent != nil && parent.Bucket([]byte(name)) != nil {
+				if err := parent.DeleteBucket([]byte(name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	var attrs, keys *bolt.Bucket
+	// the index buckets live in the metadata bucket, writing them doesn't move the cursor of the scan
+	return tx.Bucket([]byte(bucketName)).ForEach(func(k, v []byte) error {
+		iv, err := decodeValue(k, v)
+		if err != nil {
+			return err
+		}
+		if iv.tombstone || iv.kind != ValueScalar {
+			return nil
+		}
+		if err := be.open(iv); err != nil {
+			return err
+		}
+		attr := extractor(iv.value)
+		if attr == nil {
+			return nil
+		}
+		if attrs == nil {
+			if attrs, keys, err = valueIndexes(tx, bucketName, name, true); err != nil {
+				return err
+			}
+		}
+		if err := attrs.Put(pairKey(attr, k), nil); err != nil {
+			return err
+		}
+		return keys.Put(k, attr)
+	})
+}
+
+/*
+QueryIndex returns the keys of the current bucket whose value has attribute attr
+in index name, in key order. Expired keys are skipped
+*/
+func (be *KVBoltDBBackend) QueryIndex(name string, attr []byte) ([][]byte, error) {
+	if err := be.flushPending(); err != nil {
+		return nil, err
+	}
+	if err := be.rlock(); err != nil {
+		return nil, err
+	}
+	defer be.dbMutex.RUnlock()
+	if be.indexes[name] == nil {
+		return nil, fmt.Errorf("Unknown index %s", name)
+	}
+
+	var ret [][]byte
+	err := be.db.View(func(tx *bolt.Tx) error {
+		attrs, _, err := valueIndexes(tx, be.bucketName, name, false)
+		bucket := tx.Bucket([]byte(be.bucketName))
+		if err != nil || attrs == nil || bucket == nil {
+			return err
+		}
+		now := time.Now()
+		prefix := pairPrefix(attr)
+		c := attrs.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			key := k[len(prefix):]
+			raw := bucket.Get(key)
+			if raw == nil {
+				continue
+			}
+			if iv, err := decodeValue(key, raw); err != nil || iv.tombstone || iv.expired(now) {
+				continue
+			}
+			ret = append(ret, append([]byte(nil), key...))
+		}
+		return nil
+	})
+	return ret, err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+/*
+Bolt keeps keys in byte order and Range walks them that way, so limit and from
+always refer to byte order. RangeOrdered can sort the window it fetched with
+another comparator, but it only reorders those keys: the window itself is still
+the first limit keys in byte order. For an ordering that holds across pages,
+store keys in an order preserving encoding, like EncodeInt64Key for numbers
+*/
+
+/*
+RangeOrdered is Range also returning the keys of the window sorted by compare,
+which returns a negative number, zero or a positive number when a sorts before,
+equal to or after b. A nil compare keeps the storage order of the scan
+*/
+func (be *KVBoltDBBackend) RangeOrdered(key []byte, limit int, from []byte, reverse bool, compare func(a, b []byte) int) ([][]byte, map[string][]byte, error) {
+	ret, err := be.Range(key, limit, from, reverse)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := make([][]byte, 0, len(ret))
+	for k := range ret {
+		keys = append(keys, []byte(k))
+	}
+	if compare == nil {
+		compare = bytes.Compare
+		if reverse {
+			compare = func(a, b []byte) int { return bytes.Compare(b, a) }
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return compare(keys[i], keys[j]) < 0 })
+	return keys, ret, nil
+}
+
+/*
+EncodeInt64Key encodes n big endian with the sign bit flipped, so the byte order
+of encoded keys is the numeric order, negatives included
+*/
+func EncodeInt64Key(n int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(n)^(1<<63))
+	return k
+}
+
+// DecodeInt64Key returns the number encoded by EncodeInt64Key
+func DecodeInt64Key(k []byte) (int64, error) {
+	if len(k) != 8 {
+		return 0, fmt.Errorf("Int64 key must be 8 bytes, got %d", len(k))
+	}
+	return int64(binary.BigEndian.Uint64(k) ^ (1 << 63)), nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+A list is stored as a single value of kind ValueList: its items one after the
+other, each prefixed by its uvarint length. Pushes rewrite the whole value in one
+transaction, so lists suit short append only sequences. Flags, expiration and
+bucket MaxValueSize apply to the list as a whole
+*/
+
+// listItems splits an encoded list, the items reference v
+func listItems(key []byte, v []byte) ([][]byte, error) {
+	var items [][]byte
+	for len(v) > 0 {
+		l, n := binary.Uvarint(v)
+		if n <= 0 || uint64(len(v)-n) < l {
+			return nil, fmt.Errorf("Corrupted list for key %s", printableKey(key))
+		}
+		items = append(items, v[n:n+int(l)])
+		v = v[n+int(l):]
+	}
+	return items, nil
+}
+
+// appendListItem appends item to an encoded list
+func appendListItem(list []byte, item []byte) []byte {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(item)))
+	list = append(list, l[:n]...)
+	return append(list, item...)
+}
+
+/*
+ListPush appends value to the list at key, creating it if the key doesn't exist.
+Returns the new length of the list, ErrWrongType if key holds a scalar
+*/
+func (be *KVBoltDBBackend) ListPush(key []byte, value []byte) (int, error) {
+	key = be.normalizeKey(key)
+	if err := be.enterWrite(); err != nil {
+		return 0, err
+	}
+	defer be.writes.leave()
+	if !be.allowWrite() {
+		return 0, ErrRateLimited
+	}
+	if err := be.flushPending(); err != nil {
+		return 0, err
+	}
+	if err := be.rlock(); err != nil {
+		return 0, err
+	}
+	defer be.dbMutex.RUnlock()
+	cfg := be.BucketConfigFor(be.bucketName)
+
+	var length, expiration int
+	err := be.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(be.bucketName))
+		if err != nil {
+			return err
+		}
+		iv, err := be.liveValue(bucket, key)
+		if err != nil {
+			return err
+		}
+		list := &InternalValue{key: key, kind: ValueList, expiration: be.expirationFor(cfg.DefaultTTL, time.Now())}
+		var items [][]byte
+		if iv != nil {
+			if iv.kind != ValueList {
+				return ErrWrongType
+			}
+			if items, err = listItems(key, iv.value); err != nil {
+				return err
+			}
+			list.flags, list.expiration, list.ctype = iv.flags, iv.expiration, iv.ctype
+			list.value = cloneValue(iv.value)
+		}
+		list.value = appendListItem(list.value, value)
+		if limit := cfg.MaxValueSize; limit > 0 && len(list.value) > limit {
+			return fmt.Errorf("List for key %s is %d bytes, bucket %s accepts up to %d", printableKey(key), len(list.value), be.bucketName, limit)
+		}
+		// before the commit, see putIf
+		be.keyCache[be.bucketName].Add(key)
+		length = len(items) + 1
+		if iv == nil {
+			expiration = list.expiration
+		}
+		return be.putValue(tx, be.bucketName, bucket, list)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if expiration != 0 {
+		if err := be.indexExpiration(be.bucketName, key, expiration); err != nil {
+			log.Error("Error indexing expiration of key %s - %s", printableKey(key), err)
+		}
+	}
+	return length, nil
+}
+
+// viewList calls fn with the items of the list at key, nil if the key doesn't exist
+func (be *KVBoltDBBackend) viewList(key []byte, fn func(items [][]byte) error) error {
+	if err := be.flushPending(); err != nil {
+		return err
+	}
+	if err := be.rlock(); err != nil {
+		return err
+	}
+	defer be.dbMutex.RUnlock()
+	if !be.keyCache[be.bucketName].Test(key) {
+		return fn(nil)
+	}
+	return be.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(be.bucketName))
+		if bucket == nil {
+			return fn(nil)
+		}
+		iv, err := be.liveValue(bucket, key)
+		if err != nil {
+			return err
+		}
+		if iv == nil {
+			return fn(nil)
+		}
+		if iv.kind != ValueList {
+			return ErrWrongType
+		}
+		items, err := listItems(key, iv.value)
+		if err != nil {
+			return err
+		}
+		return fn(items)
+	})
+}
+
+/*
+ListRange returns the items of the list at key from start to stop, both included.
+Negative indexes count from the end, -1 is the last item. Out of range indexes
+are clamped, an empty range or a missing key return no items
+*/
+func (be *KVBoltDBBackend) ListRange(key []byte, start, stop int) ([][]byte, error) {
+	key = be.normalizeKey(key)
+	var ret [][]byte
+	err := be.viewList(key, func(items [][]byte) error {
+		n := len(items)
+		if start < 0 {
+			start += n
+		}
+		if stop < 0 {
+			stop += n
+		}
+		if start < 0 {
+			start = 0
+		}
+		if stop >= n {
+			stop = n - 1
+		}
+		for i := start; i <= stop; i++ {
+			ret = append(ret, cloneValue(items[i]))
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// ListLen returns the length of the list at key, 0 if the key doesn't exist
+func (be *KVBoltDBBackend) ListLen(key []byte) (int, error) {
+	key = be.normalizeKey(key)
+	var n int
+	err := be.viewList(key, func(items [][]byte) error {
+		n = len(items)
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+/*
+A patch rebuilds a value from the stored one and a few new bytes, so a client
+changing a small part of a large value doesn't send all of it:
+
+	version(1) old length(uvarint) old crc32(4) new length(uvarint) ops...
+
+Each op is a byte followed by its arguments. patchCopy appends length bytes of
+the old value from offset (both uvarints), patchInsert appends the length
+(uvarint) bytes following it. Lengths and checksum are checked before anything
+is written, a patch made against another value or building other than the
+announced length is refused. MakePatch writes patches of this format
+*/
+const patchVersion byte = 1
+
+// patch ops
+const (
+	patchCopy byte = iota
+	patchInsert
+)
+
+// ErrBadPatch is returned by ApplyPatch for a malformed patch or one made against another value
+var ErrBadPatch = errors.New("Patch doesn't apply to the stored value")
+
+/*
+MakePatch returns the patch turning old into new. It keeps the prefix and the
+suffix the values share and inserts what's between, fine for values edited in
+one place, not a real diff
+*/
+func MakePatch(old []byte, new []byte) []byte {
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix] == new[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix && old[len(old)-1-suffix] == new[len(new)-1-suffix] {
+		suffix++
+	}
+
+	patch := []byte{patchVersion}
+	patch = appendUvarint(patch, uint64(len(old)))
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(old))
+	patch = append(patch, checksum[:]...)
+	patch = appendUvarint(patch, uint64(len(new)))
+	if prefix > 0 {
+		patch = append(patch, patchCopy)
+		patch = appendUvarint(patch, 0)
+		patch = appendUvarint(patch, uint64(prefix))
+	}
+	if middle := new[prefix : len(new)-suffix]; len(middle) > 0 {
+		patch = append(patch, patchInsert)
+		patch = appendUvarint(patch, uint64(len(middle)))
+		patch = append(patch, middle...)
+	}
+	if suffix > 0 {
+		patch = append(patch, patchCopy)
+		patch = appendUvarint(patch, uint64(len(old)-suffix))
+		patch = appendUvarint(patch, uint64(suffix))
+	}
+	return patch
+}
+
+// appendUvarint appends the uvarint encoding of v to b
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// patchReader reads the fields of a patch, or of any uvarint framed buffer, the first malformed one sets bad
+type patchReader struct {
+	patch []byte
+	bad   bool
+}
+
+func (r *patchReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.patch)
+	if n <= 0 {
+		r.bad = true
+		return 0
+	}
+	r.patch = r.patch[n:]
+	return v
+}
+
+func (r *patchReader) bytes(n uint64) []byte {
+	if r.bad || n > uint64(len(r.patch)) {
+		r.bad = true
+		return nil
+	}
+	b := r.patch[:n]
+	r.patch = r.patch[n:]
+	return b
+}
+
+// applyPatch returns old with patch applied, ErrBadPatch if it doesn't apply
+func applyPatch(old []byte, patch []byte) ([]byte, error) {
+	r := &patchReader{patch: patch}
+	if version := r.bytes(1); r.bad || version[0] != patchVersion {
+		return nil, ErrBadPatch
+	}
+	oldLen := r.uvarint()
+	checksum := r.bytes(4)
+	newLen := r.uvarint()
+	if r.bad || oldLen != uint64(len(old)) || binary.BigEndian.Uint32(checksum) != crc32.ChecksumIEEE(old) {
+		return nil, ErrBadPatch
+	}
+
+	// the announced length bounds the work, whatever the ops ask
+	var ret []byte
+	for len(r.patch) > 0 {
+		op := r.bytes(1)[0]
+		var part []byte
+		switch op {
+		case patchCopy:
+			offset, length := r.uvarint(), r.uvarint()
+			if r.bad || offset > uint64(len(old)) || length > uint64(len(old))-offset {
+				return nil, ErrBadPatch
+			}
+			part = old[offset : offset+length]
+		case patchInsert:
+			part = r.bytes(r.uvarint())
+		default:
+			return nil, ErrBadPatch
+		}
+		if r.bad || uint64(len(part)) > newLen-uint64(len(ret)) {
+			return nil, ErrBadPatch
+		}
+		ret = append(ret, part...)
+	}
+	if uint64(len(ret)) != newLen {
+		return nil, ErrBadPatch
+	}
+	return ret, nil
+}
+
+/*
+ApplyPatch applies patch, made by MakePatch against the value stored at key, and
+stores the result in one write transaction like Update. Returns ErrKeyNotFound
+when the key doesn't exist and ErrBadPatch, leaving the value as it is, when the
+patch is malformed or the value changed since the patch was made
+*/
+func (be *KVBoltDBBackend) ApplyPatch(key []byte, patch []byte) error {
+	return be.Update(key, func(old []byte) ([]byte, error) {
+		if old == nil {
+			return nil, ErrKeyNotFound
+		}
+		return applyPatch(old, patch)
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrWritesPaused is returned by writes while writes are paused, see PauseWrites
+var ErrWritesPaused = errors.New("Writes are paused")
+
+/*
+writeGate lets writes through unless paused. Writes hold inflight for reading
+while they run, pause takes it for writing to wait for them to drain. resumed is
+nil unless paused and closed on resume, waking the writes waiting on it
+*/
+type writeGate struct {
+	lock     sync.Mutex
+	resumed  chan struct{}
+	inflight sync.RWMutex
+}
+
+/*
+enter lets a write through, waiting up to timeout while paused, forever if 0.
+With failFast a paused write fails at once
+*/
+func (g *writeGate) enter(timeout time.Duration, failFast bool) error {
+	var deadline <-chan time.Time
+	for {
+		g.lock.Lock()
+		resumed := g.resumed
+		if resumed == nil {
+			g.inflight.RLock()
+			g.lock.Unlock()
+			return nil
+		}
+		g.lock.Unlock()
+		if failFast {
+			return ErrWritesPaused
+		}
+		if deadline == nil && timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case <-resumed:
+		case <-deadline:
+			return ErrWritesPaused
+		}
+	}
+}
+
+func (g *writeGate) leave() {
+	g.inflight.RUnlock()
+}
+
+// pause stops new writes and waits for the running ones, false if already paused
+func (g *writeGate) pause() bool {
+	g.lock.Lock()
+	if g.resumed != nil {
+		g.lock.Unlock()
+		return false
+	}
+	g.resumed = make(chan struct{})
+	g.lock.Unlock()
+	g.inflight.Lock()
+	g.inflight.Unlock()
+	return true
+}
+
+func (g *writeGate) resume() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+/*
+enterWrite passes the write gate as the PausedWriteTimeout and FailPausedWrites
+options say, failing with ErrDiskFull while the disk is full
+*/
+func (be *KVBoltDBBackend) enterWrite() error {
+	if err := be.enterDiskFull(); err != nil {
+		return err
+	}
+	if err := be.enterBreaker(); err != nil {
+		return err
+	}
+	return be.writes.enter(be.opts.PausedWriteTimeout, be.opts.FailPausedWrites)
+}
+
+/*
+PauseWrites quiesces writes for maintenance, like a backup or a compaction, while
+reads go on. It returns once the writes already running are done and buffered
+Sets are flushed; every write after it waits for ResumeWrites, up to
+PausedWriteTimeout, and then fails with ErrWritesPaused. Replicated records wait
+the same way. Flush, compactions and other maintenance operations aren't paused.
+Pausing paused writes does nothing
+*/
+func (be *KVBoltDBBackend) PauseWrites() error {
+	if err := be.rlock(); err != nil {
+		return err
+	}
+	be.dbMutex.RUnlock()
+	if !be.writes.pause() {
+		return nil
+	}
+	// Sets buffered before the pause are written now, not at the next interval
+	if err := be.flushPending(); err != nil {
+		be.writes.resume()
+		return err
+	}
+	return nil
+}
+
+// ResumeWrites lets writes paused by PauseWrites through again
+func (be *KVBoltDBBackend) ResumeWrites() {
+	be.writes.resume()
+}
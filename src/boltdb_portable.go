@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+A portable snapshot is the current bucket as a stream of records any store can
+read, unlike Backup which copies bolt's file. Integers are big endian:
+
+	magic(8) version(1) record count(8) records...
+
+Each record is its length(4), its body and the CRC-32 of the body(4). The body
+holds the key and the value, each as a uvarint length and its bytes, the flags(4),
+the expiration as a unix time in seconds, 0 for none(8), the kind(1) and the
+content type(1). Values are plain, decrypted and uncompressed. Sets and hashes
+keep their members outside the record, like ExportKey snapshots don't hold them
+*/
+const (
+	portableMagic   = "BEANOSNP"
+	portableVersion = 1
+)
+
+// portableImportBatch is the number of records ImportSnapshot commits per transaction
+const portableImportBatch = 1000
+
+/*
+ExportSnapshot writes the current bucket to w as a portable snapshot. It fails
+with ErrWrongType, before writing anything, if the bucket holds a set or a hash
+*/
+func (be *KVBoltDBBackend) ExportSnapshot(w io.Writer) error {
+	if err := be.allowOp(OpBackup); err != nil {
+		return err
+	}
+	if err := be.flushPending(); err != nil {
+		return err
+	}
+	if err := be.rlock(); err != nil {
+		return err
+	}
+	defer be.dbMutex.RUnlock()
+
+	// the transaction holds the bucket still for the count and then the records
+	return be.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		bucket := tx.Bucket([]byte(be.bucketName))
+		exported := func(iv *InternalValue) bool {
+			return !iv.tombstone && !iv.expired(now)
+		}
+		var count uint64
+		if bucket != nil {
+			err := bucket.ForEach(func(k, v []byte) error {
+				iv, err := decodeValue(k, v)
+				if err != nil || !exported(iv) {
+					return err
+				}
+				if iv.kind == ValueSet || iv.kind == ValueHash {
+					log.Error("Snapshot of bucket %s not exported, key %s is a set or a hash", be.bucketName, printableKey(k))
+					return ErrWrongType
+				}
+				count++
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		bw := bufio.NewWriter(w)
+		header := make([]byte, len(portableMagic)+9)
+		copy(header, portableMagic)
+		header[len(portableMagic)] = portableVersion
+		binary.BigEndian.PutUint64(header[len(portableMagic)+1:], count)
+		if _, err := bw.Write(header); err != nil {
+			return err
+		}
+		if bucket != nil {
+			err := bucket.ForEach(func(k, v []byte) error {
+				iv, err := decodeValue(k, v)
+				if err != nil || !exported(iv) {
+					return err
+				}
+				if err := be.open(iv); err != nil {
+					return err
+				}
+				_, err = bw.Write(encodePortable(iv))
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	})
+}
+
+// encodePortable returns the record of iv in a portable snapshot, length and checksum included
+func encodePortable(iv *InternalValue) []byte {
+	body := make([]byte, 4, 4+2*binary.MaxVarintLen64+len(iv.key)+len(iv.value)+18)
+	body = appendUvarint(body, uint64(len(iv.key)))
+	body = append(body, iv.key...)
+	body = appendUvarint(body, uint64(len(iv.value)))
+	body = append(body, iv.value...)
+	var fixed [14]byte
+	binary.BigEndian.PutUint32(fixed[0:], uint32(iv.flags))
+	binary.BigEndian.PutUint64(fixed[4:], uint64(iv.expiration))
+	fixed[12], fixed[13] = byte(iv.kind), byte(iv.ctype)
+	body = append(body, fixed[:]...)
+	binary.BigEndian.PutUint32(body, uint32(len(body)-4))
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(body[4:]))
+	return append(body, checksum[:]...)
+}
+
+// decodePortable parses the body of a record of a portable snapshot, false if malformed
+func decodePortable(body []byte) (Record, bool) {
+	r := &patchReader{patch: body}
+	key := r.bytes(r.uvarint())
+	value := r.bytes(r.uvarint())
+	fixed := r.bytes(14)
+	if r.bad || len(r.patch) != 0 {
+		return Record{}, false
+	}
+	return Record{
+		Op:          RecordSet,
+		Key:         cloneValue(key),
+		Value:       cloneValue(value),
+		Flags:       int32(binary.BigEndian.Uint32(fixed[0:])),
+		Expiration:  int(int64(binary.BigEndian.Uint64(fixed[4:]))),
+		Kind:        ValueKind(fixed[12]),
+		ContentType: ContentType(fixed[13]),
+	}, true
+}
+
+/*
+ImportSnapshot loads a portable snapshot from ExportSnapshot into the current
+bucket, replacing the keys it holds like ImportKey, metadata included. Records
+are imported as they're read, portableImportBatch per transaction: a snapshot
+failing its checks halfway, truncated or corrupt, leaves the batches before in
+place
+*/
+func (be *KVBoltDBBackend) ImportSnapshot(r io.Reader) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(portableMagic)+9)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return fmt.Errorf("Error reading snapshot header - %s", err)
+	}
+	if !bytes.Equal(header[:len(portableMagic)], []byte(portableMagic)) {
+		return fmt.Errorf("Not a beano snapshot")
+	}
+	if version := header[len(portableMagic)]; version != portableVersion {
+		return fmt.Errorf("Unsupported snapshot version %d", version)
+	}
+	count := binary.BigEndian.Uint64(header[len(portableMagic)+1:])
+
+	be.dbMutex.RLock()
+	bucketName := be.bucketName
+	be.dbMutex.RUnlock()
+	var size [4]byte
+	batch := make([]Record, 0, portableImportBatch)
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(br, size[:]); err != nil {
+			return fmt.Errorf("Truncated snapshot at record %d of %d - %s", i, count, err)
+		}
+		// copied as it comes, a corrupt length doesn't allocate gigabytes up front
+		var record bytes.Buffer
+		if _, err := io.CopyN(&record, br, int64(binary.BigEndian.Uint32(size[:]))+4); err != nil {
+			return fmt.Errorf("Truncated snapshot at record %d of %d - %s", i, count, err)
+		}
+		body, checksum := record.Bytes()[:record.Len()-4], record.Bytes()[record.Len()-4:]
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(checksum) {
+			return fmt.Errorf("Checksum mismatch in snapshot record %d", i)
+		}
+		rec, ok := decodePortable(body)
+		if !ok {
+			return fmt.Errorf("Malformed snapshot record %d", i)
+		}
+		rec.Bucket = bucketName
+		if batch = append(batch, rec); len(batch) == portableImportBatch || i == count-1 {
+			if _, err := be.applyRecords(batch, true); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	return nil
+}
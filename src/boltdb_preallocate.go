@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// preallocateBucketName is the bucket of the metadata bucket holding the placeholder of Preallocate
+const preallocateBucketName = "preallocate"
+
+// preallocateChunk is the size of the placeholder values Preallocate writes
+const preallocateChunk = 16 << 20
+
+// preallocateTxSize is the placeholder size Preallocate writes per transaction
+const preallocateTxSize = 4 * preallocateChunk
+
+/*
+Preallocate grows the file of the current bucket to estimatedBytes before a bulk
+load, so its writes don't have to grow the file and remap it, stalling every
+other writer and waiting for the readers. It writes a placeholder of the missing
+size, preallocateTxSize per transaction so bolt doesn't hold all of it in dirty
+pages, and deletes it in a last transaction: bolt never shrinks its file or its
+memory map, the freed pages are reused by the writes that follow. The space is
+taken from the disk right away, and kept, even if the load never comes, and
+writing the placeholder costs as much as writing that much data once.
+InitialMmapSize in BoltOptions maps the space up front on open instead.
+A file already that large is left as it is. Like other writes it waits while
+writes are paused and fails while the disk is full or the circuit open
+*/
+func (be *KVBoltDBBackend) Preallocate(estimatedBytes int64) error {
+	if err := be.allowOp(OpPreallocate); err != nil {
+		return err
+	}
+	if err := be.enterWrite(); err != nil {
+		return err
+	}
+	defer be.writes.leave()
+	if !be.allowWrite() {
+		return ErrRateLimited
+	}
+	if err := be.rlock(); err != nil {
+		return err
+	}
+	defer be.dbMutex.RUnlock()
+
+	var size int64
+	be.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	missing := estimatedBytes - size
+	if missing <= 0 {
+		return nil
+	}
+
+	// bolt keeps the values until the commit, the chunk is shared and never changed
+	chunk := make([]byte, preallocateChunk)
+	n := uint64(0)
+	written := false
+	var err error
+	for missing > 0 && err == nil {
+		err = be.updateOn(be.db, func(tx *bolt.Tx) error {
+			meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+			if err != nil {
+				return err
+			}
+			placeholder, err := meta.CreateBucketIfNotExists([]byte(preallocateBucketName))
+			if err != nil {
+				return err
+			}
+			for size := int64(0); missing > 0 && size < preallocateTxSize; n++ {
+				value := chunk
+				if missing < int64(len(chunk)) {
+					value = chunk[:missing]
+				}
+				key := make([]byte, 8)
+				binary.BigEndian.PutUint64(key, n)
+				if err := placeholder.Put(key, value); err != nil {
+					return err
+				}
+				missing -= int64(len(value))
+				size += int64(len(value))
+			}
+			return nil
+		})
+		written = written || err == nil
+	}
+	if written {
+		// dropped even after a failure, the pages written so far are reused
+		dropErr := be.updateOn(be.db, func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(metaBucketName)).DeleteBucket([]byte(preallocateBucketName))
+		})
+		if err == nil {
+			err = dropErr
+		}
+	}
+	if err == ErrDiskFull {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Error preallocating %d bytes - %s", estimatedBytes, err)
+	}
+	return nil
+}
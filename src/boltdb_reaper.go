@@ -0,0 +1,228 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+The reaper is a background goroutine that deletes expired keys and purges
+tombstones once they are older than the tombstone grace window, so lagging
+replicas had the chance to see them. It only starts with state to reap: with
+the Tombstones, ChangeIndex or ChangeLog options, or expirations in the index
+when the backend opens. Else it's pending, the first expiration indexed or
+replicated delete applied starts it, see wakeReaper
+*/
+func (be *KVBoltDBBackend) startReaper(interval time.Duration) {
+	be.reaperLock.Lock()
+	defer be.reaperLock.Unlock()
+	atomic.StoreInt32(&be.reaperPending, 0)
+	if be.reaperStop != nil {
+		return
+	}
+	be.reaperStop = make(chan struct{})
+	be.reaperDone = make(chan struct{})
+	stop, done := be.reaperStop, be.reaperDone
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if n, err := be.reapExpired(time.Now()); err != nil {
+					log.Error("Reaper: %s", err)
+				} else if n > 0 {
+					log.Info("Reaper: deleted %d expired keys", n)
+				}
+				if !be.reapsTombstones() {
+					continue
+				}
+				if n, err := be.reap(time.Now()); err != nil {
+					log.Error("Reaper: %s", err)
+				} else if n > 0 {
+					log.Info("Reaper: purged %d tombstones", n)
+				}
+			}
+		}
+	}()
+}
+
+// reapsTombstones tells whether the options or applied deletes leave tombstones or changes for reap to purge
+func (be *KVBoltDBBackend) reapsTombstones() bool {
+	return be.hasTombstones() || be.opts.ChangeIndex || (be.opts.ChangeLog && be.opts.ChangeLogRetention > 0)
+}
+
+// tombstonesKey marks, in the metadata bucket, a database holding applied tombstones without the Tombstones option
+const tombstonesKey = "tombstones"
+
+// markTombstones writes tombstonesKey in tx, applying a replicated delete, unless the reaper looks already
+func (be *KVBoltDBBackend) markTombstones(tx *bolt.Tx) error {
+	if be.hasTombstones() {
+		return nil
+	}
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+	if err != nil {
+		return err
+	}
+	return meta.Put([]byte(tombstonesKey), []byte{1})
+}
+
+// loadTombstoneMark has the reaper look for tombstones if db was marked by markTombstones
+func (be *KVBoltDBBackend) loadTombstoneMark(db *bolt.DB) {
+	db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket([]byte(metaBucketName)); meta != nil && meta.Get([]byte(tombstonesKey)) != nil {
+			if atomic.CompareAndSwapInt32(&be.tombstoned, 0, 1) {
+				be.wakeReaper()
+			}
+		}
+		return nil
+	})
+}
+
+// hasTombstones tells whether buckets can hold tombstones: with Tombstones, or once a replicated delete was applied
+func (be *KVBoltDBBackend) hasTombstones() bool {
+	return be.opts.Tombstones || atomic.LoadInt32(&be.tombstoned) != 0
+}
+
+/*
+wakeReaper starts the pending reaper once a key expires, from a goroutine of its
+own: the writes calling it hold dbMutex, that a running pass waits for
+*/
+func (be *KVBoltDBBackend) wakeReaper() {
+	if !atomic.CompareAndSwapInt32(&be.reaperPending, 1, 2) {
+		return
+	}
+	go func() {
+		be.reaperLock.Lock()
+		// stopped or started meanwhile
+		wake := atomic.CompareAndSwapInt32(&be.reaperPending, 2, 0)
+		be.reaperLock.Unlock()
+		if wake {
+			be.startReaper(be.opts.ReaperInterval)
+		}
+	}()
+}
+
+// stopReaper stops the reaper goroutine and waits for it to finish, a pending one won't start
+func (be *KVBoltDBBackend) stopReaper() {
+	be.reaperLock.Lock()
+	defer be.reaperLock.Unlock()
+	atomic.StoreInt32(&be.reaperPending, 0)
+	if be.reaperStop == nil {
+		return
+	}
+	close(be.reaperStop)
+	<-be.reaperDone
+	be.reaperStop = nil
+}
+
+/*
+StartExpirationReaper starts the reaper, running every interval (ReaperInterval
+when <= 0). It's a no-op if the reaper is already running or the backend is
+closed. With the ManualReaper option the constructor doesn't start it, for tests
+and deployments that expire keys out of band
+*/
+func (be *KVBoltDBBackend) StartExpirationReaper(interval time.Duration) {
+	if err := be.rlock(); err != nil {
+		return
+	}
+	be.dbMutex.RUnlock()
+	if interval <= 0 {
+		interval = be.opts.ReaperInterval
+	}
+	be.startReaper(interval)
+}
+
+// StopExpirationReaper stops the reaper and waits for a running pass. It's a no-op if it isn't running
+func (be *KVBoltDBBackend) StopExpirationReaper() {
+	be.stopReaper()
+}
+
+/*
+reap deletes, in every bucket, the tombstones written before now minus the grace
+window, and trims the change logs. Returns the number of tombstones purged. The
+buckets are only read for tombstones when they can hold some, and a database
+is only written when it has some to purge or changes to trim
+*/
+func (be *KVBoltDBBackend) reap(now time.Time) (int, error) {
+	if err := be.rlock(); err != nil {
+		return 0, err
+	}
+	defer be.dbMutex.RUnlock()
+
+	deadline := now.Add(-be.opts.TombstoneGrace).UnixNano()
+	trims := be.opts.ChangeIndex || (be.opts.ChangeLog && be.opts.ChangeLogRetention > 0)
+	purged := 0
+	for _, db := range be.databases() {
+		doomed, err := be.oldTombstones(db, deadline)
+		if err != nil {
+			return 0, err
+		}
+		if len(doomed) == 0 && !trims {
+			continue
+		}
+		n := 0
+		err = db.Update(func(tx *bolt.Tx) error {
+			n = 0
+			return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+				if string(name) == metaBucketName {
+					return nil
+				}
+				for _, k := range doomed[string(name)] {
+					// rewritten since it was read
+					if iv, err := decodeValue(k, bucket.Get(k)); err != nil || !iv.tombstone || iv.modified >= deadline {
+						continue
+					}
+					if err := bucket.Delete(k); err != nil {
+						return err
+					}
+					if err := be.unindexKey(tx, string(name), k); err != nil {
+						return err
+					}
+					n++
+				}
+				if be.opts.ChangeIndex {
+					if err := reapChanges(tx, string(name), bucket, deadline); err != nil {
+						return err
+					}
+				}
+				return be.trimChangeLog(tx, string(name), now)
+			})
+		})
+		if err != nil {
+			return 0, err
+		}
+		purged += n
+	}
+	return purged, nil
+}
+
+// oldTombstones returns by bucket the keys of db whose tombstones are older than deadline, with Tombstones
+func (be *KVBoltDBBackend) oldTombstones(db *bolt.DB, deadline int64) (map[string][][]byte, error) {
+	if !be.hasTombstones() {
+		return nil, nil
+	}
+	doomed := make(map[string][][]byte)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			if string(name) == metaBucketName {
+				return nil
+			}
+			return bucket.ForEach(func(k, v []byte) error {
+				if iv, err := decodeValue(k, v); err == nil && iv.tombstone && iv.modified < deadline {
+					doomed[string(name)] = append(doomed[string(name)], append([]byte(nil), k...))
+				}
+				return nil
+			})
+		})
+	})
+	if len(doomed) == 0 {
+		return nil, err
+	}
+	return doomed, err
+}
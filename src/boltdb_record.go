@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+/*
+Values stored by the boltdb backend are framed with a fixed size header so
+metadata travels with the value:
+
+	magic(1) version(1) attrs(1) content type(1) flags(4) expiration(8) cas(8) modified(8) value...
+
+The attrs tell tombstones, encrypted and compressed rows, rows with a source tag,
+and the kind of value: scalars, the default, lists, sets or hashes.
+
+Rows with a source tag carry it right after the header, as a length byte and up
+to maxSourceSize bytes, never encrypted. Compressed rows carry the uncompressed
+size of the value next, as a uvarint. Encrypted rows carry the AES-GCM nonce
+next, before the sealed value, compressed before it's encrypted.
+Rows without the magic byte were written before the header existed and are read
+as plain values with no metadata. The content type byte was reserved and zero
+before content types existed, which reads as ContentTypeUnknown
+*/
+const (
+	headerMagic   byte = 0xbe
+	headerVersion byte = 1
+	headerSize         = 32
+)
+
+// header attrs bits
+const (
+	attrTombstone byte = 1 << iota
+	attrEncrypted
+	attrList
+	attrSet
+	attrHash
+	attrSource
+	attrCompressed
+)
+
+// maxSourceSize bounds the source tag stored with a value
+const maxSourceSize = 64
+
+/*
+ValueKind is the kind of value stored under a key. Scalar operations like Get
+fail with ErrWrongType on the other kinds, Set replaces a value of any kind
+*/
+type ValueKind byte
+
+// Value kinds
+const (
+	ValueScalar ValueKind = iota
+	ValueList
+	ValueSet
+	ValueHash
+)
+
+// ErrWrongType is returned by operations on a key holding another kind of value
+var ErrWrongType = errors.New("Operation against a key holding the wrong kind of value")
+
+/*
+ContentType is an optional hint of the encoding of a value, for proxies and
+clients. It is independent of the memcached flags
+*/
+type ContentType byte
+
+// Content types, unknown is the default of every value stored without one
+const (
+	ContentTypeUnknown ContentType = iota
+	ContentTypeText
+	ContentTypeJSON
+	ContentTypeMsgPack
+	ContentTypeProtobuf
+	ContentTypeBinary
+)
+
+/*
+Record is a committed mutation as published to the replication stream. Checksum,
+the CRC-32 of Value, is only set by ExportKey, with HasChecksum: a CRC-32 can be 0
+*/
+type Record struct {
+	Op          string
+	Bucket      string
+	Key         []byte
+	Value       []byte
+	Flags       int32
+	Expiration  int
+	CAS         int64
+	Modified    int64
+	ContentType ContentType
+	Kind        ValueKind
+	Source      []byte
+	Checksum    uint32
+	HasChecksum bool
+}
+
+/*
+Record operations. RecordExpire tells the reaper deleted an expired key, at
+Modified, and is only published with the ExpireEvents option
+*/
+const (
+	RecordSet    = "set"
+	RecordDelete = "delete"
+	RecordExpire = "expire"
+)
+
+// encodeValue frames an InternalValue with the header
+func encodeValue(iv *InternalValue) []byte {
+	buf := make([]byte, headerSize, headerSize+1+len(iv.source)+binary.MaxVarintLen64+len(iv.nonce)+len(iv.value))
+	buf[0] = headerMagic
+	buf[1] = headerVersion
+	if iv.tombstone {
+		buf[2] |= attrTombstone
+	}
+	if iv.nonce != nil {
+		buf[2] |= attrEncrypted
+	}
+	switch iv.kind {
+	case ValueList:
+		buf[2] |= attrList
+	case ValueSet:
+		buf[2] |= attrSet
+	case ValueHash:
+		buf[2] |= attrHash
+	}
+	buf[3] = byte(iv.ctype)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(iv.flags))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(iv.expiration))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(iv.cas))
+	binary.BigEndian.PutUint64(buf[24:32], uint64(iv.modified))
+	if len(iv.source) > 0 {
+		buf[2] |= attrSource
+		buf = append(buf, byte(len(iv.source)))
+		buf = append(buf, iv.source...)
+	}
+	if iv.plainLen > 0 {
+		buf[2] |= attrCompressed
+		buf = appendUvarint(buf, uint64(iv.plainLen))
+	}
+	buf = append(buf, iv.nonce...)
+	return append(buf, iv.value...)
+}
+
+// decodeValue parses a stored row. The returned value references raw
+func decodeValue(key []byte, raw []byte) (*InternalValue, error) {
+	if len(raw) < headerSize || raw[0] != headerMagic {
+		return &InternalValue{key: key, value: raw}, nil
+	}
+	if raw[1] != headerVersion {
+		return nil, fmt.Errorf("Unsupported header version %d for key %s", raw[1], printableKey(key))
+	}
+	iv := InternalValue{
+		key:        key,
+		tombstone:  raw[2]&attrTombstone != 0,
+		ctype:      ContentType(raw[3]),
+		flags:      int32(binary.BigEndian.Uint32(raw[4:8])),
+		expiration: int(binary.BigEndian.Uint64(raw[8:16])),
+		cas:        int64(binary.BigEndian.Uint64(raw[16:24])),
+		modified:   int64(binary.BigEndian.Uint64(raw[24:32])),
+		value:      raw[headerSize:],
+	}
+	switch {
+	case raw[2]&attrList != 0:
+		iv.kind = ValueList
+	case raw[2]&attrSet != 0:
+		iv.kind = ValueSet
+	case raw[2]&attrHash != 0:
+		iv.kind = ValueHash
+	}
+	if raw[2]&attrSource != 0 {
+		if len(iv.value) == 0 || len(iv.value) < 1+int(iv.value[0]) {
+			return nil, fmt.Errorf("Truncated source tag for key %s", printableKey(key))
+		}
+		n := 1 + int(iv.value[0])
+		iv.source, iv.value = iv.value[1:n], iv.value[n:]
+	}
+	if raw[2]&attrCompressed != 0 {
+		size, n := binary.Uvarint(iv.value)
+		if n <= 0 || size == 0 || size > math.MaxInt32 {
+			return nil, fmt.Errorf("Invalid compressed size for key %s", printableKey(key))
+		}
+		iv.plainLen, iv.value = int(size), iv.value[n:]
+	}
+	if raw[2]&attrEncrypted != 0 {
+		if len(iv.value) < nonceSize {
+			return nil, fmt.Errorf("Truncated encrypted value for key %s", printableKey(key))
+		}
+		iv.nonce, iv.value = iv.value[:nonceSize], iv.value[nonceSize:]
+	}
+	return &iv, nil
+}
+
+// record converts a stored value to its replication Record
+func (iv *InternalValue) record(bucket string) Record {
+	op := RecordSet
+	if iv.tombstone {
+		op = RecordDelete
+	}
+	return Record{
+		Op:          op,
+		Bucket:      bucket,
+		Key:         append([]byte(nil), iv.key...),
+		Value:       append([]byte(nil), iv.value...),
+		Flags:       iv.flags,
+		Expiration:  iv.expiration,
+		CAS:         iv.cas,
+		Modified:    iv.modified,
+		ContentType: iv.ctype,
+		Kind:        iv.kind,
+		Source:      append([]byte(nil), iv.source...),
+	}
+}
+
+// modifiedTime returns the last write time of a value
+func (iv *InternalValue) modifiedTime() time.Time {
+	return time.Unix(0, iv.modified)
+}
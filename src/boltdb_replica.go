@@ -0,0 +1,227 @@
+package main
+
+import (
+	"sync"
+)
+
+/*
+ReplicaBackend splits a boltdb backend for read scaling: writes go to the primary
+database and reads are served by a replica database, a second bolt file that is
+only written by applying the primary's replication stream.
+
+Consistency: records are applied to the replica asynchronously, in the order they
+are published. That isn't quite commit order, bolt runs the commit handlers
+publishing them once its write lock is released, so the records of concurrent
+commits can swap; ApplyReplicationRecord keeps the newer of a key by modification
+time and CAS, so the replica converges. Replica reads are eventually consistent
+and lag the primary by the records still queued. With readYourWrites a Get of a key with queued records, or still
+buffered by write coalescing, is served by the primary, and so is a Range while
+any record is queued: a client always reads what it wrote (and every write
+committed before it). Without it reads may return stale values or miss keys
+written moments before
+*/
+type ReplicaBackend struct {
+	primary        *KVBoltDBBackend
+	replica        *KVBoltDBBackend
+	readYourWrites bool
+	records        chan Record
+	done           chan struct{}
+	lock           sync.Mutex
+	drained        *sync.Cond
+	pending        map[string]int
+	closeOnce      sync.Once
+}
+
+// replicaQueueSize is the number of records queued for the replica before writes block
+const replicaQueueSize = 1024
+
+/*
+NewReplicaBackend opens primaryFile with opts and replicaFile as its replica. The
+replica shares the bloom sizing, encryption key, key normalizer and tombstone
+grace of the primary. opts.Replicate, when set, still receives every record
+*/
+func NewReplicaBackend(primaryFile string, replicaFile string, bucketName string, opts BackendOptions, readYourWrites bool) (*ReplicaBackend, error) {
+	replica, err := NewKVBoltDBBackendWithOptions(replicaFile, bucketName, BackendOptions{
+		MaxKeysPerBucket: opts.MaxKeysPerBucket,
+		EncryptionKey:    opts.EncryptionKey,
+		KeyNormalizer:    opts.KeyNormalizer,
+		TombstoneGrace:   opts.TombstoneGrace,
+		ReaperInterval:   opts.ReaperInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rb := &ReplicaBackend{
+		replica:        replica,
+		readYourWrites: readYourWrites,
+		records:        make(chan Record, replicaQueueSize),
+		done:           make(chan struct{}),
+		pending:        make(map[string]int),
+	}
+	rb.drained = sync.NewCond(&rb.lock)
+
+	upstream := opts.Replicate
+	opts.Replicate = func(rec Record) {
+		rb.enqueue(rec)
+		if upstream != nil {
+			upstream(rec)
+		}
+	}
+	rb.primary, err = NewKVBoltDBBackendWithOptions(primaryFile, bucketName, opts)
+	if err != nil {
+		replica.Close()
+		return nil, err
+	}
+	go rb.apply()
+	return rb, nil
+}
+
+func pendingKey(bucket string, key []byte) string {
+	return bucket + "\x00" + string(key)
+}
+
+// enqueue queues a committed record for the replica
+func (rb *ReplicaBackend) enqueue(rec Record) {
+	rb.lock.Lock()
+	rb.pending[pendingKey(rec.Bucket, rec.Key)]++
+	rb.lock.Unlock()
+	rb.records <- rec
+}
+
+// apply writes the queued records to the replica until the queue is closed
+func (rb *ReplicaBackend) apply() {
+	defer close(rb.done)
+	for rec := range rb.records {
+		if err := rb.replica.ApplyReplicationRecord(rec); err != nil {
+			log.Error("Replica: error applying %s of key %s - %s", rec.Op, printableKey(rec.Key), err)
+		}
+		rb.lock.Lock()
+		k := pendingKey(rec.Bucket, rec.Key)
+		if rb.pending[k]--; rb.pending[k] <= 0 {
+			delete(rb.pending, k)
+		}
+		if len(rb.pending) == 0 {
+			rb.drained.Broadcast()
+		}
+		rb.lock.Unlock()
+	}
+}
+
+// Sync waits until the replica applied every record committed so far
+func (rb *ReplicaBackend) Sync() {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	for len(rb.pending) > 0 {
+		rb.drained.Wait()
+	}
+}
+
+// Lag returns the number of records the replica still has to apply
+func (rb *ReplicaBackend) Lag() int {
+	return len(rb.records)
+}
+
+// readPrimary tells if a read of key must go to the primary, a nil key is a Range
+func (rb *ReplicaBackend) readPrimary(key []byte) bool {
+	if !rb.readYourWrites {
+		return false
+	}
+	if key == nil {
+		rb.lock.Lock()
+		defer rb.lock.Unlock()
+		return len(rb.pending) > 0
+	}
+	key = rb.primary.normalizeKey(key)
+	if _, ok := rb.primary.buffered(key); ok {
+		return true
+	}
+	rb.primary.dbMutex.RLock()
+	k := pendingKey(rb.primary.bucketName, key)
+	rb.primary.dbMutex.RUnlock()
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	return rb.pending[k] > 0
+}
+
+func (rb *ReplicaBackend) Set(key []byte, value []byte) error {
+	return rb.primary.Set(key, value)
+}
+
+func (rb *ReplicaBackend) Add(key []byte, value []byte) error {
+	return rb.primary.Add(key, value)
+}
+
+func (rb *ReplicaBackend) Replace(key []byte, value []byte) error {
+	return rb.primary.Replace(key, value)
+}
+
+func (rb *ReplicaBackend) Incr(key []byte, value uint64) (uint64, error) {
+	return rb.primary.Incr(key, value)
+}
+
+func (rb *ReplicaBackend) Decr(key []byte, value uint64) (uint64, error) {
+	return rb.primary.Decr(key, value)
+}
+
+func (rb *ReplicaBackend) Increment(key []byte, value int64, create_if_not_exists bool) (uint64, error) {
+	return rb.primary.Increment(key, value, create_if_not_exists)
+}
+
+func (rb *ReplicaBackend) Put(key []byte, value []byte, replace bool, passthru bool) error {
+	return rb.primary.Put(key, value, replace, passthru)
+}
+
+func (rb *ReplicaBackend) Delete(key []byte, only_if_exists bool) (bool, error) {
+	return rb.primary.Delete(key, only_if_exists)
+}
+
+func (rb *ReplicaBackend) Get(key []byte) ([]byte, error) {
+	if rb.readPrimary(key) {
+		return rb.primary.Get(key)
+	}
+	return rb.replica.Get(key)
+}
+
+func (rb *ReplicaBackend) Range(key []byte, limit int, from []byte, reverse bool) (map[string][]byte, error) {
+	if rb.readPrimary(nil) {
+		return rb.primary.Range(key, limit, from, reverse)
+	}
+	return rb.replica.Range(key, limit, from, reverse)
+}
+
+/*
+Flush empties the current bucket of the primary and, once the records before it
+are applied, of the replica. Flushes don't travel the replication stream
+*/
+func (rb *ReplicaBackend) Flush() error {
+	if err := rb.primary.Flush(); err != nil {
+		return err
+	}
+	rb.Sync()
+	return rb.replica.Flush()
+}
+
+// SwitchBucket switches both databases to bucket
+func (rb *ReplicaBackend) SwitchBucket(bucket string) error {
+	if err := rb.primary.SwitchBucket(bucket); err != nil {
+		return err
+	}
+	return rb.replica.SwitchBucket(bucket)
+}
+
+// Close closes the primary, lets the replica apply what is queued and closes it
+func (rb *ReplicaBackend) Close() {
+	rb.primary.Close()
+	rb.closeOnce.Do(func() { close(rb.records) })
+	<-rb.done
+	rb.replica.Close()
+}
+
+func (rb *ReplicaBackend) Stats() string      { return rb.primary.Stats() }
+func (rb *ReplicaBackend) GetDbPath() string  { return rb.primary.GetDbPath() }
+func (rb *ReplicaBackend) BucketStats() error { return nil }
+func (rb *ReplicaBackend) Version() string    { return rb.primary.Version() }
+
+func (rb *ReplicaBackend) SetVerbosity(level int) { rb.primary.SetVerbosity(level) }
+
+func (rb *ReplicaBackend) StatsJSON() ([]byte, error) { return rb.primary.StatsJSON() }
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+ReplicatedBackend writes every change synchronously to several boltdb backends,
+one file each, ideally on different disks, so the data survives the loss of one.
+Unlike ReplicaBackend there's no primary: every replica applies every write.
+
+Quorum: a write is acknowledged once quorum replicas committed it, fsynced, even
+on NoSync backends, and its outcome is the one of the first replica to commit.
+It fails, with the error of the first replica failing it, once so many failed
+that the quorum can't be reached. Either way the slower replicas still apply it:
+each has a queue applying the writes in the order they were made, the same on
+every replica, so a slow disk lags but doesn't reorder. A replica that lags by
+replicatedQueueSize writes blocks the next one, queued holding the lock every
+write takes, so a slow disk throttles every writer once its queue is full.
+
+Failures: a replica whose outcome differs from the one returned, failing an
+acknowledged write or committing a failed one, no longer holds the same data
+and is marked stale: it keeps applying the writes but stops serving reads, see
+StaleReplicas. The mark is stored in the metadata bucket of the replica, so it
+stays stale when opened again, unless the failing disk couldn't store it either,
+which is logged. It's repaired by replacing its file with a copy of a replica in
+sync, like a Backup, while the backend is closed. With every replica stale reads
+fail.
+
+Consistency: reads are served by any replica in sync, in turns. With a quorum
+smaller than the replicas a read can hit one that hasn't applied an acknowledged
+write yet and see the value before it, a quorum of every replica, or a Sync
+after the write, reads its writes. Flush travels the queues like the writes
+*/
+type ReplicatedBackend struct {
+	replicas []*KVBoltDBBackend
+	files    []string
+	quorum   int
+	queues   []chan func()
+	lock     sync.Mutex
+	stale    []int32
+	next     uint32
+	done     sync.WaitGroup
+}
+
+// replicatedQueueSize is the number of writes queued for a replica before writes block
+const replicatedQueueSize = 1024
+
+// replicatedStaleKey marks a stale replica in its metadata bucket, the value is the reason
+const replicatedStaleKey = "replicated_stale"
+
+// replicatedResult is the outcome of a write on a replica
+type replicatedResult struct {
+	replica int
+	value   uint64
+	ok      bool
+	err     error
+}
+
+/*
+NewReplicatedBackend opens a replica for each of files with opts, a quorum of 0
+being a majority of them. The Replicate and CoalesceInterval options aren't
+supported: records would be published once per replica and coalesced Sets are
+acknowledged before they commit
+*/
+func NewReplicatedBackend(files []string, bucketName string, opts BackendOptions, quorum int) (*ReplicatedBackend, error) {
+	if quorum == 0 {
+		quorum = len(files)/2 + 1
+	}
+	if len(files) == 0 || quorum < 0 || quorum > len(files) {
+		return nil, fmt.Errorf("Quorum of %d for %d replicas", quorum, len(files))
+	}
+	if opts.Replicate != nil || opts.CoalesceInterval > 0 {
+		return nil, fmt.Errorf("ReplicatedBackend doesn't support the Replicate and CoalesceInterval options")
+	}
+	rb := &ReplicatedBackend{files: files, quorum: quorum, stale: make([]int32, len(files))}
+	for _, file := range files {
+		be, err := NewKVBoltDBBackendWithOptions(file, bucketName, opts)
+		if err != nil {
+			rb.closeReplicas()
+			return nil, err
+		}
+		rb.replicas = append(rb.replicas, be)
+	}
+	for i, be := range rb.replicas {
+		reason, err := staleMark(be)
+		if err != nil {
+			rb.closeReplicas()
+			return nil, fmt.Errorf("Error reading the stale mark of replica %s - %s", files[i], err)
+		}
+		if reason != nil {
+			rb.stale[i] = 1
+			log.Warning("Replica %s marked out of sync, not read until repaired - %s", files[i], reason)
+		}
+	}
+	for range rb.replicas {
+		queue := make(chan func(), replicatedQueueSize)
+		rb.queues = append(rb.queues, queue)
+		rb.done.Add(1)
+		go func() {
+			defer rb.done.Done()
+			for write := range queue {
+				write()
+			}
+		}()
+	}
+	return rb, nil
+}
+
+/*
+write queues op on every replica and returns the outcome of the quorum, see
+ReplicatedBackend. The replicas left are checked in the background
+*/
+func (rb *ReplicatedBackend) write(op func(be *KVBoltDBBackend) replicatedResult) replicatedResult {
+	results := make(chan replicatedResult, len(rb.replicas))
+	rb.lock.Lock()
+	if rb.queues == nil {
+		rb.lock.Unlock()
+		return replicatedResult{err: ErrBackendClosed}
+	}
+	for i, queue := range rb.queues {
+		i := i
+		queue <- func() {
+			r := op(rb.replicas[i])
+			r.replica = i
+			results <- r
+		}
+	}
+	rb.lock.Unlock()
+
+	var acked, failed []replicatedResult
+	for len(acked) < rb.quorum && len(failed) <= len(rb.replicas)-rb.quorum {
+		if r := <-results; r.err == nil {
+			acked = append(acked, r)
+		} else {
+			failed = append(failed, r)
+		}
+	}
+	var outcome replicatedResult
+	if len(acked) == rb.quorum {
+		outcome = acked[0]
+	} else {
+		outcome = failed[0]
+	}
+	received := len(acked) + len(failed)
+	go func() {
+		for _, r := range append(acked, failed...) {
+			rb.check(r, outcome)
+		}
+		for ; received < len(rb.replicas); received++ {
+			rb.check(<-results, outcome)
+		}
+	}()
+	return outcome
+}
+
+// check marks the replica of r stale when its outcome differs from the one returned
+func (rb *ReplicatedBackend) check(r replicatedResult, outcome replicatedResult) {
+	if (r.err == nil) == (outcome.err == nil) && r.value == outcome.value && r.ok == outcome.ok {
+		return
+	}
+	if atomic.SwapInt32(&rb.stale[r.replica], 1) == 0 {
+		reason := "committed a failed write"
+		if r.err != nil {
+			reason = r.err.Error()
+		}
+		log.Error("Replica %s out of sync, no longer read - %s", rb.files[r.replica], reason)
+		if err := markStale(rb.replicas[r.replica], reason); err != nil {
+			log.Error("Error storing the stale mark of replica %s, it's read again if reopened before repair - %s", rb.files[r.replica], err)
+		}
+	}
+}
+
+// markStale stores the stale mark of the replica be, see ReplicatedBackend
+func markStale(be *KVBoltDBBackend, reason string) error {
+	if err := be.rlock(); err != nil {
+		return err
+	}
+	defer be.dbMutex.RUnlock()
+	return be.main.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte(replicatedStaleKey), []byte(reason))
+	})
+}
+
+// staleMark returns the reason the replica be was marked stale with, nil if it wasn't
+func staleMark(be *KVBoltDBBackend) ([]byte, error) {
+	if err := be.rlock(); err != nil {
+		return nil, err
+	}
+	defer be.dbMutex.RUnlock()
+	var reason []byte
+	err := be.main.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket([]byte(metaBucketName)); meta != nil {
+			if v := meta.Get([]byte(replicatedStaleKey)); v != nil {
+				reason = cloneValue(v)
+			}
+		}
+		return nil
+	})
+	return reason, err
+}
+
+// Sync waits until every replica applied the writes made so far
+func (rb *ReplicatedBackend) Sync() {
+	var applied sync.WaitGroup
+	rb.lock.Lock()
+	for _, queue := range rb.queues {
+		applied.Add(1)
+		queue <- applied.Done
+	}
+	rb.lock.Unlock()
+	applied.Wait()
+}
+
+// read calls fn with the replicas in sync, starting from the next in turn, until one doesn't fail
+func (rb *ReplicatedBackend) read(fn func(be *KVBoltDBBackend) error) error {
+	start := int(atomic.AddUint32(&rb.next, 1))
+	err := fmt.Errorf("No replica in sync")
+	for j := range rb.replicas {
+		i := (start + j) % len(rb.replicas)
+		if atomic.LoadInt32(&rb.stale[i]) != 0 {
+			continue
+		}
+		if err = fn(rb.replicas[i]); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// StaleReplicas returns the files of the replicas out of sync, which no longer serve reads
+func (rb *ReplicatedBackend) StaleReplicas() []string {
+	var ret []string
+	for i := range rb.replicas {
+		if atomic.LoadInt32(&rb.stale[i]) != 0 {
+			ret = append(ret, rb.files[i])
+		}
+	}
+	return ret
+}
+
+func (rb *ReplicatedBackend) Set(key []byte, value []byte) error {
+	return rb.Put(key, value, false, true)
+}
+
+func (rb *ReplicatedBackend) Add(key []byte, value []byte) error {
+	return rb.Put(key, value, false, false)
+}
+
+func (rb *ReplicatedBackend) Replace(key []byte, value []byte) error {
+	return rb.Put(key, value, true, false)
+}
+
+func (rb *ReplicatedBackend) Incr(key []byte, value uint64) (uint64, error) {
+	return rb.Increment(key, signedDelta(value, false), false)
+}
+
+func (rb *ReplicatedBackend) Decr(key []byte, value uint64) (uint64, error) {
+	return rb.Increment(key, signedDelta(value, true), false)
+}
+
+func (rb *ReplicatedBackend) Increment(key []byte, value int64, create_if_not_exists bool) (uint64, error) {
+	r := rb.write(func(be *KVBoltDBBackend) replicatedResult {
+		n, err := be.IncrementWithDurability(key, value, create_if_not_exists, DurabilitySync)
+		return replicatedResult{value: n, err: err}
+	})
+	return r.value, r.err
+}
+
+func (rb *ReplicatedBackend) Put(key []byte, value []byte, replace bool, passthru bool) error {
+	return rb.write(func(be *KVBoltDBBackend) replicatedResult {
+		return replicatedResult{err: be.PutWithDurability(key, value, replace, passthru, DurabilitySync)}
+	}).err
+}
+
+func (rb *ReplicatedBackend) Delete(key []byte, only_if_exists bool) (bool, error) {
+	r := rb.write(func(be *KVBoltDBBackend) replicatedResult {
+		ok, err := be.DeleteWithDurability(key, only_if_exists, DurabilitySync)
+		return replicatedResult{ok: ok, err: err}
+	})
+	return r.ok, r.err
+}
+
+func (rb *ReplicatedBackend) Get(key []byte) ([]byte, error) {
+	var ret []byte
+	err := rb.read(func(be *KVBoltDBBackend) error {
+		v, err := be.Get(key)
+		ret = v
+		return err
+	})
+	return ret, err
+}
+
+func (rb *ReplicatedBackend) Range(key []byte, limit int, from []byte, reverse bool) (map[string][]byte, error) {
+	var ret map[string][]byte
+	err := rb.read(func(be *KVBoltDBBackend) error {
+		m, err := be.Range(key, limit, from, reverse)
+		ret = m
+		return err
+	})
+	return ret, err
+}
+
+// Flush empties the current bucket of every replica, once the writes before it are applied
+func (rb *ReplicatedBackend) Flush() error {
+	return rb.write(func(be *KVBoltDBBackend) replicatedResult {
+		return replicatedResult{err: be.Flush()}
+	}).err
+}
+
+// Close lets every replica apply the writes queued and closes them
+func (rb *ReplicatedBackend) Close() {
+	rb.lock.Lock()
+	for _, queue := range rb.queues {
+		close(queue)
+	}
+	rb.queues = nil
+	rb.lock.Unlock()
+	rb.done.Wait()
+	rb.closeReplicas()
+}
+
+func (rb *ReplicatedBackend) closeReplicas() {
+	for _, be := range rb.replicas {
+		be.Close()
+	}
+}
+
+// Stats reports the stats of the first replica and the number of stale ones
+func (rb *ReplicatedBackend) Stats() string {
+	lines := []string{fmt.Sprintf("replicas %d", len(rb.replicas)), fmt.Sprintf("replicas_stale %d", len(rb.StaleReplicas()))}
+	if stats := rb.replicas[0].Stats(); stats != "" {
+		lines = append(lines, stats)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// StatsJSON is Stats as a JSON object with bolt's stats, see KVBoltDBBackend.StatsJSON
+func (rb *ReplicatedBackend) StatsJSON() ([]byte, error) {
+	js, err := rb.replicas[0].StatsJSON()
+	if err != nil {
+		return nil, err
+	}
+	obj := make(map[string]int64)
+	if err := json.Unmarshal(js, &obj); err != nil {
+		return nil, err
+	}
+	obj["replicas"], obj["replicas_stale"] = int64(len(rb.replicas)), int64(len(rb.StaleReplicas()))
+	return json.Marshal(obj)
+}
+
+func (rb *ReplicatedBackend) GetDbPath() string  { return rb.replicas[0].GetDbPath() }
+func (rb *ReplicatedBackend) BucketStats() error { return nil }
+func (rb *ReplicatedBackend) Version() string    { return rb.replicas[0].Version() }
+
+func (rb *ReplicatedBackend) SetVerbosity(level int) { rb.replicas[0].SetVerbosity(level) }
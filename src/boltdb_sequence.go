@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+Named sequences live in the main database, whatever the bucket: a bucket of the
+metadata bucket holds a nested bucket per name, whose bolt sequence is the
+counter. They store no value and are independent of every bucket and key
+*/
+const sequencesBucketName = "sequences"
+
+/*
+NextSequence returns the next value of the sequence name, 1 for a new one, for
+unique ids. Values are durable and grow by one, a value is never handed out twice,
+even across restarts. Flush doesn't reset sequences
+*/
+func (be *KVBoltDBBackend) NextSequence(name []byte) (uint64, error) {
+	if len(name) == 0 {
+		return 0, fmt.Errorf("Empty sequence name")
+	}
+	if err := be.enterWrite(); err != nil {
+		return 0, err
+	}
+	defer be.writes.leave()
+	if !be.allowWrite() {
+		return 0, ErrRateLimited
+	}
+	if err := be.rlock(); err != nil {
+		return 0, err
+	}
+	defer be.dbMutex.RUnlock()
+
+	var seq uint64
+	err := be.updateOn(be.main, func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+		if err != nil {
+			return err
+		}
+		sequences, err := meta.CreateBucketIfNotExists([]byte(sequencesBucketName))
+		if err != nil {
+			return err
+		}
+		sequence, err := sequences.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		seq, err = sequence.NextSequence()
+		return err
+	})
+	if err == ErrDiskFull {
+		return 0, err
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Error advancing sequence %s - %s", printableKey(name), err)
+	}
+	return seq, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+Collections, sets and hashes, keep a marker row of their kind in the data bucket, for
+expiration, bloom filter and type checks, and their members in a nested bucket
+per key inside the collection bucket of the data bucket, in the metadata bucket.
+Member operations are atomic but only the marker is replicated and versioned: its
+CAS and change index entry are the ones of the collection creation. Members of a
+collection overwritten by a scalar or expired are dropped when the key becomes a
+collection again or the bucket is flushed. Set members are the keys of their
+bucket, stored as given: EncryptionKey doesn't encrypt them, sets mustn't hold
+secrets
+*/
+const (
+	setsBucketPrefix   = "sets:"
+	hashesBucketPrefix = "hashes:"
+)
+
+// collectionPrefixes are the collection buckets of every kind
+var collectionPrefixes = []string{setsBucketPrefix, hashesBucketPrefix}
+
+// membersBucket returns the members of key in the prefix collection bucket, nil if missing
+func membersBucket(tx *bolt.Tx, prefix string, bucketName string, key []byte) *bolt.Bucket {
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		return nil
+	}
+	collection := meta.Bucket([]byte(prefix + bucketName))
+	if collection == nil {
+		return nil
+	}
+	return collection.Bucket(key)
+}
+
+// newMembersBucket creates an empty members bucket for key, dropping stale members
+func newMembersBucket(tx *bolt.Tx, prefix string, bucketName string, key []byte) (*bolt.Bucket, error) {
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+	if err != nil {
+		return nil, err
+	}
+	collection, err := meta.CreateBucketIfNotExists([]byte(prefix + bucketName))
+	if err != nil {
+		return nil, err
+	}
+	if collection.Bucket(key) != nil {
+		if err := collection.DeleteBucket(key); err != nil {
+			return nil, err
+		}
+	}
+	return collection.CreateBucket(key)
+}
+
+// dropMembers deletes the members of key in every collection bucket
+func dropMembers(tx *bolt.Tx, bucketName string, key []byte) error {
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		return nil
+	}
+	for _, prefix := range collectionPrefixes {
+		collection := meta.Bucket([]byte(prefix + bucketName))
+		if collection == nil || collection.Bucket(key) == nil {
+			continue
+		}
+		if err := collection.DeleteBucket(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropCollections deletes the collection buckets of bucketName
+func dropCollections(tx *bolt.Tx, bucketName string) error {
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		return nil
+	}
+	for _, prefix := range collectionPrefixes {
+		if meta.Bucket([]byte(prefix+bucketName)) == nil {
+			continue
+		}
+		if err := meta.DeleteBucket([]byte(prefix + bucketName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+updateCollection runs fn with the members of the kind collection at key in a write
+transaction. With create a missing key becomes an empty collection, without it fn
+gets nil members. A collection fn leaves empty is deleted. Returns ErrWrongType if
+key holds another kind of value
+*/
+func (be *KVBoltDBBackend) updateCollection(key []byte, kind ValueKind, prefix string, create bool, fn func(members *bolt.Bucket) error) error {
+	if err := be.enterWrite(); err != nil {
+		return err
+	}
+	defer be.writes.leave()
+	if !be.allowWrite() {
+		return ErrRateLimited
+	}
+	if err := be.flushPending(); err != nil {
+		return err
+	}
+	if err := be.rlock(); err != nil {
+		return err
+	}
+	defer be.dbMutex.RUnlock()
+
+	var expiration int
+	var deleted bool
+	err := be.update(func(tx *bolt.Tx) error {
+		expiration, deleted = 0, false
+		bucket, err := tx.CreateBucketIfNotExists([]byte(be.bucketName))
+		if err != nil {
+			return err
+		}
+		iv, err := be.liveValue(bucket, key)
+		if err != nil {
+			return err
+		}
+		if iv != nil && iv.kind != kind {
+			return ErrWrongType
+		}
+
+		var members *bolt.Bucket
+		if iv != nil {
+			members = membersBucket(tx, prefix, be.bucketName, key)
+		}
+		if iv == nil && create {
+			marker := &InternalValue{
+				key:        key,
+				kind:       kind,
+				expiration: be.expirationFor(be.BucketConfigFor(be.bucketName).DefaultTTL, time.Now()),
+				value:      []byte{},
+			}
+			if err := untagKey(tx, be.bucketName, key); err != nil {
+				return err
+			}
+			// before the commit, see putIf
+			be.keyCache[be.bucketName].Add(key)
+			if err := be.putValue(tx, be.bucketName, bucket, marker); err != nil {
+				return err
+			}
+			expiration = marker.expiration
+		}
+		// replicated markers come without members
+		if members == nil && create {
+			if members, err = newMembersBucket(tx, prefix, be.bucketName, key); err != nil {
+				return err
+			}
+		}
+		if err := fn(members); err != nil {
+			return err
+		}
+		if members != nil {
+			if k, _ := members.Cursor().First(); k == nil {
+				deleted = true
+				return be.deleteKey(tx, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if deleted {
+		be.keyCache[be.bucketName].Remove(key)
+	} else if expiration != 0 {
+		if err := be.indexExpiration(be.bucketName, key, expiration); err != nil {
+			log.Error("Error indexing expiration of key %s - %s", printableKey(key), err)
+		}
+	}
+	return nil
+}
+
+/*
+viewCollection runs fn with the members of the kind collection at key in a read
+transaction, nil if the key doesn't exist. Returns ErrWrongType if key holds
+another kind of value
+*/
+func (be *KVBoltDBBackend) viewCollection(key []byte, kind ValueKind, prefix string, fn func(members *bolt.Bucket) error) error {
+	if err := be.flushPending(); err != nil {
+		return err
+	}
+	if err := be.rlock(); err != nil {
+		return err
+	}
+	defer be.dbMutex.RUnlock()
+	if !be.keyCache[be.bucketName].Test(key) {
+		return fn(nil)
+	}
+	return be.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(be.bucketName))
+		if bucket == nil {
+			return fn(nil)
+		}
+		iv, err := be.liveValue(bucket, key)
+		if err != nil {
+			return err
+		}
+		if iv == nil {
+			return fn(nil)
+		}
+		if iv.kind != kind {
+			return ErrWrongType
+		}
+		return fn(membersBucket(tx, prefix, be.bucketName, key))
+	})
+}
+
+// SetAdd adds member to the set at key, creating it. Returns false if it was already a member
+func (be *KVBoltDBBackend) SetAdd(key []byte, member []byte) (bool, error) {
+	key = be.normalizeKey(key)
+	added := false
+	err := be.updateCollection(key, ValueSet, setsBucketPrefix, true, func(members *bolt.Bucket) error {
+		added = members.Get(member) == nil
+		if !added {
+			return nil
+		}
+		return members.Put(member, []byte{})
+	})
+	return added, err
+}
+
+// SetRemove removes member from the set at key, returns false if it wasn't a member
+func (be *KVBoltDBBackend) SetRemove(key []byte, member []byte) (bool, error) {
+	key = be.normalizeKey(key)
+	removed := false
+	err := be.updateCollection(key, ValueSet, setsBucketPrefix, false, func(members *bolt.Bucket) error {
+		removed = members != nil && members.Get(member) != nil
+		if !removed {
+			return nil
+		}
+		return members.Delete(member)
+	})
+	return removed, err
+}
+
+// SetIsMember tells if member is in the set at key
+func (be *KVBoltDBBackend) SetIsMember(key []byte, member []byte) (bool, error) {
+	key = be.normalizeKey(key)
+	found := false
+	err := be.viewCollection(key, ValueSet, setsBucketPrefix, func(members *bolt.Bucket) error {
+		found = members != nil && members.Get(member) != nil
+		return nil
+	})
+	return found, err
+}
+
+// SetMembers returns the members of the set at key in byte order, none if it doesn't exist
+func (be *KVBoltDBBackend) SetMembers(key []byte) ([][]byte, error) {
+	key = be.normalizeKey(key)
+	var ret [][]byte
+	err := be.viewCollection(key, ValueSet, setsBucketPrefix, func(members *bolt.Bucket) error {
+		if members == nil {
+			return nil
+		}
+		return members.ForEach(func(k, _ []byte) error {
+			ret = append(ret, cloneValue(k))
+			return nil
+		})
+	})
+	return ret, err
+}
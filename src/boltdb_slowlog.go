@@ -0,0 +1,21 @@
+package main
+
+import (
+	"time"
+)
+
+// slowLog logs op on key, nil for operations on many keys, if it took longer than the SlowLogThreshold
+func (be *KVBoltDBBackend) slowLog(op string, key []byte, start time.Time) {
+	threshold := be.opts.SlowLogThreshold
+	if threshold <= 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	switch {
+	case elapsed <= threshold:
+	case key == nil:
+		log.Warning("Slow %s took %s", op, elapsed)
+	default:
+		log.Warning("Slow %s of key %s took %s", op, printableKey(key), elapsed)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrSnapshotExpired is returned by the reads of a snapshot released for being older than MaxSnapshotAge
+var ErrSnapshotExpired = errors.New("Snapshot was released for exceeding the maximum age")
+
+/*
+Snapshot is a point in time view of the current bucket, read from a long lived
+bolt read transaction: its Gets and Ranges see the database as it was when the
+snapshot was taken, whatever is written after. Values buffered by write
+coalescing are flushed when it's taken. Only the read transaction stays open,
+the backend goes on, other operations and its exclusive ones like SwitchBucket
+included.
+
+Holding a snapshot is expensive though. bolt can't reuse the pages freed by later
+writes while it is open, so the file grows, and a write that has to grow the
+memory map waits for it to be released, with every write behind it, forever if
+the same goroutine holds it: a large InitialMmapSize in BoltOptions avoids the
+remaps. Release it as soon as possible, debugging is what it's for. The
+MaxSnapshotAge option bounds the wait, a watchdog releases the snapshot when it
+gets older and its reads fail with ErrSnapshotExpired from then on, without it
+nothing does. Close and Reopen release the snapshots left, their reads then fail
+with ErrBackendClosed.
+
+Reads hold lock for reading, releasing takes it for writing so the transaction
+isn't closed under a running read
+*/
+type Snapshot struct {
+	be       *KVBoltDBBackend
+	tx       *bolt.Tx
+	txid     int
+	bucket   *bolt.Bucket
+	lock     sync.RWMutex
+	err      error
+	watchdog *time.Timer
+}
+
+// Snapshot takes a snapshot of the current bucket, Release must be called once done
+func (be *KVBoltDBBackend) Snapshot() (*Snapshot, error) {
+	if err := be.flushPending(); err != nil {
+		return nil, err
+	}
+	if err := be.rlock(); err != nil {
+		return nil, err
+	}
+	defer be.dbMutex.RUnlock()
+	tx, err := be.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{be: be, tx: tx, txid: tx.ID(), bucket: tx.Bucket([]byte(be.bucketName))}
+	be.snapshotLock.Lock()
+	if be.snapshots == nil {
+		be.snapshots = make(map[*Snapshot]struct{})
+	}
+	be.snapshots[s] = struct{}{}
+	be.snapshotLock.Unlock()
+	if be.opts.MaxSnapshotAge > 0 {
+		s.watchdog = time.AfterFunc(be.opts.MaxSnapshotAge, s.expire)
+	}
+	return s, nil
+}
+
+// releaseSnapshots releases the open snapshots before the files are closed, bolt would wait for them
+func (be *KVBoltDBBackend) releaseSnapshots() {
+	be.snapshotLock.Lock()
+	open := make([]*Snapshot, 0, len(be.snapshots))
+	for s := range be.snapshots {
+		open = append(open, s)
+	}
+	be.snapshotLock.Unlock()
+	for _, s := range open {
+		if s.watchdog != nil {
+			s.watchdog.Stop()
+		}
+		s.release(ErrBackendClosed)
+	}
+}
+
+// use locks the snapshot for a read, the error tells a released one
+func (s *Snapshot) use() error {
+	s.lock.RLock()
+	if err := s.err; err != nil {
+		s.lock.RUnlock()
+		return err
+	}
+	return nil
+}
+
+// Get returns the value of key in the snapshot, nil if absent
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if err := s.use(); err != nil {
+		return nil, err
+	}
+	defer s.lock.RUnlock()
+	key = s.be.normalizeKey(key)
+	if s.bucket == nil {
+		return nil, nil
+	}
+	iv, err := s.be.liveValue(s.bucket, key)
+	if err != nil || iv == nil {
+		return nil, err
+	}
+	if iv.kind != ValueScalar {
+		return nil, ErrWrongType
+	}
+	return cloneValue(iv.value), nil
+}
+
+// Range is the backend Range on the snapshot
+func (s *Snapshot) Range(key []byte, limit int, from []byte, reverse bool) (map[string][]byte, error) {
+	if err := s.use(); err != nil {
+		return nil, err
+	}
+	defer s.lock.RUnlock()
+	limit, _ = s.be.rangeLimit(limit)
+	ret, _, err := s.be.rangeIn(s.bucket, key, limit, from, reverse, nil)
+	return ret, err
+}
+
+// TxID returns the id of the bolt transaction the snapshot reads from, released or not
+func (s *Snapshot) TxID() int {
+	return s.txid
+}
+
+// Release ends the snapshot, releasing twice is a no-op
+func (s *Snapshot) Release() {
+	if s.watchdog != nil {
+		s.watchdog.Stop()
+	}
+	s.release(bolt.ErrTxClosed)
+}
+
+// release closes the transaction unless done already, false then. Later reads fail with err
+func (s *Snapshot) release(err error) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return false
+	}
+	s.err = err
+	s.tx.Rollback()
+	s.be.snapshotLock.Lock()
+	delete(s.be.snapshots, s)
+	s.be.snapshotLock.Unlock()
+	return true
+}
+
+// expire releases the snapshot for the watchdog when it exceeds MaxSnapshotAge
+func (s *Snapshot) expire() {
+	if s.release(ErrSnapshotExpired) {
+		log.Warning("Snapshot of bucket %s held for more than %s, released", s.be.bucketName, s.be.opts.MaxSnapshotAge)
+	}
+}
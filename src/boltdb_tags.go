@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+Tags group keys for invalidation. For every data bucket the metadata bucket holds
+two nested buckets, tag to keys and key to tags, so InvalidateTag finds the keys
+of a tag and Delete finds the tags of a key. Entries are the first element length
+prefixed (uvarint) followed by both elements, keys can hold any byte
+*/
+const (
+	tagsBucketPrefix    = "tags:"
+	keyTagsBucketPrefix = "keytags:"
+)
+
+// pairKey builds an index entry, entries sharing first are contiguous
+func pairKey(first []byte, second []byte) []byte {
+	k := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(first)+len(second))
+	k = k[:binary.PutUvarint(k, uint64(len(first)))]
+	k = append(k, first...)
+	return append(k, second...)
+}
+
+// pairPrefix is the prefix shared by the entries of first
+func pairPrefix(first []byte) []byte {
+	return pairKey(first, nil)
+}
+
+// tagIndexes returns the tag to keys and key to tags buckets of bucketName
+func tagIndexes(tx *bolt.Tx, bucketName string, create bool) (*bolt.Bucket, *bolt.Bucket, error) {
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		if !create {
+			return nil, nil, nil
+		}
+		var err error
+		if meta, err = tx.CreateBucket([]byte(metaBucketName)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !create {
+		return meta.Bucket([]byte(tagsBucketPrefix + bucketName)), meta.Bucket([]byte(keyTagsBucketPrefix + bucketName)), nil
+	}
+	tags, err := meta.CreateBucketIfNotExists([]byte(tagsBucketPrefix + bucketName))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyTags, err := meta.CreateBucketIfNotExists([]byte(keyTagsBucketPrefix + bucketName))
+	if err != nil {
+		return nil, nil, err
+	}
+	return tags, keyTags, nil
+}
+
+// untagKey removes every tag membership of key
+func untagKey(tx *bolt.Tx, bucketName string, key []byte) error {
+	tags, keyTags, err := tagIndexes(tx, bucketName, false)
+	if err != nil || tags == nil || keyTags == nil {
+		return err
+	}
+	prefix := pairPrefix(key)
+	var doomed [][]byte
+	c := keyTags.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		doomed = append(doomed, append([]byte(nil), k...))
+	}
+	for _, k := range doomed {
+		tag := k[len(prefix):]
+		if err := tags.Delete(pairKey(tag, key)); err != nil {
+			return err
+		}
+		if err := keyTags.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropTags deletes the tag indexes of bucketName
+func dropTags(tx *bolt.Tx, bucketName string) error {
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		return nil
+	}
+	for _, name := range []string{tagsBucketPrefix + bucketName, keyTagsBucketPrefix + bucketName} {
+		if meta.Bucket([]byte(name)) == nil {
+			continue
+		}
+		if err := meta.DeleteBucket([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+SetWithTags sets key and makes it a member of tags, replacing the tags it had.
+Value and memberships are written in the same transaction
+*/
+func (be *KVBoltDBBackend) SetWithTags(key []byte, value []byte, tags []string) error {
+	key = be.normalizeKey(key)
+	_, err := be.putEx(&InternalValue{key: key, value: value}, false, true, func(tx *bolt.Tx) error {
+		if err := untagKey(tx, be.bucketName, key); err != nil {
+			return err
+		}
+		tagIndex, keyTags, err := tagIndexes(tx, be.bucketName, true)
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			if err := tagIndex.Put(pairKey([]byte(tag), key), nil); err != nil {
+				return err
+			}
+			if err := keyTags.Put(pairKey(key, []byte(tag)), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+/*
+InvalidateTag deletes every key of the current bucket tagged with tag, in a
+single transaction. Returns the number of keys deleted
+*/
+func (be *KVBoltDBBackend) InvalidateTag(tag string) (int, error) {
+	if err := be.allowOp(OpInvalidateTag); err != nil {
+		return 0, err
+	}
+	if err := be.enterWrite(); err != nil {
+		return 0, err
+	}
+	defer be.writes.leave()
+	if !be.allowWrite() {
+		return 0, ErrRateLimited
+	}
+	if err := be.flushPending(); err != nil {
+		return 0, err
+	}
+	if err := be.rlock(); err != nil {
+		return 0, err
+	}
+	defer be.dbMutex.RUnlock()
+
+	var removed [][]byte
+	deleted := 0
+	err := be.updateOn(be.db, func(tx *bolt.Tx) error {
+		removed, deleted = nil, 0
+		tags, _, err := tagIndexes(tx, be.bucketName, false)
+		if err != nil || tags == nil {
+			return err
+		}
+		prefix := pairPrefix([]byte(tag))
+		var keys [][]byte
+		c := tags.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k[len(prefix):]...))
+		}
+		bucket := tx.Bucket([]byte(be.bucketName))
+		now := time.Now()
+		for _, key := range keys {
+			var raw []byte
+			if bucket != nil {
+				raw = bucket.Get(key)
+			}
+			if raw == nil {
+				// deleted by a path that doesn't clean tags, drop the stale membership
+				if err := untagKey(tx, be.bucketName, key); err != nil {
+					return err
+				}
+				continue
+			}
+			iv, err := decodeValue(key, raw)
+			if err != nil {
+				return err
+			}
+			if !iv.tombstone && !iv.expired(now) {
+				deleted++
+			}
+			if err := be.deleteKey(tx, key); err != nil {
+				return err
+			}
+			removed = append(removed, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range removed {
+		be.keyCache[be.bucketName].Remove(key)
+	}
+	return deleted, nil
+}
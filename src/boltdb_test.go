@@ -1,6 +1,28 @@
 package main
 
-import "testing"
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	logging "github.com/op/go-logging"
+)
 
 func TestBoltDBDelete(t *testing.T) {
 	key := []byte("beano")
@@ -97,6 +119,62 @@ func TestBoltDBIncr(t *testing.T) {
 	vboltdb.Delete(key, false)
 }
 
+func TestBoltDBIncr64(t *testing.T) {
+	key := []byte("beano64")
+	vboltdb.Delete(key, false)
+
+	vboltdb.Set(key, []byte("4294967295"))
+	if v, err := vboltdb.Incr(key, 1); err != nil {
+		t.Error(err)
+	} else if v != 4294967296 {
+		t.Error(errUnexpected(v))
+	}
+	if v, err := vboltdb.Incr(key, 3000000000); err != nil || v != 7294967296 {
+		t.Error(errUnexpected(v), err)
+	}
+	if v, err := vboltdb.Get(key); err != nil || string(v) != "7294967296" {
+		t.Error(errUnexpected(string(v)), err)
+	}
+
+	// incr wraps at 2^64, decr stops at 0
+	vboltdb.Set(key, []byte("18446744073709551615"))
+	if v, err := vboltdb.Incr(key, 2); err != nil || v != 1 {
+		t.Error(errUnexpected(v), err)
+	}
+	if v, err := vboltdb.Decr(key, 5); err != nil || v != 0 {
+		t.Error(errUnexpected(v), err)
+	}
+	vboltdb.Delete(key, false)
+}
+
+func TestBoltDBIncrNotNumeric(t *testing.T) {
+	key := []byte("beanonumeric")
+	vboltdb.Delete(key, false)
+
+	// surrounding whitespace is tolerated and dropped on write
+	vboltdb.Set(key, []byte(" 41\r\n"))
+	if v, err := vboltdb.Incr(key, 1); err != nil || v != 42 {
+		t.Error(errUnexpected(v), err)
+	}
+	if v, err := vboltdb.Get(key); err != nil || string(v) != "42" {
+		t.Error(errUnexpected(string(v)), err)
+	}
+
+	for _, value := range []string{"eric", "4 2", "-1", "+1", "", "0x10", "18446744073709551616"} {
+		vboltdb.Set(key, []byte(value))
+		if v, err := vboltdb.Incr(key, 1); err != ErrNotNumeric {
+			t.Error(errUnexpected(value), v, err)
+		}
+		if _, err := vboltdb.Decr(key, 1); err != ErrNotNumeric {
+			t.Error(errUnexpected(value), err)
+		}
+		if v, _ := vboltdb.Get(key); string(v) != value {
+			t.Error(errUnexpected(string(v)))
+		}
+	}
+	vboltdb.Delete(key, false)
+}
+
 func TestBoltDBDecr(t *testing.T) {
 	key := []byte("beano")
 	value := []byte("10")
@@ -108,7 +186,7 @@ func TestBoltDBDecr(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	} else if v != 9 {
-		t.Error(errUnexpected(string(v)))
+		t.Error(errUnexpected(v))
 	}
 
 	if v, err := vboltdb.Get(key); err != nil {
@@ -136,3 +214,4867 @@ func TestBoltDBFlush(t *testing.T) {
 		t.Error(errUnexpected(v))
 	}
 }
+
+func TestBoltDBRange(t *testing.T) {
+	vboltdb.Flush()
+	for _, k := range []string{"a1", "b1", "b2", "b3", "c1"} {
+		vboltdb.Set([]byte(k), []byte(k))
+	}
+	if v, err := vboltdb.Range([]byte("b"), -1, nil, false); err != nil {
+		t.Error(err)
+	} else if len(v) != 3 || string(v["b2"]) != "b2" {
+		t.Error(errUnexpected(v))
+	}
+	if v, err := vboltdb.Range([]byte("b"), 2, nil, true); err != nil {
+		t.Error(err)
+	} else if _, ok := v["b3"]; !ok || len(v) != 2 {
+		t.Error(errUnexpected(v))
+	}
+	if v, err := vboltdb.Range([]byte("b"), -1, []byte("b1"), false); err != nil {
+		t.Error(err)
+	} else if _, ok := v["b1"]; ok || len(v) != 2 {
+		t.Error(errUnexpected(v))
+	}
+	vboltdb.Flush()
+}
+
+func TestBoltDBRangePage(t *testing.T) {
+	vboltdb.Flush()
+	for i := 0; i < 10; i++ {
+		k := fmt.Sprintf("page%02d", i)
+		vboltdb.Set([]byte(k), []byte(k))
+	}
+
+	seen := make(map[string]bool)
+	token := ""
+	for pages := 0; pages < 10; pages++ {
+		v, next, err := vboltdb.RangePage([]byte("page"), 3, token, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := range v {
+			if seen[k] {
+				t.Error(errUnexpected(k))
+			}
+			seen[k] = true
+		}
+		if next == "" {
+			break
+		}
+		// keys inserted before the cursor must not shift the next page
+		vboltdb.Set([]byte("page"), []byte("head"))
+		token = next
+	}
+	if len(seen) != 10 {
+		t.Error(errUnexpected(seen))
+	}
+
+	if _, _, err := vboltdb.RangePage([]byte("page"), 3, EncodePageToken("other", []byte("page01")), false); err == nil {
+		t.Error("expected error for a token from another bucket")
+	}
+	vboltdb.Flush()
+}
+
+func TestBoltDBFlushExcept(t *testing.T) {
+	vboltdb.Flush()
+	for _, k := range []string{"config", "boot", "cache1", "cache2", "cache3"} {
+		vboltdb.Set([]byte(k), []byte(k))
+	}
+
+	n, err := vboltdb.FlushExcept([][]byte{[]byte("config"), []byte("boot")})
+	if err != nil {
+		t.Error(err)
+	} else if n != 3 {
+		t.Error(errUnexpected(n))
+	}
+
+	for _, k := range []string{"config", "boot"} {
+		if v, err := vboltdb.Get([]byte(k)); err != nil {
+			t.Error(err)
+		} else if string(v) != k {
+			t.Error(errUnexpected(v))
+		}
+	}
+	if v, err := vboltdb.Get([]byte("cache1")); err != nil {
+		t.Error(err)
+	} else if v != nil {
+		t.Error(errUnexpected(v))
+	}
+	vboltdb.Flush()
+}
+
+func TestBoltDBFlushFailure(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("beano"), []byte("clapton"))
+
+	// a failed flush returns its error and leaves the bloom filter alone
+	be.main.Close()
+	if err := be.Flush(); err == nil {
+		t.Error("Flush of a closed database succeeded")
+	}
+	if !be.keyCache["memcached"].Test([]byte("beano")) {
+		t.Error("filter reset by a failed flush")
+	}
+}
+
+func TestBoltDBFlushExceptCleanup(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	var records []Record
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{
+		MaxKeysPerBucket: 1000,
+		Tombstones:       true,
+		ManualReaper:     true,
+		KeyNormalizer:    TrimKeySpace,
+		Replicate:        func(rec Record) { records = append(records, rec) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("config"), []byte("v"))
+	be.SetAdd([]byte("set"), []byte("m"))
+	be.SetWithTags([]byte("tagged"), []byte("v"), []string{"t"})
+	be.putEx(&InternalValue{key: []byte("expired"), value: []byte("v"), expiration: -1}, false, true, nil)
+	be.Delete([]byte("deleted"), false)
+	records = nil
+
+	// keep is normalized, expired keys and tombstones aren't counted
+	n, err := be.FlushExcept([][]byte{[]byte(" config ")})
+	if err != nil || n != 2 {
+		t.Fatal(errUnexpected(n), err)
+	}
+	if v, _ := be.Get([]byte("config")); string(v) != "v" {
+		t.Error(errUnexpected(string(v)))
+	}
+	if len(records) != 2 || records[0].Op != RecordDelete || records[1].Op != RecordDelete {
+		t.Error(errUnexpected(records))
+	}
+	be.db.View(func(tx *bolt.Tx) error {
+		if membersBucket(tx, setsBucketPrefix, "memcached", []byte("set")) != nil {
+			t.Error("members of a flushed set left")
+		}
+		if tags, _, _ := tagIndexes(tx, "memcached", false); tags != nil {
+			if k, _ := tags.Cursor().First(); k != nil {
+				t.Error("tag of a flushed key left")
+			}
+		}
+		return nil
+	})
+	if be.keyCache["memcached"].Test([]byte("set")) || !be.keyCache["memcached"].Test([]byte("expired")) {
+		t.Error("filter not rebuilt for the survivors")
+	}
+}
+
+func tempBoltDBFile(t testing.TB) string {
+	f, err := ioutil.TempFile("", "beano_bolt_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return f.Name()
+}
+
+func removeBoltDBFiles(filename string) {
+	os.Remove(filename)
+	os.Remove(filename + expirationDBSuffix)
+}
+
+func TestBoltDBConfigureBucket(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = be.ConfigureBucket("small", BucketConfig{MaxKeys: 10, DefaultTTL: 60, MaxValueSize: 4})
+	if err != nil {
+		t.Error(err)
+	}
+	be.Close()
+
+	be, err = NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	if cfg := be.BucketConfigFor("small"); cfg.MaxKeys != 10 || cfg.DefaultTTL != 60 || cfg.MaxValueSize != 4 {
+		t.Error(errUnexpected(cfg))
+	}
+	if cfg := be.BucketConfigFor("memcached"); cfg.MaxKeys != 1000 || cfg.MaxValueSize != 0 {
+		t.Error(errUnexpected(cfg))
+	}
+
+	if err := be.Set([]byte("big"), []byte("clapton")); err != nil {
+		t.Error(err)
+	}
+	be.SwitchBucket("small")
+	if err := be.Set([]byte("big"), []byte("clapton")); err == nil {
+		t.Error("expected value cap error")
+	}
+	if err := be.Set([]byte("tiny"), []byte("eric")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBoltDBReopen(t *testing.T) {
+	restored := tempBoltDBFile(t)
+	defer removeBoltDBFiles(restored)
+	be, err := NewKVBoltDBBackend(restored, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("restored"), []byte("clapton"))
+	be.Close()
+
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err = NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("current"), []byte("mayall"))
+
+	if err := be.Reopen(restored); err != nil {
+		t.Fatal(err)
+	}
+	if be.GetDbPath() != restored {
+		t.Error(errUnexpected(be.GetDbPath()))
+	}
+	if v, err := be.Get([]byte("restored")); err != nil {
+		t.Error(err)
+	} else if string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+	if v, err := be.Get([]byte("current")); err != nil {
+		t.Error(err)
+	} else if v != nil {
+		t.Error(errUnexpected(v))
+	}
+
+	if err := be.Reopen("/nonexistent/beano/bolt.db"); err == nil {
+		t.Error("expected error reopening a missing path")
+	}
+	if v, err := be.Get([]byte("restored")); err != nil {
+		t.Error(err)
+	} else if string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+}
+
+func TestBoltDBTombstones(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+
+	var records []Record
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{
+		MaxKeysPerBucket: 1000,
+		Tombstones:       true,
+		TombstoneGrace:   time.Minute,
+		Replicate:        func(r Record) { records = append(records, r) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	key := []byte("beano")
+	be.Set(key, []byte("clapton"))
+	if deleted, err := be.Delete(key, true); err != nil || !deleted {
+		t.Error(errUnexpected(deleted), err)
+	}
+	if v, err := be.Get(key); err != nil {
+		t.Error(err)
+	} else if v != nil {
+		t.Error(errUnexpected(v))
+	}
+	if deleted, _ := be.Delete(key, true); deleted {
+		t.Error("tombstone deleted twice")
+	}
+	if len(records) != 2 || records[1].Op != RecordDelete || string(records[1].Key) != "beano" {
+		t.Error(errUnexpected(records))
+	}
+
+	if n, err := be.reap(time.Now()); err != nil || n != 0 {
+		t.Error(errUnexpected(n), err)
+	}
+	if n, err := be.reap(time.Now().Add(2 * time.Minute)); err != nil || n != 1 {
+		t.Error(errUnexpected(n), err)
+	}
+	if err := be.Add(key, []byte("eric")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBoltDBAllBucketStats(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	if st, err := be.AllBucketStats(); err != nil {
+		t.Error(err)
+	} else if st == nil || len(st) != 0 {
+		t.Error(errUnexpected(st))
+	}
+
+	be.Set([]byte("a"), []byte("1"))
+	be.Set([]byte("b"), []byte("2"))
+	be.SwitchBucket("other")
+	be.Set([]byte("c"), []byte("3"))
+	be.ConfigureBucket("other", BucketConfig{MaxKeys: 100})
+
+	st, err := be.AllBucketStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st) != 2 || st["memcached"].Items != 2 || st["other"].Items != 1 {
+		t.Error(errUnexpected(st))
+	}
+	if st["other"].Bytes != int64(1+headerSize+1) {
+		t.Error(errUnexpected(st["other"]))
+	}
+}
+
+func TestBoltDBEncryption(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	if _, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, EncryptionKey: []byte("short")}); err == nil {
+		t.Error("expected error for a short key")
+	}
+
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, EncryptionKey: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("beano")
+	be.Set(key, []byte("clapton"))
+	if v, err := be.Get(key); err != nil {
+		t.Error(err)
+	} else if string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+	if v, err := be.Range([]byte("bea"), -1, nil, false); err != nil {
+		t.Error(err)
+	} else if string(v["beano"]) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+	be.db.View(func(tx *bolt.Tx) error {
+		if raw := tx.Bucket([]byte("memcached")).Get(key); bytes.Contains(raw, []byte("clapton")) {
+			t.Error(errUnexpected(raw))
+		}
+		return nil
+	})
+	be.Close()
+
+	other := []byte("fedcba9876543210fedcba9876543210")
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, EncryptionKey: other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if _, err := be.Get(key); err != ErrDecrypt {
+		t.Error(errUnexpected(err))
+	}
+}
+
+func TestBoltDBGetReturnsCopy(t *testing.T) {
+	key := []byte("beano")
+	vboltdb.Set(key, []byte("clapton"))
+
+	v, err := vboltdb.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(v, "XXXXXXX")
+	if v, err := vboltdb.Get(key); err != nil {
+		t.Error(err)
+	} else if string(v) != "clapton" {
+		t.Error(errUnexpected(string(v)))
+	}
+
+	var seen string
+	err = vboltdb.GetUnsafe(key, func(v []byte) error {
+		seen = string(v)
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	} else if seen != "clapton" {
+		t.Error(errUnexpected(seen))
+	}
+	vboltdb.Delete(key, false)
+}
+
+func TestBoltDBValuesSurviveRemap(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	stable := bytes.Repeat([]byte("clapton"), 1000)
+	be.Set([]byte("stable"), stable)
+	be.Set([]byte("empty"), []byte{})
+	got, err := be.Get([]byte("stable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranged, err := be.Range([]byte(""), -1, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := ranged["empty"]; !ok || v == nil {
+		t.Error(errUnexpected(ranged["empty"]))
+	}
+
+	// grow the file well past the initial mmap so bolt remaps it
+	filler := bytes.Repeat([]byte("x"), 64*1024)
+	for i := 0; i < 200; i++ {
+		be.Set([]byte(fmt.Sprintf("filler%03d", i)), filler)
+	}
+	be.Set([]byte("stable"), []byte("overwritten"))
+
+	if !bytes.Equal(got, stable) {
+		t.Error("Get result changed after remap")
+	}
+	if !bytes.Equal(ranged["stable"], stable) {
+		t.Error("Range result changed after remap")
+	}
+}
+
+func TestBoltDBScanErrors(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("good"), []byte("clapton"))
+	// a row from a future header version can't be decoded
+	be.db.Update(func(tx *bolt.Tx) error {
+		bad := make([]byte, headerSize)
+		bad[0], bad[1] = headerMagic, headerVersion+1
+		return tx.Bucket([]byte("memcached")).Put([]byte("bad"), bad)
+	})
+	be.Close()
+
+	if _, err := NewKVBoltDBBackend(filename, "memcached", 1000); err == nil {
+		t.Error("expected scan error")
+	}
+
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, PessimisticBloom: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if !be.keyCache["memcached"].Pessimistic() {
+		t.Error("expected a pessimistic bloom filter")
+	}
+	if v, err := be.Get([]byte("good")); err != nil {
+		t.Error(err)
+	} else if string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+	if v, err := be.Get([]byte("missing")); err != nil || v != nil {
+		t.Error(errUnexpected(v), err)
+	}
+	if err := be.Replace([]byte("missing"), []byte("eric")); err == nil {
+		t.Error("replace of a missing key succeeded")
+	}
+}
+
+func TestBoltDBWriteRateLimit(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, WriteRateLimit: 10, WriteRateBurst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := be.Set([]byte("beano"), []byte("clapton")); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := be.Set([]byte("beano"), []byte("clapton")); err != ErrRateLimited {
+		t.Error(errUnexpected(err))
+	}
+	if _, err := be.Delete([]byte("beano"), false); err != ErrRateLimited {
+		t.Error(errUnexpected(err))
+	}
+	if v, err := be.Get([]byte("beano")); err != nil || string(v) != "clapton" {
+		t.Error("reads must not be rate limited", err)
+	}
+
+	be.opts.WriteRateTimeout = time.Second
+	start := time.Now()
+	if err := be.Set([]byte("beano"), []byte("eric")); err != nil {
+		t.Error(err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("expected the write to wait for a token")
+	}
+}
+
+func TestBoltDBReplaceEx(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	key := []byte("beano")
+	if stored, err := be.ReplaceEx(key, []byte("clapton"), 7, 100); err != nil || stored {
+		t.Error(errUnexpected(stored), err)
+	}
+	be.Set(key, []byte("clapton"))
+	if stored, err := be.ReplaceEx(key, []byte("eric"), 7, 100); err != nil || !stored {
+		t.Error(errUnexpected(stored), err)
+	}
+	be.db.View(func(tx *bolt.Tx) error {
+		iv, _ := decodeValue(key, tx.Bucket([]byte("memcached")).Get(key))
+		if iv.flags != 7 || string(iv.value) != "eric" || iv.expiration < int(time.Now().Unix())+99 {
+			t.Error(errUnexpected(iv))
+		}
+		return nil
+	})
+
+	if stored, err := be.ReplaceEx(key, []byte("gone"), 0, -1); err != nil || !stored {
+		t.Error(errUnexpected(stored), err)
+	}
+	if v, err := be.Get(key); err != nil || v != nil {
+		t.Error(errUnexpected(v), err)
+	}
+	if stored, _ := be.ReplaceEx(key, []byte("again"), 0, 0); stored {
+		t.Error("replaced an expired key")
+	}
+	if n, err := be.reapExpired(time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Error(errUnexpected(n), err)
+	}
+	// the stale index entry from the first ReplaceEx must not delete anything
+	be.Set(key, []byte("fresh"))
+	if n, err := be.reapExpired(time.Now().Add(200 * time.Second)); err != nil || n != 0 {
+		t.Error(errUnexpected(n), err)
+	}
+	if v, _ := be.Get(key); string(v) != "fresh" {
+		t.Error(errUnexpected(v))
+	}
+}
+
+func TestBoltDBDefaultTTL(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	be.ConfigureBucket("memcached", BucketConfig{DefaultTTL: 60})
+	be.Set([]byte("beano"), []byte("clapton"))
+	if n, err := be.reapExpired(time.Now().Add(61 * time.Second)); err != nil || n != 1 {
+		t.Error(errUnexpected(n), err)
+	}
+}
+
+func TestBoltDBCompactBucket(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	for i := 0; i < 100; i++ {
+		be.Set([]byte(fmt.Sprintf("churn%03d", i)), bytes.Repeat([]byte("x"), 1024))
+	}
+	for i := 0; i < 90; i++ {
+		be.Delete([]byte(fmt.Sprintf("churn%03d", i)), false)
+	}
+	be.ReplaceEx([]byte("churn099"), []byte("expired"), 0, -1)
+	be.Set([]byte("beano"), []byte("clapton"))
+
+	if err := be.CompactBucket("memcached"); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := be.AllBucketStats(); st["memcached"].Items != 10 {
+		t.Error(errUnexpected(st))
+	}
+	if v, err := be.Get([]byte("beano")); err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(v), err)
+	}
+	if _, err := be.Get([]byte("churn099")); err != nil {
+		t.Error(err)
+	}
+	// CAS sequence survives the rewrite
+	be.Set([]byte("after"), []byte("compact"))
+	be.db.View(func(tx *bolt.Tx) error {
+		iv, _ := decodeValue(nil, tx.Bucket([]byte("memcached")).Get([]byte("after")))
+		if iv.cas <= 100 {
+			t.Error(errUnexpected(iv.cas))
+		}
+		return nil
+	})
+	if err := be.CompactBucket("missing"); err == nil {
+		t.Error("expected error compacting a missing bucket")
+	}
+}
+
+func TestBoltDBReady(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !be.Ready() {
+		t.Error("backend not ready after open")
+	}
+	if err := be.Reopen(filename); err != nil || !be.Ready() {
+		t.Error("backend not ready after reopen", err)
+	}
+	be.Close()
+	if be.Ready() {
+		t.Error("backend ready after close")
+	}
+}
+
+func TestBoltDBRangeFlags(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	for i := 0; i < 6; i++ {
+		key := []byte(fmt.Sprintf("typed%d", i))
+		be.Set(key, []byte("clapton"))
+		if i%2 == 0 {
+			be.ReplaceEx(key, []byte("tagged"), 7, 0)
+		}
+	}
+	tagged := func(flags int32) bool { return flags == 7 }
+
+	ret, err := be.RangeFlags([]byte("typed"), 0, nil, false, tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 3 || string(ret["typed2"]) != "tagged" || ret["typed1"] != nil {
+		t.Error(errUnexpected(ret))
+	}
+	if ret, _ := be.RangeFlags([]byte("typed"), 2, nil, false, tagged); len(ret) != 2 {
+		t.Error(errUnexpected(ret))
+	}
+	if ret, _ := be.RangeFlags([]byte("typed"), 0, nil, false, nil); len(ret) != 6 {
+		t.Error(errUnexpected(ret))
+	}
+}
+
+func TestBoltDBCoalesce(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, CoalesceInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := []byte("counter")
+	for i := 0; i <= 100; i++ {
+		if err := be.Set(key, []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := be.Get(key); err != nil || string(v) != "100" {
+		t.Error(errUnexpected(string(v)), err)
+	}
+	be.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("memcached")) != nil {
+			t.Error("buffered writes reached the database before the flush")
+		}
+		return nil
+	})
+
+	// other operations see the buffered value
+	if v, err := be.Incr(key, 1); err != nil || v != 101 {
+		t.Error(errUnexpected(v), err)
+	}
+
+	be.Set([]byte("pending"), []byte("clapton"))
+	be.Close()
+	be, err = NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if v, err := be.Get([]byte("pending")); err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(string(v)), err)
+	}
+	if v, err := be.Get(key); err != nil || string(v) != "101" {
+		t.Error(errUnexpected(string(v)), err)
+	}
+}
+
+func TestBoltDBCoalesceConcurrentFlush(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, CoalesceInterval: time.Hour, NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	// a flush racing the one of a Delete must not write the buffered Set after it
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("flush:%d", i))
+		be.Set(key, []byte("mayall"))
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := be.flushPending(); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		if _, err := be.Delete(key, false); err != nil {
+			t.Error(err)
+		}
+		wg.Wait()
+		if v, err := be.Get(key); err != nil || v != nil {
+			t.Fatalf("deleted key %s read %q - %v", key, v, err)
+		}
+	}
+}
+
+func TestBoltDBVerbosity(t *testing.T) {
+	defer logging.SetLevel(logging.DEBUG, "beano")
+	if vboltdb.Version() != buildVersion {
+		t.Error(errUnexpected(vboltdb.Version()))
+	}
+	vboltdb.SetVerbosity(0)
+	if logging.GetLevel("beano") != logging.WARNING {
+		t.Error(errUnexpected(logging.GetLevel("beano")))
+	}
+	vboltdb.SetVerbosity(3)
+	if logging.GetLevel("beano") != logging.DEBUG {
+		t.Error(errUnexpected(logging.GetLevel("beano")))
+	}
+}
+
+func TestBoltDBCheck(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("beano"), []byte("clapton"))
+	be.ReplaceEx([]byte("beano"), []byte("clapton"), 0, 60)
+	if errs := be.Check(); len(errs) != 0 {
+		t.Error(errUnexpected(errs))
+	}
+
+	// a row with an unknown header version
+	be.db.Update(func(tx *bolt.Tx) error {
+		raw := encodeValue(&InternalValue{value: []byte("clapton")})
+		raw[1] = 99
+		return tx.Bucket([]byte("memcached")).Put([]byte("corrupt"), raw)
+	})
+	if errs := be.Check(); len(errs) != 1 {
+		t.Error(errUnexpected(errs))
+	}
+	be.Close()
+
+	_, err = NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, CheckOnOpen: true, PessimisticBloom: true})
+	if err == nil {
+		t.Error("expected the check on open to fail")
+	}
+}
+
+func TestBoltDBBinaryKeys(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	key := []byte{0x00, 'b', 0xff, 0x00}
+	other := []byte{0x00, 'b', 0xff, 0x01}
+	be.Set(key, []byte{0xff, 0x00})
+	be.Set(other, []byte("clapton"))
+
+	if v, err := be.Get(key); err != nil || !bytes.Equal(v, []byte{0xff, 0x00}) {
+		t.Error(errUnexpected(v), err)
+	}
+	if !be.keyCache["memcached"].Test(key) {
+		t.Error("binary key missing from the bloom filter")
+	}
+	if ret, err := be.Range([]byte{0x00, 'b', 0xff}, 0, nil, false); err != nil || len(ret) != 2 || ret[string(other)] == nil {
+		t.Error(errUnexpected(ret), err)
+	}
+	if err := be.Add(key, []byte("clapton")); err == nil || !bytes.Contains([]byte(err.Error()), []byte(`"\x00b\xff\x00"`)) {
+		t.Error(errUnexpected(err))
+	}
+	if deleted, err := be.Delete(key, true); err != nil || !deleted {
+		t.Error(errUnexpected(deleted), err)
+	}
+	if v, err := be.Get(key); err != nil || v != nil {
+		t.Error(errUnexpected(v), err)
+	}
+	if v, err := be.Get(other); err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(v), err)
+	}
+}
+
+func TestBoltDBMaxBuckets(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, MaxBuckets: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("beano"), []byte("clapton"))
+	if err := be.SwitchBucket("second"); err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("beano"), []byte("clapton"))
+	be.Close()
+
+	// on disk buckets count even if never switched to after a restart
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, MaxBuckets: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if err := be.SwitchBucket("third"); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.SwitchBucket("fourth"); err != ErrTooManyBuckets {
+		t.Error(errUnexpected(err))
+	}
+	if err := be.SwitchBucket("second"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBoltDBGetOrSet(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	var loads int32
+	release := make(chan struct{})
+	loader := func() ([]byte, int, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return []byte("clapton"), 60, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := be.GetOrSet([]byte("beano"), loader); err != nil || string(v) != "clapton" {
+				t.Error(errUnexpected(string(v)), err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if loads != 1 {
+		t.Error(errUnexpected(loads))
+	}
+	if v, err := be.Get([]byte("beano")); err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(string(v)), err)
+	}
+
+	failing := func() ([]byte, int, error) { return nil, 0, fmt.Errorf("loader failed") }
+	if v, err := be.GetOrSet([]byte("missing"), failing); err == nil || v != nil {
+		t.Error(errUnexpected(v), err)
+	}
+	if v, _ := be.Get([]byte("missing")); v != nil {
+		t.Error(errUnexpected(v))
+	}
+}
+
+func TestBoltDBTags(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	be.SetWithTags([]byte("user42:profile"), []byte("clapton"), []string{"user42"})
+	be.SetWithTags([]byte("user42:cart"), []byte("clapton"), []string{"user42", "carts"})
+	be.SetWithTags([]byte("user7:cart"), []byte("clapton"), []string{"user7", "carts"})
+	be.Set([]byte("untagged"), []byte("clapton"))
+
+	// deleting a key drops its memberships
+	be.Delete([]byte("user7:cart"), false)
+	be.Set([]byte("user7:cart"), []byte("clapton"))
+	if n, err := be.InvalidateTag("user7"); err != nil || n != 0 {
+		t.Error(errUnexpected(n), err)
+	}
+
+	if n, err := be.InvalidateTag("user42"); err != nil || n != 2 {
+		t.Error(errUnexpected(n), err)
+	}
+	for _, k := range []string{"user42:profile", "user42:cart"} {
+		if v, _ := be.Get([]byte(k)); v != nil {
+			t.Error(errUnexpected(k))
+		}
+	}
+	for _, k := range []string{"user7:cart", "untagged"} {
+		if v, _ := be.Get([]byte(k)); string(v) != "clapton" {
+			t.Error(errUnexpected(k))
+		}
+	}
+	if n, err := be.InvalidateTag("carts"); err != nil || n != 0 {
+		t.Error(errUnexpected(n), err)
+	}
+	if st, _ := be.AllBucketStats(); st["memcached"].Items != 2 {
+		t.Error(errUnexpected(st))
+	}
+}
+
+func TestBoltDBApplyReplicationRecord(t *testing.T) {
+	var records []Record
+	primaryFile := tempBoltDBFile(t)
+	defer removeBoltDBFiles(primaryFile)
+	primary, err := NewKVBoltDBBackendWithOptions(primaryFile, "memcached", BackendOptions{
+		MaxKeysPerBucket: 1000,
+		Replicate:        func(r Record) { records = append(records, r) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	primary.Set([]byte("beano"), []byte("v1"))
+	primary.Set([]byte("beano"), []byte("v2"))
+	primary.Set([]byte("gone"), []byte("v1"))
+	primary.Delete([]byte("gone"), false)
+
+	replicaFile := tempBoltDBFile(t)
+	defer removeBoltDBFiles(replicaFile)
+	replica, err := NewKVBoltDBBackend(replicaFile, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	applied, skipped := replicationApplied.Count(), replicationSkipped.Count()
+	// newest first, then everything again: only the first two apply
+	for _, i := range []int{1, 3, 0, 2, 1, 3} {
+		if err := replica.ApplyReplicationRecord(records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := replicationApplied.Count() - applied; n != 2 {
+		t.Error(errUnexpected(n))
+	}
+	if n := replicationSkipped.Count() - skipped; n != 4 {
+		t.Error(errUnexpected(n))
+	}
+	if v, err := replica.Get([]byte("beano")); err != nil || string(v) != "v2" {
+		t.Error(errUnexpected(string(v)), err)
+	}
+	if v, err := replica.Get([]byte("gone")); err != nil || v != nil {
+		t.Error(errUnexpected(v), err)
+	}
+	if err := replica.ApplyReplicationRecord(Record{Op: "rename", Bucket: "memcached"}); err == nil {
+		t.Error("expected error on unknown op")
+	}
+}
+
+func TestBoltDBUpdate(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	// a counter in the last byte of a fixed layout value
+	bump := func(old []byte) ([]byte, error) {
+		if old == nil {
+			return []byte("hits:\x00"), nil
+		}
+		v := append([]byte(nil), old...)
+		v[len(v)-1]++
+		return v, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := be.Update([]byte("beano"), bump); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if v, err := be.Get([]byte("beano")); err != nil || !bytes.Equal(v, []byte("hits:\x13")) {
+		t.Error(errUnexpected(v), err)
+	}
+
+	be.ReplaceEx([]byte("beano"), []byte("clapton"), 7, 0)
+	abort := fmt.Errorf("abort")
+	if err := be.Update([]byte("beano"), func(old []byte) ([]byte, error) { return nil, abort }); err != abort {
+		t.Error(errUnexpected(err))
+	}
+	be.Update([]byte("beano"), func(old []byte) ([]byte, error) { return append(old, '!'), nil })
+	if ret, _ := be.RangeFlags([]byte("beano"), 0, nil, false, func(f int32) bool { return f == 7 }); string(ret["beano"]) != "clapton!" {
+		t.Error(errUnexpected(ret))
+	}
+}
+
+func TestBoltDBValueSizeStats(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("before"), bytes.Repeat([]byte("x"), 100))
+	if be.Stats() != "" {
+		t.Error(errUnexpected(be.Stats()))
+	}
+	be.Close()
+
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, ValueSizeStats: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if err := be.ScanValueSizes(); err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("small"), []byte("clapton"))
+	be.Set([]byte("big"), bytes.Repeat([]byte("x"), 5000))
+	be.Set([]byte("big"), bytes.Repeat([]byte("x"), 3000))
+	be.Set([]byte("gone"), bytes.Repeat([]byte("x"), 100))
+	be.Delete([]byte("gone"), false)
+
+	h := be.ValueSizes()
+	if h[3] != 1 || h[7] != 1 || h[12] != 1 || h[13] != 0 {
+		t.Error(errUnexpected(h))
+	}
+	if s := be.Stats(); s != "value_size_7 1\nvalue_size_127 1\nvalue_size_4095 1" {
+		t.Error(errUnexpected(s))
+	}
+}
+
+func TestBoltDBStatsJSON(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, ValueSizeStats: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("beano"), []byte("clapton"))
+	be.Get([]byte("beano"))
+
+	js, err := be.StatsJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats map[string]int64
+	if err := json.Unmarshal(js, &stats); err != nil {
+		t.Fatal(err)
+	}
+	// the counters of Stats and bolt's
+	if stats["value_size_7"] != 1 || stats["bolt_write"] == 0 || stats["bolt_read_tx"] == 0 || stats["bolt_page_count"] == 0 {
+		t.Error(errUnexpected(string(js)))
+	}
+	if _, ok := stats["bolt_free_pages"]; !ok {
+		t.Error(errUnexpected(string(js)))
+	}
+	// text Stats leaves bolt's out
+	if s := be.Stats(); strings.Contains(s, "bolt_") || !strings.Contains(s, "value_size_7 1") {
+		t.Error(errUnexpected(s))
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go NewMemcachedProtocolServer(false).Parse(server, be)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("dbstats json\r\n"))
+	reader := bufio.NewReader(client)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(line), &stats); err != nil || stats["value_size_7"] != 1 {
+		t.Error(errUnexpected(line), err)
+	}
+	if ok, _ := reader.ReadString('\n'); ok != "OK\r\n" {
+		t.Error(errUnexpected(ok))
+	}
+}
+
+func TestBloomFilterKeysSharded(t *testing.T) {
+	single := NewBloomFilterKeys(10000)
+	sharded := NewShardedBloomFilterKeys(10000, 8)
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		single.Add(key)
+		sharded.Add(key)
+	}
+	for i := 0; i < 10000; i += 2 {
+		key := []byte(fmt.Sprintf("key%d", i))
+		single.Remove(key)
+		sharded.Remove(key)
+	}
+
+	singleFP, shardedFP := 0, 0
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if i%2 == 1 {
+			if !single.Test(key) || !sharded.Test(key) {
+				t.Fatal(errUnexpected(string(key)))
+			}
+			continue
+		}
+		if single.Test(key) {
+			singleFP++
+		}
+		if sharded.Test(key) {
+			shardedFP++
+		}
+	}
+	if singleFP > 250 || shardedFP > 250 {
+		t.Error(errUnexpected([]int{singleFP, shardedFP}))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprintf("w%d-%d", w, i))
+				sharded.Add(key)
+				if !sharded.Test(key) {
+					t.Error(errUnexpected(string(key)))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	sharded.Reset()
+	if sharded.Test([]byte("key1")) {
+		t.Error("key found after reset")
+	}
+}
+
+func TestBoltDBGetOK(t *testing.T) {
+	key := []byte("getok")
+	vboltdb.Delete(key, false)
+	if v, found, err := vboltdb.GetOK(key); err != nil || found || v != nil {
+		t.Error(errUnexpected(v), err)
+	}
+	vboltdb.Set(key, []byte{})
+	if v, found, err := vboltdb.GetOK(key); err != nil || !found || len(v) != 0 {
+		t.Error(errUnexpected(v), err)
+	}
+	if v, err := vboltdb.Get(key); err != nil || v == nil || len(v) != 0 {
+		t.Error(errUnexpected(v), err)
+	}
+	vboltdb.Set(key, []byte("clapton"))
+	if v, found, err := vboltdb.GetOK(key); err != nil || !found || string(v) != "clapton" {
+		t.Error(errUnexpected(v), err)
+	}
+	vboltdb.Delete(key, false)
+	vboltdb.ListPush(key, []byte("x"))
+	if _, found, err := vboltdb.GetOK(key); err != ErrWrongType || found {
+		t.Error(errUnexpected(err))
+	}
+	vboltdb.Delete(key, false)
+}
+
+func TestBoltDBGetTxID(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := be.GetTxID([]byte("beano")); err == nil {
+		t.Error("expected error without the Debug option")
+	}
+	be.Close()
+
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, Debug: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("beano"), []byte("clapton"))
+	v, first, err := be.GetTxID([]byte("beano"))
+	if err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(string(v)), err)
+	}
+	if _, again, _ := be.GetTxID([]byte("beano")); again != first {
+		t.Error(errUnexpected([]int{first, again}))
+	}
+	be.Set([]byte("beano"), []byte("clapton2"))
+	if _, after, _ := be.GetTxID([]byte("beano")); after <= first {
+		t.Error(errUnexpected([]int{first, after}))
+	}
+}
+
+func TestBoltDBGetRaw(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	if _, err := vboltdb.GetRaw([]byte("beano")); err == nil {
+		t.Error("expected error without the Debug option")
+	}
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, Debug: true, Tombstones: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	if raw, err := be.GetRaw([]byte("beano")); err != nil || raw != nil {
+		t.Error(errUnexpected(raw), err)
+	}
+	be.Set([]byte("beano"), []byte("clapton"))
+	raw, err := be.GetRaw([]byte("beano"))
+	if err != nil || len(raw) < headerSize || raw[0] != headerMagic || !bytes.HasSuffix(raw, []byte("clapton")) {
+		t.Fatal(errUnexpected(raw), err)
+	}
+	if iv, err := decodeValue([]byte("beano"), raw); err != nil || string(iv.value) != "clapton" {
+		t.Error(errUnexpected(iv), err)
+	}
+	// a copy, writes don't change it
+	be.Set([]byte("beano"), []byte("mayall!"))
+	if !bytes.HasSuffix(raw, []byte("clapton")) {
+		t.Error(errUnexpected(raw))
+	}
+
+	be.Delete([]byte("beano"), false)
+	raw, err = be.GetRaw([]byte("beano"))
+	if err != nil || raw == nil || raw[2]&attrTombstone == 0 {
+		t.Error(errUnexpected(raw), err)
+	}
+}
+
+func TestBoltDBCacheDump(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	be.Set([]byte("a key"), []byte("clapton"))
+	be.Set([]byte("beano"), []byte("clapton"))
+	be.ReplaceEx([]byte("beano"), []byte("blues"), 0, 3600)
+	be.Set([]byte("expired"), []byte("clapton"))
+	be.ReplaceEx([]byte("expired"), []byte("clapton"), 0, -1)
+	be.Set([]byte("zeta"), []byte("clapton"))
+
+	dump, err := be.CacheDump(0)
+	if err != nil || len(dump) != 3 {
+		t.Fatal(errUnexpected(dump), err)
+	}
+	if s := dump[0].String(); s != fmt.Sprintf("key=a+key exp=-1 la=%d cas=1 fetch=no cls=1 size=7", dump[0].Modified.Unix()) {
+		t.Error(errUnexpected(s))
+	}
+	if dump[1].Size != 5 || dump[1].Expiration == 0 {
+		t.Error(errUnexpected(dump[1]))
+	}
+	if dump, _ := be.CacheDump(2); len(dump) != 2 || string(dump[1].Key) != "beano" {
+		t.Error(errUnexpected(dump))
+	}
+}
+
+func TestBoltDBNoBloom(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, NoBloom: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if bf := be.keyCache["memcached"]; !bf.Pessimistic() || bf.shards != nil {
+		t.Error("bloom filter allocated with NoBloom")
+	}
+
+	key := []byte("beano")
+	if err := be.Replace(key, []byte("clapton")); err == nil {
+		t.Error("replace of a missing key succeeded")
+	}
+	if err := be.Add(key, []byte("10")); err != nil {
+		t.Error(err)
+	}
+	if err := be.Add(key, []byte("10")); err == nil {
+		t.Error("add of an existing key succeeded")
+	}
+	if v, err := be.Incr(key, 1); err != nil || v != 11 {
+		t.Error(errUnexpected(v), err)
+	}
+	if _, err := be.Incr([]byte("missing"), 1); err == nil {
+		t.Error("incr of a missing key succeeded")
+	}
+	if deleted, err := be.Delete(key, true); err != nil || !deleted {
+		t.Error(errUnexpected(deleted), err)
+	}
+	if v, err := be.Get(key); err != nil || v != nil {
+		t.Error(errUnexpected(v), err)
+	}
+}
+
+func TestBoltDBChangedSince(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, ChangeIndex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	be.Set([]byte("old"), []byte("clapton"))
+	be.Set([]byte("rewritten"), []byte("clapton"))
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+	be.Set([]byte("new"), []byte("clapton"))
+	be.Set([]byte("rewritten"), []byte("clapton2"))
+	be.Delete([]byte("old"), false)
+
+	keys, err := be.ChangedSince(since, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || string(keys[0]) != "new" || string(keys[1]) != "rewritten" || string(keys[2]) != "old" {
+		t.Error(errUnexpected(keys))
+	}
+	if keys, _ := be.ChangedSince(since, 1); len(keys) != 1 {
+		t.Error(errUnexpected(keys))
+	}
+	if keys, _ := be.ChangedSince(time.Time{}, 0); len(keys) != 3 {
+		t.Error(errUnexpected(keys))
+	}
+
+	// entries of deleted keys go once past the tombstone grace
+	be.reap(time.Now().Add(DefaultTombstoneGrace + time.Second))
+	if keys, _ := be.ChangedSince(time.Time{}, 0); len(keys) != 2 {
+		t.Error(errUnexpected(keys))
+	}
+}
+
+func TestBoltDBContentType(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	if err := be.SetWithContentType([]byte("doc"), []byte(`{"beano":"clapton"}`), ContentTypeJSON); err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("plain"), []byte("clapton"))
+
+	if m, err := be.Meta([]byte("doc")); err != nil || m == nil || m.ContentType != ContentTypeJSON || m.Size != 19 || m.Flags != 0 {
+		t.Error(errUnexpected(m), err)
+	}
+	if m, err := be.Meta([]byte("plain")); err != nil || m == nil || m.ContentType != ContentTypeUnknown {
+		t.Error(errUnexpected(m), err)
+	}
+	if m, err := be.Meta([]byte("missing")); err != nil || m != nil {
+		t.Error(errUnexpected(m), err)
+	}
+	// Update keeps the content type
+	be.Update([]byte("doc"), func(old []byte) ([]byte, error) { return []byte(`{}`), nil })
+	if m, _ := be.Meta([]byte("doc")); m == nil || m.ContentType != ContentTypeJSON {
+		t.Error(errUnexpected(m))
+	}
+}
+
+func TestBoltDBTransaction(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("from"), []byte("10"))
+
+	// move a key, reading its own writes
+	err = be.Transaction(func(tx *Txn) error {
+		v, err := tx.Get([]byte("from"))
+		if err != nil {
+			return err
+		}
+		if err := tx.Put([]byte("to"), v); err != nil {
+			return err
+		}
+		if v, _ := tx.Get([]byte("to")); string(v) != "10" {
+			t.Error(errUnexpected(v))
+		}
+		_, err = tx.Delete([]byte("from"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := be.Get([]byte("from")); v != nil {
+		t.Error(errUnexpected(v))
+	}
+	if v, _ := be.Get([]byte("to")); string(v) != "10" {
+		t.Error(errUnexpected(v))
+	}
+
+	// a failing fn rolls back everything, bloom included
+	abort := fmt.Errorf("abort")
+	err = be.Transaction(func(tx *Txn) error {
+		tx.Put([]byte("rolledback"), []byte("clapton"))
+		tx.Delete([]byte("to"))
+		return abort
+	})
+	if err != abort {
+		t.Error(errUnexpected(err))
+	}
+	if be.keyCache["memcached"].Test([]byte("rolledback")) {
+		t.Error("bloom updated by a rolled back transaction")
+	}
+	if v, _ := be.Get([]byte("to")); string(v) != "10" {
+		t.Error(errUnexpected(v))
+	}
+}
+
+func TestBoltDBClosed(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("kkk"), []byte("vvv"))
+	be.Close()
+
+	if v, err := be.Get([]byte("kkk")); err != ErrBackendClosed || v != nil {
+		t.Error(errUnexpected(err))
+	}
+	if err := be.Set([]byte("kkk"), []byte("vvv")); err != ErrBackendClosed {
+		t.Error(errUnexpected(err))
+	}
+	if _, err := be.Delete([]byte("kkk"), true); err != ErrBackendClosed {
+		t.Error(errUnexpected(err))
+	}
+	if err := be.SwitchBucket("other"); err != ErrBackendClosed {
+		t.Error(errUnexpected(err))
+	}
+	// closing twice is harmless
+	be.Close()
+}
+
+func TestBoltDBKeyFingerprint(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	for _, k := range []string{"shared1", "shared2", "local"} {
+		be.Set([]byte(k), []byte("v"))
+	}
+	local, err := be.KeyFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be.SwitchBucket("replica")
+	for _, k := range []string{"shared1", "shared2", "remote1", "remote2"} {
+		be.Set([]byte(k), []byte("v"))
+	}
+	remote, err := be.KeyFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remote) != 4*fingerprintHashSize {
+		t.Error(errUnexpected(len(remote)))
+	}
+
+	onlyLocal, onlyRemote, err := DiffFingerprints(local, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onlyLocal) != 1 || onlyLocal[0] != keyHash([]byte("local")) {
+		t.Error(errUnexpected(onlyLocal))
+	}
+	if len(onlyRemote) != 2 {
+		t.Error(errUnexpected(onlyRemote))
+	}
+
+	keys, err := be.KeysMissingFrom(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || string(keys[0]) != "remote1" || string(keys[1]) != "remote2" {
+		t.Error(errUnexpected(keys))
+	}
+
+	if _, _, err := DiffFingerprints(local[1:], remote); err == nil {
+		t.Error("malformed fingerprint accepted")
+	}
+}
+
+func TestBoltDBBatchWrites(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, BatchWrites: true, BatchDelay: time.Millisecond, ValueSizeStats: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("counter"), []byte("0"))
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := []byte(fmt.Sprintf("key-%d-%d", w, i))
+				if err := be.Set(key, []byte("clapton")); err != nil {
+					t.Error(err)
+				}
+				if _, err := be.Incr([]byte("counter"), 1); err != nil {
+					t.Error(err)
+				}
+			}
+			be.Delete([]byte(fmt.Sprintf("key-%d-0", w)), false)
+		}(w)
+	}
+	wg.Wait()
+
+	if v, _ := be.Get([]byte("counter")); string(v) != "400" {
+		t.Error(errUnexpected(v))
+	}
+	if v, _ := be.Get([]byte("key-3-7")); string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+	if v, _ := be.Get([]byte("key-3-0")); v != nil {
+		t.Error(errUnexpected(v))
+	}
+	var count int64
+	for _, n := range be.ValueSizes() {
+		count += n
+	}
+	if count != 8*49+1 {
+		t.Error(errUnexpected(count))
+	}
+}
+
+func TestBoltDBAdaptiveBatchDelay(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	if _, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{AdaptiveBatchDelay: true}); err == nil {
+		t.Error("expected error without BatchWrites")
+	}
+	if _, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{BatchWrites: true, AdaptiveBatchDelay: true, BatchDelayMin: time.Second, BatchDelayMax: time.Millisecond}); err == nil {
+		t.Error("expected error with BatchDelayMin above BatchDelayMax")
+	}
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, BatchWrites: true, BatchDelay: 2 * time.Millisecond, AdaptiveBatchDelay: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if be.BatchDelay() != 2*time.Millisecond || be.db.MaxBatchDelay != 2*time.Millisecond {
+		t.Fatal(errUnexpected(be.BatchDelay()))
+	}
+
+	// a lone writer waits for nobody, the delay shrinks
+	for i := 0; i < batchTuneCalls; i++ {
+		be.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("clapton"))
+	}
+	be.batchTuner.since = time.Now().Add(-batchTuneWindow)
+	be.Set([]byte("beano"), []byte("clapton"))
+	if be.BatchDelay() != time.Millisecond || be.db.MaxBatchDelay != time.Millisecond {
+		t.Error(errUnexpected(be.BatchDelay()))
+	}
+	if !strings.Contains(be.Stats(), "batch_delay_us 1000") {
+		t.Error(errUnexpected(be.Stats()))
+	}
+
+	// crowded commits, it moves while the latency improves and turns back when it doesn't
+	tuner, _ := newBatchTuner(BackendOptions{BatchDelay: 4 * time.Millisecond})
+	window := func(latency time.Duration) time.Duration {
+		for i := 0; i < batchTuneCalls; i++ {
+			if i%5 == 0 {
+				tuner.counted(&bolt.Tx{})
+			}
+			tuner.observe(latency)
+		}
+		tuner.since = time.Now().Add(-batchTuneWindow)
+		next := tuner.observe(latency)
+		if next != 0 {
+			tuner.delay = int64(next)
+		}
+		return next
+	}
+	for i, step := range []struct {
+		latency time.Duration
+		next    time.Duration
+	}{
+		{40 * time.Millisecond, 2 * time.Millisecond},
+		{60 * time.Millisecond, 3 * time.Millisecond},
+		{50 * time.Millisecond, 4500 * time.Microsecond},
+		{45 * time.Millisecond, 6750 * time.Microsecond},
+		{44 * time.Millisecond, DefaultBatchDelayMax},
+		{44 * time.Millisecond, 0},
+		{44 * time.Millisecond, DefaultBatchDelayMax / 2},
+	} {
+		if next := window(step.latency); next != step.next {
+			t.Errorf("window %d: expected delay %s, got %s", i, step.next, next)
+		}
+	}
+	// too few writes to tell
+	tuner.since = time.Now().Add(-batchTuneWindow)
+	if next := tuner.observe(time.Millisecond); next != 0 {
+		t.Error(errUnexpected(next))
+	}
+}
+
+func benchmarkBoltDBSet(b *testing.B, opts BackendOptions) {
+	filename := tempBoltDBFile(b)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer be.Close()
+	var n int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := []byte(strconv.FormatInt(atomic.AddInt64(&n, 1), 10))
+			if err := be.Set(key, []byte("clapton")); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkBoltDBSetParallel(b *testing.B) {
+	benchmarkBoltDBSet(b, BackendOptions{MaxKeysPerBucket: 100000})
+}
+
+func BenchmarkBoltDBSetParallelBatch(b *testing.B) {
+	benchmarkBoltDBSet(b, BackendOptions{MaxKeysPerBucket: 100000, BatchWrites: true, BatchDelay: 500 * time.Microsecond})
+}
+
+func BenchmarkBoltDBSetParallelAdaptiveBatch(b *testing.B) {
+	benchmarkBoltDBSet(b, BackendOptions{MaxKeysPerBucket: 100000, BatchWrites: true, AdaptiveBatchDelay: true})
+}
+
+func TestBoltDBExpirationReaper(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, ManualReaper: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if be.reaperStop != nil {
+		t.Fatal("reaper started with ManualReaper")
+	}
+	be.StopExpirationReaper()
+
+	if _, err := be.putEx(&InternalValue{key: []byte("short"), value: []byte("lived"), expiration: -1}, false, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	stored := func() (raw bool) {
+		be.db.View(func(tx *bolt.Tx) error {
+			raw = tx.Bucket([]byte("memcached")).Get([]byte("short")) != nil
+			return nil
+		})
+		return raw
+	}
+	be.StartExpirationReaper(10 * time.Millisecond)
+	be.StartExpirationReaper(time.Hour)
+	for deadline := time.Now().Add(2 * time.Second); stored(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expired key not reaped")
+		}
+	}
+	be.StopExpirationReaper()
+	be.StopExpirationReaper()
+	if be.reaperStop != nil {
+		t.Error("reaper still running")
+	}
+}
+
+func TestBoltDBReaperPending(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, ReaperInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := func() bool {
+		be.reaperLock.Lock()
+		defer be.reaperLock.Unlock()
+		return be.reaperStop != nil
+	}
+	if running() {
+		t.Fatal("reaper started with nothing to reap")
+	}
+	be.Set([]byte("kept"), []byte("v"))
+	if running() {
+		t.Fatal("reaper started by a write without expiration")
+	}
+
+	// the first expiration starts it
+	if _, err := be.putEx(&InternalValue{key: []byte("short"), value: []byte("lived"), expiration: -1}, false, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	stored := func() (raw bool) {
+		be.db.View(func(tx *bolt.Tx) error {
+			raw = tx.Bucket([]byte("memcached")).Get([]byte("short")) != nil
+			return nil
+		})
+		return raw
+	}
+	for deadline := time.Now().Add(2 * time.Second); stored() || !running(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expired key not reaped")
+		}
+	}
+	be.Close()
+
+	// expirations left in the index start it on open
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running() {
+		t.Error("reaper started with an empty index")
+	}
+	if _, err := be.putEx(&InternalValue{key: []byte("later"), value: []byte("v"), expiration: 3600}, false, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	be.Close()
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !running() {
+		t.Error("reaper not started with expirations indexed")
+	}
+	be.Close()
+	if running() {
+		t.Error("reaper running after Close")
+	}
+}
+
+func TestBoltDBReaperAppliedTombstones(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	// a replica, without the Tombstones option
+	opts := BackendOptions{MaxKeysPerBucket: 1000, TombstoneGrace: 10 * time.Millisecond, ReaperInterval: 10 * time.Millisecond}
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	modified := time.Now().UnixNano()
+	be.ApplyReplicationRecord(Record{Op: RecordSet, Bucket: "memcached", Key: []byte("gone"), Value: []byte("v"), CAS: 1, Modified: modified})
+	if err := be.ApplyReplicationRecord(Record{Op: RecordDelete, Bucket: "memcached", Key: []byte("gone"), CAS: 2, Modified: modified + 1}); err != nil {
+		t.Fatal(err)
+	}
+	stored := func() (raw bool) {
+		be.db.View(func(tx *bolt.Tx) error {
+			raw = tx.Bucket([]byte("memcached")).Get([]byte("gone")) != nil
+			return nil
+		})
+		return raw
+	}
+	for deadline := time.Now().Add(2 * time.Second); stored(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("applied tombstone not purged")
+		}
+	}
+
+	// a tombstone left over a restart is still purged
+	be.Close()
+	opts.TombstoneGrace = time.Hour
+	if be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.ApplyReplicationRecord(Record{Op: RecordDelete, Bucket: "memcached", Key: []byte("gone"), CAS: 3, Modified: modified + 2}); err != nil {
+		t.Fatal(err)
+	}
+	be.Close()
+	opts.TombstoneGrace = 10 * time.Millisecond
+	if be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", opts); err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if !stored() {
+		t.Fatal("tombstone not applied")
+	}
+	for deadline := time.Now().Add(2 * time.Second); stored(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("tombstone not purged after a restart")
+		}
+	}
+}
+
+func TestBoltDBReaperCleanup(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, ManualReaper: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if err := be.ConfigureBucket("memcached", BucketConfig{DefaultTTL: 60}); err != nil {
+		t.Fatal(err)
+	}
+	be.SetWithTags([]byte("tagged"), []byte("v"), []string{"t"})
+	be.SetAdd([]byte("set"), []byte("m"))
+	if n, err := be.reapExpired(time.Now().Add(time.Hour)); err != nil || n != 2 {
+		t.Fatal(errUnexpected(n), err)
+	}
+
+	// reaped keys leave no tag nor member behind
+	be.db.View(func(tx *bolt.Tx) error {
+		if membersBucket(tx, setsBucketPrefix, "memcached", []byte("set")) != nil {
+			t.Error("members of a reaped set left")
+		}
+		if tags, _, _ := tagIndexes(tx, "memcached", false); tags != nil {
+			if k, _ := tags.Cursor().First(); k != nil {
+				t.Error("tag of a reaped key left")
+			}
+		}
+		return nil
+	})
+	if n, err := be.InvalidateTag("t"); err != nil || n != 0 {
+		t.Error(errUnexpected(n), err)
+	}
+}
+
+func TestBoltDBCASReturned(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	cas1, err := be.SetCAS([]byte("kkk"), []byte("1"))
+	if err != nil || cas1 == 0 {
+		t.Fatal(errUnexpected(err))
+	}
+	if m, _ := be.Meta([]byte("kkk")); m == nil || m.CAS != cas1 {
+		t.Error(errUnexpected(m))
+	}
+	if cas, err := be.AddCAS([]byte("kkk"), []byte("2")); err == nil || cas != 0 {
+		t.Error(errUnexpected(cas))
+	}
+	cas2, err := be.ReplaceCAS([]byte("kkk"), []byte("2"))
+	if err != nil || cas2 <= cas1 {
+		t.Error(errUnexpected(cas2))
+	}
+	v, cas3, err := be.IncrementCAS([]byte("kkk"), 5, false)
+	if err != nil || v != 7 || cas3 <= cas2 {
+		t.Error(errUnexpected(cas3))
+	}
+	if m, _ := be.Meta([]byte("kkk")); m == nil || m.CAS != cas3 {
+		t.Error(errUnexpected(m))
+	}
+	if _, cas, err := be.IncrementCAS([]byte("missing"), 1, false); err == nil || cas != 0 {
+		t.Error(errUnexpected(cas))
+	}
+}
+
+func TestBoltDBRangeOrdered(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	for _, k := range []string{"n:9", "n:10", "n:100", "n:2"} {
+		be.Set([]byte(k), []byte("v"))
+	}
+
+	numeric := func(a, b []byte) int {
+		x, _ := strconv.Atoi(string(a[2:]))
+		y, _ := strconv.Atoi(string(b[2:]))
+		return x - y
+	}
+	keys, values, err := be.RangeOrdered([]byte("n:"), 0, nil, false, numeric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprintf("%s", keys); got != "[n:2 n:9 n:10 n:100]" || len(values) != 4 {
+		t.Error(errUnexpected(got))
+	}
+	keys, _, _ = be.RangeOrdered([]byte("n:"), 0, nil, true, nil)
+	if got := fmt.Sprintf("%s", keys); got != "[n:9 n:2 n:100 n:10]" {
+		t.Error(errUnexpected(got))
+	}
+
+	be.SwitchBucket("ints")
+	for _, n := range []int64{5, -3, 0, 1 << 40, -1 << 40} {
+		be.Set(EncodeInt64Key(n), []byte("v"))
+	}
+	keys, _, _ = be.RangeOrdered(nil, 0, nil, false, nil)
+	var got []int64
+	for _, k := range keys {
+		n, err := DecodeInt64Key(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, n)
+	}
+	if fmt.Sprint(got) != fmt.Sprint([]int64{-1 << 40, -3, 0, 5, 1 << 40}) {
+		t.Error(errUnexpected(got))
+	}
+}
+
+func TestBoltDBKeyNormalizer(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, KeyNormalizer: TrimKeySpace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	be.Set([]byte("beano "), []byte("clapton"))
+	if v, _ := be.Get([]byte("beano")); string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+	if v, _ := be.Get([]byte(" beano\t")); string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+	if err := be.Add([]byte("beano"), []byte("mayall")); err == nil {
+		t.Error("Add of a normalized duplicate succeeded")
+	}
+	keys, _, _ := be.RangeOrdered(nil, 0, nil, false, nil)
+	if len(keys) != 1 || string(keys[0]) != "beano" {
+		t.Error(errUnexpected(keys))
+	}
+	if !be.keyCache["memcached"].Test([]byte("beano")) {
+		t.Error("normalized key not in the bloom filter")
+	}
+	if ok, err := be.Delete([]byte("beano  "), true); !ok || err != nil {
+		t.Error(errUnexpected(err))
+	}
+	if v, _ := be.Get([]byte("beano")); v != nil {
+		t.Error(errUnexpected(v))
+	}
+}
+
+func TestReplicaBackend(t *testing.T) {
+	primaryFile, replicaFile := tempBoltDBFile(t), tempBoltDBFile(t)
+	defer removeBoltDBFiles(primaryFile)
+	defer removeBoltDBFiles(replicaFile)
+	var forwarded int64
+	rb, err := NewReplicaBackend(primaryFile, replicaFile, "memcached", BackendOptions{
+		MaxKeysPerBucket: 1000,
+		Replicate:        func(Record) { atomic.AddInt64(&forwarded, 1) },
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rb.Close()
+	var vdb BackendDatabase = rb
+
+	vdb.Set([]byte("kkk"), []byte("clapton"))
+	if v, _ := vdb.Get([]byte("kkk")); string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+	rb.Sync()
+	if rb.Lag() != 0 {
+		t.Error(errUnexpected(rb.Lag()))
+	}
+	if v, _ := rb.replica.Get([]byte("kkk")); string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+	if r, _ := vdb.Range([]byte("k"), 0, nil, false); string(r["kkk"]) != "clapton" {
+		t.Error(errUnexpected(r))
+	}
+	vdb.Delete([]byte("kkk"), false)
+	if v, _ := vdb.Get([]byte("kkk")); v != nil {
+		t.Error(errUnexpected(v))
+	}
+	rb.Sync()
+	if v, _ := rb.replica.Get([]byte("kkk")); v != nil {
+		t.Error(errUnexpected(v))
+	}
+	if n := atomic.LoadInt64(&forwarded); n != 2 {
+		t.Error(errUnexpected(n))
+	}
+
+	// reads are served by the replica once it caught up
+	rb.replica.ApplyReplicationRecord(Record{Op: RecordSet, Bucket: "memcached", Key: []byte("replica-only"), Value: []byte("mayall"), Modified: time.Now().UnixNano()})
+	if v, _ := vdb.Get([]byte("replica-only")); string(v) != "mayall" {
+		t.Error(errUnexpected(v))
+	}
+}
+
+func TestReplicatedBackend(t *testing.T) {
+	files := []string{tempBoltDBFile(t), tempBoltDBFile(t), tempBoltDBFile(t)}
+	for _, file := range files {
+		defer removeBoltDBFiles(file)
+	}
+	if _, err := NewReplicatedBackend(files, "memcached", BackendOptions{MaxKeysPerBucket: 1000}, 4); err == nil {
+		t.Error("expected error with a quorum above the replicas")
+	}
+	rb, err := NewReplicatedBackend(files, "memcached", BackendOptions{MaxKeysPerBucket: 1000, NoSync: true}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vdb BackendDatabase = rb
+	if rb.quorum != 2 {
+		t.Fatal(errUnexpected(rb.quorum))
+	}
+
+	vdb.Set([]byte("beano"), []byte("clapton"))
+	// every replica applies the writes, in turns they all serve the reads
+	rb.Sync()
+	for i := 0; i < 3; i++ {
+		if v, _ := vdb.Get([]byte("beano")); string(v) != "clapton" {
+			t.Error(errUnexpected(string(v)))
+		}
+	}
+	if err := vdb.Add([]byte("beano"), []byte("mayall")); err == nil {
+		t.Error("expected Add of an existing key to fail")
+	}
+	if n, err := vdb.Increment([]byte("counter"), 3, true); err != nil || n != 3 {
+		t.Error(errUnexpected(n), err)
+	}
+	rb.Flush()
+	rb.Sync()
+	for _, be := range rb.replicas {
+		if v, _ := be.Get([]byte("counter")); v != nil {
+			t.Error(errUnexpected(string(v)))
+		}
+	}
+	vdb.Set([]byte("beano"), []byte("clapton"))
+	if stale := rb.StaleReplicas(); len(stale) != 0 {
+		t.Error(errUnexpected(stale))
+	}
+
+	// a replica failing the writes the quorum commits goes stale
+	rb.Sync()
+	rb.replicas[2].db.Close()
+	if err := vdb.Set([]byte("beano"), []byte("bruce")); err != nil {
+		t.Fatal(err)
+	}
+	// checked once every replica answered
+	for i := 0; len(rb.StaleReplicas()) == 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if stale := rb.StaleReplicas(); len(stale) != 1 || stale[0] != files[2] {
+		t.Fatal(errUnexpected(stale))
+	}
+	for i := 0; i < 3; i++ {
+		if v, err := vdb.Get([]byte("beano")); err != nil || string(v) != "bruce" {
+			t.Error(errUnexpected(string(v)), err)
+		}
+	}
+	if !strings.Contains(rb.Stats(), "replicas_stale 1") {
+		t.Error(errUnexpected(rb.Stats()))
+	}
+
+	// without a quorum writes fail, the replica committing it goes stale
+	rb.Sync()
+	rb.replicas[1].db.Close()
+	if err := vdb.Set([]byte("beano"), []byte("jack")); err != bolt.ErrDatabaseNotOpen {
+		t.Error(errUnexpected(err))
+	}
+	rb.Sync()
+	for i := 0; len(rb.StaleReplicas()) < 2 && i < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if stale := rb.StaleReplicas(); len(stale) != 2 || stale[0] != files[0] {
+		t.Fatal(errUnexpected(stale))
+	}
+
+	// it stays stale when opened again, replica 2 couldn't store its mark
+	rb.Close()
+	rb, err = NewReplicatedBackend(files, "memcached", BackendOptions{MaxKeysPerBucket: 1000, NoSync: true}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rb.Close()
+	if stale := rb.StaleReplicas(); len(stale) != 1 || stale[0] != files[0] {
+		t.Error(errUnexpected(stale))
+	}
+}
+
+func TestBoltDBTruncate(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	if err := be.Truncate([]byte("missing"), 10); err != ErrKeyNotFound {
+		t.Error(errUnexpected(err))
+	}
+	be.Set([]byte("log"), []byte("line1\nline2\nline3\n"))
+	if err := be.Truncate([]byte("log"), 12); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := be.Get([]byte("log")); string(v) != "line2\nline3\n" {
+		t.Error(errUnexpected(v))
+	}
+	m, _ := be.Meta([]byte("log"))
+	if err := be.Truncate([]byte("log"), 100); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := be.Meta([]byte("log")); after.CAS != m.CAS {
+		t.Error("no-op truncate rewrote the value")
+	}
+	if err := be.Truncate([]byte("log"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := be.Get([]byte("log")); v == nil || len(v) != 0 {
+		t.Error(errUnexpected(v))
+	}
+}
+
+func TestBoltDBSetIfExpiringSoon(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	if ok, err := be.SetIfExpiringSoon([]byte("lock"), []byte("a"), 10, 60); !ok || err != nil {
+		t.Error(errUnexpected(err))
+	}
+	if ok, err := be.SetIfExpiringSoon([]byte("lock"), []byte("b"), 10, 60); ok || err != nil {
+		t.Error(errUnexpected(err))
+	}
+	if v, _ := be.Get([]byte("lock")); string(v) != "a" {
+		t.Error(errUnexpected(v))
+	}
+	if ok, err := be.SetIfExpiringSoon([]byte("lock"), []byte("c"), 120, 60); !ok || err != nil {
+		t.Error(errUnexpected(err))
+	}
+	if v, _ := be.Get([]byte("lock")); string(v) != "c" {
+		t.Error(errUnexpected(v))
+	}
+
+	be.Set([]byte("forever"), []byte("x"))
+	if ok, err := be.SetIfExpiringSoon([]byte("forever"), []byte("y"), 1<<30, 60); ok || err != nil {
+		t.Error(errUnexpected(err))
+	}
+}
+
+func TestBoltDBExpiredKeys(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, ManualReaper: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	for _, k := range []string{"gone1", "gone2", "rewritten"} {
+		be.putEx(&InternalValue{key: []byte(k), value: []byte("v"), expiration: -1}, false, true, nil)
+	}
+	be.putEx(&InternalValue{key: []byte("alive"), value: []byte("v"), expiration: 3600}, false, true, nil)
+	be.Set([]byte("rewritten"), []byte("v"))
+
+	keys, err := be.ExpiredKeys(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatal(errUnexpected(keys))
+	}
+	if keys, _ := be.ExpiredKeys(1); len(keys) != 1 {
+		t.Error(errUnexpected(keys))
+	}
+	// nothing was deleted
+	if n, err := be.reapExpired(time.Now()); err != nil || n != 2 {
+		t.Error(errUnexpected(n))
+	}
+	if keys, _ := be.ExpiredKeys(0); len(keys) != 0 {
+		t.Error(errUnexpected(keys))
+	}
+}
+
+func TestBoltDBList(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	if n, err := be.ListLen([]byte("list")); n != 0 || err != nil {
+		t.Error(errUnexpected(err))
+	}
+	for i, item := range []string{"clapton", "", "mayall", "green"} {
+		if n, err := be.ListPush([]byte("list"), []byte(item)); n != i+1 || err != nil {
+			t.Fatal(errUnexpected(err))
+		}
+	}
+	if n, _ := be.ListLen([]byte("list")); n != 4 {
+		t.Error(errUnexpected(n))
+	}
+	items, err := be.ListRange([]byte("list"), 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%q", items) != `["clapton" "" "mayall" "green"]` {
+		t.Error(errUnexpected(items))
+	}
+	if items, _ := be.ListRange([]byte("list"), -2, 10); fmt.Sprintf("%q", items) != `["mayall" "green"]` {
+		t.Error(errUnexpected(items))
+	}
+	if items, _ := be.ListRange([]byte("list"), 3, 1); items != nil {
+		t.Error(errUnexpected(items))
+	}
+
+	// lists and scalars don't mix
+	if _, err := be.Get([]byte("list")); err != ErrWrongType {
+		t.Error(errUnexpected(err))
+	}
+	if r, _ := be.Range([]byte("li"), 0, nil, false); len(r) != 0 {
+		t.Error(errUnexpected(r))
+	}
+	be.Set([]byte("scalar"), []byte("v"))
+	if _, err := be.ListPush([]byte("scalar"), []byte("v")); err != ErrWrongType {
+		t.Error(errUnexpected(err))
+	}
+	if _, err := be.ListLen([]byte("scalar")); err != ErrWrongType {
+		t.Error(errUnexpected(err))
+	}
+	be.Set([]byte("list"), []byte("scalar now"))
+	if v, _ := be.Get([]byte("list")); string(v) != "scalar now" {
+		t.Error(errUnexpected(v))
+	}
+}
+
+func TestBoltDBSetType(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	for _, m := range []string{"mayall", "clapton", "mayall", "green"} {
+		be.SetAdd([]byte("band"), []byte(m))
+	}
+	if added, err := be.SetAdd([]byte("band"), []byte("clapton")); added || err != nil {
+		t.Error(errUnexpected(err))
+	}
+	members, err := be.SetMembers([]byte("band"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%s", members) != "[clapton green mayall]" {
+		t.Error(errUnexpected(members))
+	}
+	if ok, _ := be.SetIsMember([]byte("band"), []byte("green")); !ok {
+		t.Error("green not a member")
+	}
+	if ok, _ := be.SetIsMember([]byte("band"), []byte("bruce")); ok {
+		t.Error("bruce is a member")
+	}
+	if removed, err := be.SetRemove([]byte("band"), []byte("green")); !removed || err != nil {
+		t.Error(errUnexpected(err))
+	}
+	if removed, _ := be.SetRemove([]byte("band"), []byte("green")); removed {
+		t.Error("removed twice")
+	}
+	if _, err := be.Get([]byte("band")); err != ErrWrongType {
+		t.Error(errUnexpected(err))
+	}
+	be.Set([]byte("scalar"), []byte("v"))
+	if _, err := be.SetAdd([]byte("scalar"), []byte("v")); err != ErrWrongType {
+		t.Error(errUnexpected(err))
+	}
+
+	// emptied sets are deleted, deleted sets drop their members
+	be.SetRemove([]byte("band"), []byte("clapton"))
+	be.SetRemove([]byte("band"), []byte("mayall"))
+	if m, _ := be.Meta([]byte("band")); m != nil {
+		t.Error(errUnexpected(m))
+	}
+	be.SetAdd([]byte("band"), []byte("bruce"))
+	be.Delete([]byte("band"), false)
+	be.SetAdd([]byte("band"), []byte("baker"))
+	if members, _ := be.SetMembers([]byte("band")); fmt.Sprintf("%s", members) != "[baker]" {
+		t.Error(errUnexpected(members))
+	}
+	if members, _ := be.SetMembers([]byte("missing")); members != nil {
+		t.Error(errUnexpected(members))
+	}
+}
+
+func TestBoltDBHashType(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, EncryptionKey: bytes.Repeat([]byte("k"), 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	if created, err := be.HashSet([]byte("user:1"), []byte("name"), []byte("eric")); !created || err != nil {
+		t.Fatal(errUnexpected(err))
+	}
+	be.HashSet([]byte("user:1"), []byte("band"), []byte("cream"))
+	if created, _ := be.HashSet([]byte("user:1"), []byte("band"), []byte("bluesbreakers")); created {
+		t.Error("existing field reported as created")
+	}
+	if v, err := be.HashGet([]byte("user:1"), []byte("band")); string(v) != "bluesbreakers" || err != nil {
+		t.Error(errUnexpected(v))
+	}
+	if v, _ := be.HashGet([]byte("user:1"), []byte("missing")); v != nil {
+		t.Error(errUnexpected(v))
+	}
+	all, err := be.HashGetAll([]byte("user:1"))
+	if err != nil || len(all) != 2 || string(all["name"]) != "eric" {
+		t.Error(errUnexpected(all))
+	}
+
+	// field values are encrypted at rest
+	be.db.View(func(tx *bolt.Tx) error {
+		raw := membersBucket(tx, hashesBucketPrefix, "memcached", []byte("user:1")).Get([]byte("name"))
+		if bytes.Contains(raw, []byte("eric")) {
+			t.Error("field stored in plain text")
+		}
+		return nil
+	})
+
+	// hashes and other kinds don't mix
+	if _, err := be.Get([]byte("user:1")); err != ErrWrongType {
+		t.Error(errUnexpected(err))
+	}
+	if _, err := be.SetAdd([]byte("user:1"), []byte("x")); err != ErrWrongType {
+		t.Error(errUnexpected(err))
+	}
+	be.Set([]byte("scalar"), []byte("v"))
+	if _, err := be.HashGet([]byte("scalar"), []byte("f")); err != ErrWrongType {
+		t.Error(errUnexpected(err))
+	}
+
+	if deleted, _ := be.HashDel([]byte("user:1"), []byte("name")); !deleted {
+		t.Error("name not deleted")
+	}
+	be.HashDel([]byte("user:1"), []byte("band"))
+	if all, _ := be.HashGetAll([]byte("user:1")); len(all) != 0 {
+		t.Error(errUnexpected(all))
+	}
+	if m, _ := be.Meta([]byte("user:1")); m != nil {
+		t.Error(errUnexpected(m))
+	}
+}
+
+func TestBoltDBDurability(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, NoSync: true, BatchDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if !be.db.NoSync {
+		t.Fatal("NoSync not applied")
+	}
+
+	for i, d := range []Durability{DurabilityDefault, DurabilitySync, DurabilityNoSync, DurabilityBatch} {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if err := be.PutWithDurability(key, []byte("1"), false, false, d); err != nil {
+			t.Fatal(errUnexpected(err))
+		}
+		if err := be.PutWithDurability(key, []byte("1"), false, false, d); err == nil {
+			t.Error("add of an existing key succeeded")
+		}
+		if n, err := be.IncrementWithDurability(key, 2, false, d); n != 3 || err != nil {
+			t.Error(errUnexpected(err))
+		}
+		if ok, err := be.DeleteWithDurability(key, true, d); !ok || err != nil {
+			t.Error(errUnexpected(err))
+		}
+		if v, _ := be.Get(key); v != nil {
+			t.Error(errUnexpected(v))
+		}
+	}
+}
+
+func TestBoltDBExportImportKey(t *testing.T) {
+	filename, otherFile := tempBoltDBFile(t), tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	defer removeBoltDBFiles(otherFile)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	other, err := NewKVBoltDBBackend(otherFile, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if _, err := be.ExportKey([]byte("missing")); err != ErrKeyNotFound {
+		t.Error(errUnexpected(err))
+	}
+	be.Set([]byte("kkk"), []byte("v0"))
+	be.ReplaceEx([]byte("kkk"), []byte("clapton"), 42, 3600)
+	rec, err := be.ExportKey([]byte("kkk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Flags != 42 || rec.CAS != 2 || string(rec.Value) != "clapton" || !rec.HasChecksum || rec.Checksum != crc32.ChecksumIEEE(rec.Value) {
+		t.Error(errUnexpected(rec))
+	}
+
+	// a newer local copy is still replaced
+	other.Set([]byte("kkk"), []byte("newer"))
+	other.Set([]byte("kkk"), []byte("newer"))
+	other.Set([]byte("kkk"), []byte("newer"))
+	if err := other.ImportKey(rec); err != nil {
+		t.Fatal(err)
+	}
+	got, err := other.ExportKey([]byte("kkk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", rec) {
+		t.Error(errUnexpected(got))
+	}
+
+	rec.Value = []byte("tampered")
+	if err := other.ImportKey(rec); err == nil {
+		t.Error("import with a bad checksum succeeded")
+	}
+	// a zero checksum is checked too, a record without one isn't
+	rec.Checksum = 0
+	if err := other.ImportKey(rec); err == nil {
+		t.Error("import with a zero checksum succeeded")
+	}
+	rec.HasChecksum = false
+	if err := other.ImportKey(rec); err != nil {
+		t.Error(err)
+	}
+	be.SetAdd([]byte("set"), []byte("m"))
+	if _, err := be.ExportKey([]byte("set")); err != ErrWrongType {
+		t.Error(errUnexpected(err))
+	}
+}
+
+func TestBoltDBBoltOptions(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, BoltOptions: &bolt.Options{InitialMmapSize: 1 << 22}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("kkk"), []byte("vvv"))
+	if err := be.Reopen(filename); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := be.Get([]byte("kkk")); string(v) != "vvv" {
+		t.Error(errUnexpected(v))
+	}
+}
+
+func TestBoltDBExpireEvents(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	var records []Record
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{
+		MaxKeysPerBucket: 1000,
+		ManualReaper:     true,
+		ExpireEvents:     true,
+		Replicate:        func(r Record) { records = append(records, r) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	be.putEx(&InternalValue{key: []byte("short"), value: []byte("lived"), expiration: 1}, false, true, nil)
+	records = nil
+	if n, err := be.reapExpired(time.Now().Add(2 * time.Second)); err != nil || n != 1 {
+		t.Fatal(errUnexpected(n))
+	}
+	if len(records) != 1 || records[0].Op != RecordExpire || string(records[0].Key) != "short" || records[0].Bucket != "memcached" {
+		t.Fatal(errUnexpected(records))
+	}
+
+	// replicas expire keys on their own
+	if err := be.ApplyReplicationRecord(records[0]); err != nil {
+		t.Error(errUnexpected(err))
+	}
+}
+
+func TestBoltDBRotate(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	if err := be.Rotate([]byte("config"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := be.Get([]byte("config.prev")); err != nil || v != nil {
+		t.Fatal(errUnexpected(v))
+	}
+	if err := be.Rotate([]byte("config"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := be.Get([]byte("config")); string(v) != "v2" {
+		t.Error(errUnexpected(string(v)))
+	}
+	if v, _ := be.Get([]byte("config.prev")); string(v) != "v1" {
+		t.Error(errUnexpected(string(v)))
+	}
+
+	// non scalar values can't be rotated and are left untouched
+	be.ListPush([]byte("list"), []byte("a"))
+	if err := be.Rotate([]byte("list"), []byte("v")); err != ErrWrongType {
+		t.Error(errUnexpected(err))
+	}
+}
+
+func TestBoltDBSlowLog(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{
+		MaxKeysPerBucket: 1000,
+		SlowLogThreshold: time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	memory := logging.NewMemoryBackend(16)
+	logging.SetBackend(memory)
+	defer setLogger()
+
+	be.Set([]byte("slow"), []byte("value"))
+	be.Get([]byte("slow"))
+	be.Transaction(func(tx *Txn) error { return nil })
+
+	var logged []string
+	for n := memory.Head(); n != nil; n = n.Next() {
+		logged = append(logged, n.Record.Message())
+	}
+	if len(logged) != 3 || !strings.HasPrefix(logged[0], "Slow put of key slow took ") ||
+		!strings.HasPrefix(logged[1], "Slow get of key slow took ") || !strings.HasPrefix(logged[2], "Slow transaction took ") {
+		t.Fatal(errUnexpected(logged))
+	}
+
+	// disabled by default
+	be.opts.SlowLogThreshold = 0
+	be.Get([]byte("slow"))
+	if n := memory.Head().Next().Next(); n.Next() != nil {
+		t.Error(errUnexpected(n.Next().Record.Message()))
+	}
+}
+
+func TestBoltDBPutWithSource(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	var records []Record
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{
+		MaxKeysPerBucket: 1000,
+		EncryptionKey:    bytes.Repeat([]byte("k"), 32),
+		Replicate:        func(r Record) { records = append(records, r) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	if err := be.PutWithSource([]byte("audited"), []byte("value"), false, true, []byte("10.0.0.1:4242")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := be.Meta([]byte("audited"))
+	if err != nil || m == nil || string(m.Source) != "10.0.0.1:4242" || m.Size != 5 {
+		t.Fatal(errUnexpected(m))
+	}
+	if v, _ := be.Get([]byte("audited")); string(v) != "value" {
+		t.Error(errUnexpected(string(v)))
+	}
+	if len(records) != 1 || string(records[0].Source) != "10.0.0.1:4242" {
+		t.Error(errUnexpected(records))
+	}
+
+	// writes without a source clear it
+	be.Set([]byte("audited"), []byte("other"))
+	if m, _ := be.Meta([]byte("audited")); m == nil || m.Source != nil {
+		t.Error(errUnexpected(m))
+	}
+
+	if err := be.PutWithSource([]byte("audited"), []byte("value"), false, true, bytes.Repeat([]byte("s"), maxSourceSize+1)); err == nil {
+		t.Error("Oversized source stored")
+	}
+}
+
+func TestBoltDBAdminShell(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("beano"), []byte("clapton"))
+
+	if r := be.AdminCommand("bucketstats"); !strings.HasPrefix(r, "bucket=memcached items=1 ") || !strings.HasSuffix(r, "\nEND\n") {
+		t.Error(errUnexpected(r))
+	}
+	if r := be.AdminCommand("dump 10"); !strings.HasPrefix(r, "key=beano exp=-1 ") {
+		t.Error(errUnexpected(r))
+	}
+	if r := be.AdminCommand("compact memcached"); r != "OK\n" {
+		t.Error(errUnexpected(r))
+	}
+	if r := be.AdminCommand("compact"); !strings.HasPrefix(r, "ERROR ") {
+		t.Error(errUnexpected(r))
+	}
+	if r := be.AdminCommand("bogus"); r != "ERROR Unknown command \"bogus\"\n" {
+		t.Error(errUnexpected(r))
+	}
+
+	backup := filename + ".backup"
+	defer removeBoltDBFiles(backup)
+	if r := be.AdminCommand("backup " + backup); r != "OK\n" {
+		t.Fatal(errUnexpected(r))
+	}
+	copied, err := NewKVBoltDBBackend(backup, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := copied.Get([]byte("beano")); string(v) != "clapton" {
+		t.Error(errUnexpected(string(v)))
+	}
+	copied.Close()
+
+	sock := filename + ".sock"
+	admin, err := be.ServeAdmin(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != adminSocketMode {
+		t.Error(errUnexpected(fi))
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "flush\ndump\nquit\n")
+	reply, _ := ioutil.ReadAll(conn)
+	if string(reply) != "OK\nEND\n" {
+		t.Error(errUnexpected(string(reply)))
+	}
+
+	// a socket in use isn't taken over, a stale one is
+	if _, err := be.ServeAdmin(sock); err == nil {
+		t.Error("Admin socket in use replaced")
+	}
+	admin.Close()
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Error(errUnexpected(err))
+	}
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	if admin, err = be.ServeAdmin(sock); err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if conn, err := net.Dial("unix", sock); err != nil {
+		t.Error(err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestBoltDBIncrementConcurrent(t *testing.T) {
+	const writers, increments = 8, 100
+	for _, batch := range []bool{false, true} {
+		filename := tempBoltDBFile(t)
+		be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{
+			MaxKeysPerBucket: 1000,
+			BatchWrites:      batch,
+			BatchDelay:       100 * time.Microsecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		be.putEx(&InternalValue{key: []byte("ttl"), value: []byte("0"), expiration: 3600}, false, true, nil)
+
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < increments; i++ {
+					// the first increments race to create the counter
+					if _, err := be.Increment([]byte("counter"), 1, true); err != nil {
+						t.Error(err)
+					}
+					if _, err := be.Increment([]byte("ttl"), 1, false); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		if v, _ := be.Get([]byte("counter")); string(v) != strconv.Itoa(writers*increments) {
+			t.Error(batch, errUnexpected(string(v)))
+		}
+		if v, _ := be.Get([]byte("ttl")); string(v) != strconv.Itoa(writers*increments) {
+			t.Error(batch, errUnexpected(string(v)))
+		}
+		if m, _ := be.Meta([]byte("ttl")); m == nil || m.Expiration == 0 {
+			t.Error(batch, "Increment dropped the expiration")
+		}
+		be.Close()
+		removeBoltDBFiles(filename)
+	}
+}
+
+func TestBoltDBSnapshot(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	// writes while the snapshot is held must not grow the memory map
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{
+		MaxKeysPerBucket: 1000,
+		BoltOptions:      &bolt.Options{InitialMmapSize: 1 << 24},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("snap:a"), []byte("1"))
+	be.Set([]byte("snap:b"), []byte("2"))
+
+	snap, err := be.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+	be.Set([]byte("snap:a"), []byte("changed"))
+	be.Delete([]byte("snap:b"), false)
+	be.Set([]byte("snap:c"), []byte("3"))
+
+	if v, err := snap.Get([]byte("snap:a")); err != nil || string(v) != "1" {
+		t.Error(errUnexpected(string(v)))
+	}
+	if v, _ := snap.Get([]byte("snap:c")); v != nil {
+		t.Error(errUnexpected(string(v)))
+	}
+	r, err := snap.Range([]byte("snap:"), 0, nil, false)
+	if err != nil || len(r) != 2 || string(r["snap:b"]) != "2" {
+		t.Error(errUnexpected(r))
+	}
+	if v, _ := be.Get([]byte("snap:a")); string(v) != "changed" {
+		t.Error(errUnexpected(string(v)))
+	}
+
+	// an exclusive operation queued meanwhile doesn't block the holder's calls
+	done := make(chan error, 1)
+	go func() {
+		_, err := be.CompactExpirationIndex()
+		done <- err
+	}()
+	for i := 0; i < 10; i++ {
+		if _, err := be.Get([]byte("snap:a")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CompactExpirationIndex waited for the snapshot")
+	}
+
+	snap.Release()
+	snap.Release()
+
+	// Close releases the snapshots left
+	open, err := be.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Close()
+	if _, err := open.Get([]byte("snap:a")); err != ErrBackendClosed {
+		t.Error(errUnexpected(err))
+	}
+	open.Release()
+}
+
+func TestBoltDBExpirationJitter(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	if _, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{ExpirationJitter: 101}); err == nil {
+		t.Fatal("Jitter over 100% accepted")
+	}
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{
+		MaxKeysPerBucket: 1000,
+		ExpirationJitter: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	now := int(time.Now().Unix())
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		key := []byte("jitter" + strconv.Itoa(i))
+		be.putEx(&InternalValue{key: key, value: []byte("v"), expiration: 1000}, false, true, nil)
+		m, _ := be.Meta(key)
+		if m == nil || m.Expiration < now+900 || m.Expiration > now+1101 {
+			t.Fatal(errUnexpected(m))
+		}
+		seen[m.Expiration] = true
+	}
+	if len(seen) < 10 {
+		t.Error(errUnexpected(len(seen)))
+	}
+
+	// keys without an expiration keep none
+	be.Set([]byte("forever"), []byte("v"))
+	if m, _ := be.Meta([]byte("forever")); m == nil || m.Expiration != 0 {
+		t.Error(errUnexpected(m))
+	}
+}
+
+func TestBoltDBFlushAfter(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{
+		MaxKeysPerBucket: 10000,
+		ManualReaper:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	// more keys than a batch, one expiring sooner than the flush
+	for i := 0; i < flushAfterBatch+10; i++ {
+		be.Set([]byte("old"+strconv.Itoa(i)), []byte("v"))
+	}
+	be.putEx(&InternalValue{key: []byte("sooner"), value: []byte("v"), expiration: 5}, false, true, nil)
+	if err := be.FlushAfter(60); err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("new"), []byte("v"))
+
+	now := time.Now()
+	for _, key := range []string{"old0", "old" + strconv.Itoa(flushAfterBatch+9)} {
+		if m, _ := be.Meta([]byte(key)); m == nil || m.Expiration < int(now.Unix())+59 || m.Expiration > int(now.Unix())+60 {
+			t.Error(key, errUnexpected(m))
+		}
+	}
+	if v, _ := be.Get([]byte("old0")); string(v) != "v" {
+		t.Error(errUnexpected(string(v)))
+	}
+	if n, err := be.reapExpired(now.Add(61 * time.Second)); err != nil || n != flushAfterBatch+11 {
+		t.Error(errUnexpected(n))
+	}
+	if m, _ := be.Meta([]byte("new")); m == nil || m.Expiration != 0 {
+		t.Error(errUnexpected(m))
+	}
+}
+
+func TestBoltDBFlushAfterPaused(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{
+		MaxKeysPerBucket: 100,
+		ManualReaper:     true,
+		FailPausedWrites: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("beano"), []byte("v"))
+
+	if err := be.PauseWrites(); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.FlushAfter(60); err != ErrWritesPaused {
+		t.Error(errUnexpected(err))
+	}
+	if m, _ := be.Meta([]byte("beano")); m == nil || m.Expiration != 0 {
+		t.Error(errUnexpected(m))
+	}
+	be.ResumeWrites()
+	if err := be.FlushAfter(60); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := be.Meta([]byte("beano")); m == nil || m.Expiration == 0 {
+		t.Error(errUnexpected(m))
+	}
+}
+
+func TestBoltDBApproxKeyCount(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		be.Set([]byte("count"+strconv.Itoa(i)), []byte("v"))
+	}
+	// overwrites aren't counted again
+	be.Set([]byte("count0"), []byte("w"))
+	for i := 0; i < 100; i++ {
+		be.Delete([]byte("count"+strconv.Itoa(i)), false)
+	}
+	if n := be.ApproxKeyCount(); n < 390 || n > 400 {
+		t.Error(errUnexpected(n))
+	}
+
+	// rebuilt on reopen from the keys on disk
+	be.Close()
+	be, err = NewKVBoltDBBackend(filename, "memcached", 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if n := be.ApproxKeyCount(); n < 390 || n > 400 {
+		t.Error(errUnexpected(n))
+	}
+	be.Flush()
+	if n := be.ApproxKeyCount(); n != 0 {
+		t.Error(errUnexpected(n))
+	}
+
+	if n := NewPessimisticBloomFilterKeys(10).ApproxCount(); n != -1 {
+		t.Error(errUnexpected(n))
+	}
+}
+
+func TestBoltDBBucketFiles(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer func() {
+		removeBoltDBFiles(filename)
+		os.Remove(bucketFilename(filename, "a"))
+		os.Remove(bucketFilename(filename, "b/c"))
+	}()
+	opts := BackendOptions{MaxKeysPerBucket: 1000, BucketFiles: true}
+	be, err := NewKVBoltDBBackendWithOptions(filename, "a", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("key"), []byte("in a"))
+	if err := be.SwitchBucket("b/c"); err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("key"), []byte("in b/c"))
+	for _, name := range []string{"a", "b/c"} {
+		if _, err := os.Stat(bucketFilename(filename, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	stats, err := be.AllBucketStats()
+	if err != nil || stats["a"].Items != 1 || stats["b/c"].Items != 1 {
+		t.Error(errUnexpected(stats))
+	}
+
+	// a write transaction open on a doesn't block writes to b/c
+	locked, release := make(chan struct{}), make(chan struct{})
+	go be.files["a"].Update(func(tx *bolt.Tx) error {
+		close(locked)
+		<-release
+		return nil
+	})
+	<-locked
+	applied := make(chan error)
+	go func() {
+		applied <- be.ApplyReplicationRecord(Record{Op: RecordSet, Bucket: "b/c", Key: []byte("other"), Value: []byte("v"), Modified: time.Now().UnixNano()})
+	}()
+	select {
+	case err := <-applied:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Write to b/c waited for a")
+	}
+	close(release)
+	be.Close()
+
+	be, err = NewKVBoltDBBackendWithOptions(filename, "a", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if v, _ := be.Get([]byte("key")); string(v) != "in a" {
+		t.Error(errUnexpected(string(v)))
+	}
+	be.SwitchBucket("b/c")
+	if v, _ := be.Get([]byte("other")); string(v) != "v" {
+		t.Error(errUnexpected(string(v)))
+	}
+	if err := be.Reopen(filename); err == nil {
+		t.Error("Reopen with BucketFiles")
+	}
+
+	// a bucket file locked elsewhere times out, without holding up the open buckets
+	held := bucketFilename(filename, "held")
+	defer os.Remove(held)
+	other, err := bolt.Open(held, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	be.opts.BoltOptions = &bolt.Options{Timeout: 200 * time.Millisecond}
+	opened := make(chan error)
+	go func() {
+		_, err := be.dbFor("held")
+		opened <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if db, err := be.dbFor("a"); err != nil || db != be.files["a"] {
+		t.Error(errUnexpected(err))
+	}
+	if err := <-opened; err != bolt.ErrTimeout {
+		t.Error(errUnexpected(err))
+	}
+}
+
+func TestBoltDBMaxRangeResults(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{
+		MaxKeysPerBucket: 1000,
+		MaxRangeResults:  5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	for i := 0; i < 12; i++ {
+		be.Set([]byte(fmt.Sprintf("cap%02d", i)), []byte("v"))
+	}
+
+	if r, err := be.Range([]byte("cap"), 0, nil, false); err != nil || len(r) != 5 {
+		t.Error(errUnexpected(r))
+	}
+	if r, truncated, _ := be.RangeTruncated([]byte("cap"), 0, nil, false); len(r) != 5 || !truncated {
+		t.Error(errUnexpected(truncated))
+	}
+	if r, truncated, _ := be.RangeTruncated([]byte("cap"), 3, nil, false); len(r) != 3 || truncated {
+		t.Error(errUnexpected(truncated))
+	}
+	// exactly the cap left isn't a truncation
+	if r, truncated, _ := be.RangeTruncated([]byte("cap"), 0, []byte("cap06"), false); len(r) != 5 || truncated {
+		t.Error(errUnexpected(truncated))
+	}
+
+	// capped pages carry on
+	seen := 0
+	token := ""
+	for pages := 0; pages < 10; pages++ {
+		r, next, err := be.RangePage([]byte("cap"), 100, token, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen += len(r)
+		if token = next; token == "" {
+			break
+		}
+	}
+	if seen != 12 {
+		t.Error(errUnexpected(seen))
+	}
+}
+
+func TestBoltDBBloomCheckpoint(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	opts := BackendOptions{MaxKeysPerBucket: 1000, ChangeIndex: true, BloomCheckpointInterval: time.Hour}
+	if _, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{BloomCheckpointWrites: 10}); err == nil {
+		t.Fatal("Checkpoints without ChangeIndex should be rejected")
+	}
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		be.Set([]byte(fmt.Sprintf("before%d", i)), []byte("clapton"))
+	}
+	if err := be.CheckpointBlooms(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		be.Set([]byte(fmt.Sprintf("after%d", i)), []byte("clapton"))
+	}
+	// a replicated write indexed before the checkpoint mark
+	old := Record{Op: RecordSet, Bucket: "memcached", Key: []byte("replicated"), Value: []byte("clapton"), CAS: 1, Modified: time.Now().Add(-2 * time.Hour).UnixNano()}
+	if err := be.ApplyReplicationRecord(old); err != nil {
+		t.Fatal(err)
+	}
+	be.Close()
+
+	memory := logging.NewMemoryBackend(16)
+	logging.SetBackend(memory)
+	defer setLogger()
+	restored := func() bool {
+		for n := memory.Head(); n != nil; n = n.Next() {
+			if strings.Contains(n.Record.Message(), "restored from checkpoint") {
+				return true
+			}
+		}
+		return false
+	}
+
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored() {
+		t.Fatal("Bloom filter not restored from the checkpoint")
+	}
+	for _, key := range []string{"before0", "before49", "after0", "after19", "replicated"} {
+		if v, err := be.Get([]byte(key)); err != nil || string(v) != "clapton" {
+			t.Fatal(errUnexpected(key + ": " + string(v)))
+		}
+	}
+	if n := be.ApproxKeyCount(); n != 71 {
+		t.Error(errUnexpected(n))
+	}
+	be.Close()
+
+	// a session without checkpoints drops them
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("unindexed"), []byte("clapton"))
+	be.Close()
+	memory = logging.NewMemoryBackend(16)
+	logging.SetBackend(memory)
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if restored() {
+		t.Fatal("Stale checkpoint restored")
+	}
+	if v, err := be.Get([]byte("unindexed")); err != nil || string(v) != "clapton" {
+		t.Fatal(errUnexpected(string(v)))
+	}
+}
+
+func TestBoltDBVerifyBloom(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	be.Set([]byte("eric"), []byte("clapton"))
+	be.Set([]byte("gone"), []byte("clapton"))
+	be.Delete([]byte("gone"), false)
+	if missed, err := be.VerifyBloom(); err != nil || len(missed) != 0 {
+		t.Fatal(errUnexpected(missed))
+	}
+
+	// a row written behind the backend's back never reaches the filter
+	be.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("memcached")).Put([]byte("hidden"), encodeValue(&InternalValue{key: []byte("hidden"), value: []byte("clapton")}))
+	})
+	missed, err := be.VerifyBloom()
+	if err != nil || len(missed) != 1 || string(missed[0]) != "hidden" {
+		t.Fatal(errUnexpected(missed))
+	}
+	if out := be.AdminCommand("verifybloom"); out != "hidden\nEND\n" {
+		t.Error(errUnexpected(out))
+	}
+}
+
+func TestBoltDBOpenNewFile(t *testing.T) {
+	for _, create := range []bool{false, true} {
+		filename := tempBoltDBFile(t)
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Fatal(errUnexpected(err))
+		}
+		be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, CreateBucket: create})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := be.AllBucketStats()
+		if _, listed := stats["memcached"]; err != nil || listed != create {
+			t.Error(errUnexpected(stats))
+		}
+		if v, err := be.Get([]byte("eric")); err != nil || v != nil {
+			t.Error(errUnexpected(v))
+		}
+		if err := be.Set([]byte("eric"), []byte("clapton")); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := be.Get([]byte("eric")); err != nil || string(v) != "clapton" {
+			t.Error(errUnexpected(string(v)))
+		}
+		be.Close()
+		removeBoltDBFiles(filename)
+	}
+}
+
+// fixedHash is a hash.Hash64 summing every key to itself
+type fixedHash uint64
+
+func (h fixedHash) Write(p []byte) (int, error) { return len(p), nil }
+func (h fixedHash) Sum(b []byte) []byte         { return b }
+func (h fixedHash) Reset()                      {}
+func (h fixedHash) Size() int                   { return 8 }
+func (h fixedHash) BlockSize() int              { return 1 }
+func (h fixedHash) Sum64() uint64               { return uint64(h) }
+
+func TestBoltDBBloomDegenerateHash(t *testing.T) {
+	f := newCountingFilter(1000, 0.01, nil)
+	// a second hash multiple of m still spreads the k hashes
+	f.hash = fixedHash(uint64(f.m)<<32 | 5)
+	f.Add([]byte("eric"))
+	set := 0
+	for i := uint32(0); i < f.m; i++ {
+		if f.counter(i) != 0 {
+			set++
+		}
+	}
+	if set != int(f.k) {
+		t.Error(errUnexpected(set))
+	}
+	if !f.Test([]byte("eric")) {
+		t.Error("added key not found")
+	}
+}
+
+func TestBoltDBBloomHash(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	var made int32
+	newHash := func() hash.Hash64 {
+		atomic.AddInt32(&made, 1)
+		return fnv.New64()
+	}
+	opts := BackendOptions{MaxKeysPerBucket: 1000, BloomShards: 4, BloomHash: newHash, ChangeIndex: true, BloomCheckpointWrites: 1000}
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if made != 4 {
+		t.Error(errUnexpected(made))
+	}
+	for i := 0; i < 100; i++ {
+		be.Set([]byte(fmt.Sprintf("key%d", i)), []byte("clapton"))
+	}
+	if v, err := be.Get([]byte("key42")); err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(string(v)))
+	}
+	if missed, err := be.VerifyBloom(); err != nil || len(missed) != 0 {
+		t.Error(errUnexpected(missed))
+	}
+	if err := be.CheckpointBlooms(); err != nil {
+		t.Fatal(err)
+	}
+	be.Close()
+
+	// a checkpoint saved with another hash is scanned over
+	memory := logging.NewMemoryBackend(16)
+	logging.SetBackend(memory)
+	defer setLogger()
+	opts.BloomHash = nil
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if n := memory.Head(); n == nil || !strings.Contains(n.Record.Message(), "another hash") {
+		t.Error(errUnexpected(n))
+	}
+	if missed, err := be.VerifyBloom(); err != nil || len(missed) != 0 {
+		t.Error(errUnexpected(missed))
+	}
+}
+
+func TestBoltDBRangeMulti(t *testing.T) {
+	for _, files := range []bool{false, true} {
+		filename := tempBoltDBFile(t)
+		be, err := NewKVBoltDBBackendWithOptions(filename, "left", BackendOptions{MaxKeysPerBucket: 1000, BucketFiles: files})
+		if err != nil {
+			t.Fatal(err)
+		}
+		be.Set([]byte("user:1"), []byte("eric"))
+		be.Set([]byte("user:2"), []byte("jimi"))
+		be.Set([]byte("other"), []byte("clapton"))
+		be.SwitchBucket("right")
+		be.Set([]byte("user:3"), []byte("jeff"))
+
+		ret, err := be.RangeMulti([]string{"left", "right", "missing"}, []byte("user:"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ret) != 2 || len(ret["left"]) != 2 || string(ret["left"]["user:2"]) != "jimi" || string(ret["right"]["user:3"]) != "jeff" {
+			t.Error(errUnexpected(ret))
+		}
+		if _, ok := ret["missing"]; ok {
+			t.Error(errUnexpected(ret))
+		}
+		if ret, _ := be.RangeMulti([]string{"left", "right"}, []byte("user:"), 1); len(ret["left"]) != 1 || len(ret["right"]) != 1 {
+			t.Error(errUnexpected(ret))
+		}
+		be.Close()
+		removeBoltDBFiles(filename)
+		os.Remove(bucketFilename(filename, "left"))
+		os.Remove(bucketFilename(filename, "right"))
+	}
+}
+
+func TestBoltDBIncrementCapped(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	key := []byte("quota")
+	var wg sync.WaitGroup
+	var granted int32
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				v, capped, err := be.IncrementCapped(key, 1, 100)
+				if err != nil || v > 100 {
+					t.Error(errUnexpected(v))
+					return
+				}
+				if !capped {
+					atomic.AddInt32(&granted, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := be.Get(key); string(v) != "100" || granted != 100 {
+		t.Fatal(errUnexpected(fmt.Sprintf("%s, %d granted", v, granted)))
+	}
+
+	// a delta past the ceiling stops at it, decrements stay under it
+	if v, capped, err := be.IncrementCapped([]byte("fresh"), 50, 10); err != nil || v != 10 || !capped {
+		t.Error(errUnexpected(v))
+	}
+	if v, capped, err := be.IncrementCapped([]byte("fresh"), -3, 10); err != nil || v != 7 || capped {
+		t.Error(errUnexpected(v))
+	}
+	// a lowered max brings the counter down
+	if v, capped, err := be.IncrementCapped(key, 0, 40); err != nil || v != 40 || !capped {
+		t.Error(errUnexpected(v))
+	}
+	if _, _, err := be.IncrementCapped(key, 1, -1); err == nil {
+		t.Error("negative max accepted")
+	}
+}
+
+func TestBoltDBTopKeysBySize(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	for i := 1; i <= 20; i++ {
+		be.Set([]byte(fmt.Sprintf("key%d", i)), bytes.Repeat([]byte("x"), i*10))
+	}
+	be.Delete([]byte("key20"), false)
+	top, err := be.TopKeysBySize(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 3 || string(top[0].Key) != "key19" || top[0].Size != 190 || string(top[2].Key) != "key17" {
+		t.Error(errUnexpected(top))
+	}
+	if top, _ := be.TopKeysBySize(100); len(top) != 19 || top[18].Size != 10 {
+		t.Error(errUnexpected(top))
+	}
+}
+
+func TestBoltDBDisabledOperations(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	if _, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{DisabledOperations: []string{"drop"}}); err == nil {
+		t.Fatal("Unknown operation accepted")
+	}
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, DisabledOperations: []string{OpFlush, OpDelete}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	be.Set([]byte("eric"), []byte("clapton"))
+	if err := be.Flush(); err != ErrOperationDisabled {
+		t.Error(errUnexpected(err))
+	}
+	if err := be.FlushAfter(10); err != ErrOperationDisabled {
+		t.Error(errUnexpected(err))
+	}
+	if _, err := be.Delete([]byte("eric"), false); err != ErrOperationDisabled {
+		t.Error(errUnexpected(err))
+	}
+	err = be.Transaction(func(tx *Txn) error {
+		_, err := tx.Delete([]byte("eric"))
+		return err
+	})
+	if err != ErrOperationDisabled {
+		t.Error(errUnexpected(err))
+	}
+	if out := be.AdminCommand("flush"); out != "ERROR Operation disabled\n" {
+		t.Error(errUnexpected(out))
+	}
+	if v, err := be.Get([]byte("eric")); err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(string(v)))
+	}
+	// other operations are unaffected
+	if err := be.CompactBucket("memcached"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBoltDBMultiCAS(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	casA, _ := be.SetCAS([]byte("a"), []byte("1"))
+	casB, _ := be.SetCAS([]byte("b"), []byte("1"))
+	ok, err := be.MultiCAS([]CASUpdate{{Key: []byte("a"), Value: []byte("2"), CAS: casA}, {Key: []byte("b"), Value: []byte("2"), CAS: casB}, {Key: []byte("c"), Value: []byte("2")}})
+	if !ok || err != nil {
+		t.Fatal(err)
+	}
+
+	// b changed since: nothing is written
+	ok, err = be.MultiCAS([]CASUpdate{{Key: []byte("a"), Value: []byte("3"), CAS: casA + 2}, {Key: []byte("b"), Value: []byte("3"), CAS: casB}})
+	mismatch, isMismatch := err.(*CASMismatchError)
+	if ok || !isMismatch || string(mismatch.Key) != "b" {
+		t.Fatal(errUnexpected(err))
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if v, _ := be.Get([]byte(key)); string(v) != "2" {
+			t.Error(errUnexpected(key + "=" + string(v)))
+		}
+	}
+}
+
+func TestBoltDBMultiSet(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	entries := func(n int, bigAt int) []KeyValue {
+		ret := make([]KeyValue, n)
+		for i := range ret {
+			ret[i] = KeyValue{Key: []byte(fmt.Sprintf("multi:%d", i)), Value: []byte("x")}
+		}
+		if bigAt >= 0 {
+			ret[bigAt].Value = []byte("too big")
+		}
+		return ret
+	}
+	for _, batch := range []int{0, 3} {
+		be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, MultiSetBatch: batch, MaxMultiSet: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		be.ConfigureBucket("memcached", BucketConfig{MaxValueSize: 4})
+		be.Flush()
+
+		if n, err := be.MultiSet(entries(11, -1)); err == nil || n != 0 {
+			t.Error(errUnexpected(n))
+		}
+		if n, err := be.MultiSet(entries(10, -1)); err != nil || n != 10 {
+			t.Error(errUnexpected(err))
+		}
+		be.Flush()
+		// atomic, the error leaves nothing. In batches of 3 the first 2 are kept
+		n, err := be.MultiSet(entries(8, 7))
+		written := 0
+		if batch > 0 {
+			written = 6
+		}
+		if err == nil || n != written {
+			t.Errorf("batch %d: expected %d written with an error, got %d, %v", batch, written, n, err)
+		}
+		for i := 0; i < 8; i++ {
+			v, _ := be.Get([]byte(fmt.Sprintf("multi:%d", i)))
+			if (i < written) != (v != nil) {
+				t.Errorf("batch %d: unexpected value %q of multi:%d", batch, v, i)
+			}
+		}
+		be.Close()
+	}
+}
+
+func TestBoltDBKeyAgeRange(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, ChangeIndex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	if oldest, newest, err := be.KeyAgeRange(); err != nil || !oldest.IsZero() || !newest.IsZero() {
+		t.Fatal(errUnexpected(err))
+	}
+	start := time.Now()
+	be.Set([]byte("deleted"), []byte("clapton"))
+	be.Set([]byte("old"), []byte("clapton"))
+	middle := time.Now()
+	be.Set([]byte("new"), []byte("clapton"))
+	be.Set([]byte("gone"), []byte("clapton"))
+	be.Delete([]byte("gone"), false)
+	be.Delete([]byte("deleted"), false)
+	oldest, newest, err := be.KeyAgeRange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldest.Before(start) || oldest.After(middle) || !newest.After(middle) || newest.After(time.Now()) {
+		t.Error(errUnexpected(fmt.Sprintf("%s %s", oldest, newest)))
+	}
+
+	be.opts.ChangeIndex = false
+	if _, _, err := be.KeyAgeRange(); err == nil {
+		t.Error("KeyAgeRange without ChangeIndex should fail")
+	}
+}
+
+func TestBoltDBSecondaryIndex(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	// the attribute is the text before the first comma, values without one aren't indexed
+	city := func(value []byte) []byte {
+		if i := bytes.IndexByte(value, ','); i >= 0 {
+			return value[:i]
+		}
+		return nil
+	}
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, EncryptionKey: bytes.Repeat([]byte("k"), 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := be.CreateIndex("city", city); err == nil {
+		t.Error("Index created with EncryptionKey")
+	}
+	be.Close()
+	removeBoltDBFiles(filename)
+
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, ManualReaper: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("eric"), []byte("london,guitar"))
+	if _, err := be.QueryIndex("city", []byte("london")); err == nil {
+		t.Error("Query of an unknown index should fail")
+	}
+	if err := be.CreateIndex("city", city); err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("jimi"), []byte("seattle,guitar"))
+	be.Set([]byte("jeff"), []byte("london,guitar"))
+	be.Set([]byte("ringo"), []byte("liverpool"))
+	query := func(attr string) string {
+		keys, err := be.QueryIndex("city", []byte(attr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(bytes.Join(keys, []byte(" ")))
+	}
+	if got := query("london"); got != "eric jeff" {
+		t.Error(errUnexpected(got))
+	}
+
+	// a rewrite moves the key, a delete drops it, a failed transaction leaves the index alone
+	be.Set([]byte("eric"), []byte("surrey,guitar"))
+	be.Delete([]byte("jimi"), false)
+	be.Transaction(func(tx *Txn) error {
+		tx.Put([]byte("jeff"), []byte("paris,guitar"))
+		return fmt.Errorf("rolled back")
+	})
+	if got := query("london") + "|" + query("surrey") + "|" + query("seattle") + "|" + query("liverpool"); got != "jeff|eric||" {
+		t.Error(errUnexpected(got))
+	}
+
+	// keys deleted by the reaper or FlushExcept leave no entry behind
+	indexed := func(key string) (attr []byte) {
+		be.db.View(func(tx *bolt.Tx) error {
+			if _, keys, _ := valueIndexes(tx, "memcached", "city", false); keys != nil {
+				attr = keys.Get([]byte(key))
+			}
+			return nil
+		})
+		return attr
+	}
+	be.putEx(&InternalValue{key: []byte("brian"), value: []byte("london,guitar"), expiration: -1}, false, true, nil)
+	be.Set([]byte("keith"), []byte("dartford,guitar"))
+	if indexed("brian") == nil || indexed("keith") == nil {
+		t.Fatal("keys not indexed")
+	}
+	if _, err := be.reapExpired(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := be.FlushExcept([][]byte{[]byte("eric"), []byte("jeff")}); err != nil {
+		t.Fatal(err)
+	}
+	if indexed("brian") != nil || indexed("keith") != nil || indexed("eric") == nil {
+		t.Error(errUnexpected(string(indexed("brian")) + "|" + string(indexed("keith"))))
+	}
+	if got := query("london") + "|" + query("surrey"); got != "jeff|eric" {
+		t.Error(errUnexpected(got))
+	}
+	if err := be.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := query("london"); got != "" {
+		t.Error(errUnexpected(got))
+	}
+}
+
+func TestBoltDBPauseWrites(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, CoalesceInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	// buffered Sets are flushed by the pause, reads go on
+	be.Set([]byte("eric"), []byte("clapton"))
+	if err := be.PauseWrites(); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.PauseWrites(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := be.Get([]byte("eric")); err != nil || string(v) != "clapton" {
+		t.Fatal(errUnexpected(string(v)), err)
+	}
+
+	done := make(chan error, 2)
+	go func() { done <- be.Set([]byte("jimi"), []byte("hendrix")) }()
+	go func() {
+		_, err := be.Delete([]byte("eric"), false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatal(errUnexpected(err))
+	case <-time.After(50 * time.Millisecond):
+	}
+	if v, _ := be.Get([]byte("eric")); string(v) != "clapton" {
+		t.Fatal(errUnexpected(string(v)))
+	}
+	be.ResumeWrites()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, _ := be.Get([]byte("jimi")); string(v) != "hendrix" {
+		t.Error(errUnexpected(string(v)))
+	}
+	if v, _ := be.Get([]byte("eric")); v != nil {
+		t.Error(errUnexpected(string(v)))
+	}
+
+	// paused writes give up after the timeout, or at once with FailPausedWrites
+	be.opts.PausedWriteTimeout = 20 * time.Millisecond
+	be.PauseWrites()
+	if err := be.Set([]byte("jimi"), []byte("page")); err != ErrWritesPaused {
+		t.Error(errUnexpected(err))
+	}
+	be.opts.FailPausedWrites = true
+	start := time.Now()
+	if _, err := be.Incr([]byte("counter"), 1); err != ErrWritesPaused || time.Since(start) > 10*time.Millisecond {
+		t.Error(errUnexpected(err))
+	}
+	be.ResumeWrites()
+	if err := be.Set([]byte("jimi"), []byte("page")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBoltDBApplyPatch(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	old := []byte(`{"name":"eric","band":"cream","year":1966}`)
+	new := []byte(`{"name":"eric","band":"derek and the dominos","year":1970}`)
+	patch := MakePatch(old, new)
+	if err := be.ApplyPatch([]byte("eric"), patch); err != ErrKeyNotFound {
+		t.Error(errUnexpected(err))
+	}
+	be.Set([]byte("eric"), old)
+	if err := be.ApplyPatch([]byte("eric"), patch); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := be.Get([]byte("eric")); !bytes.Equal(v, new) {
+		t.Error(errUnexpected(string(v)))
+	}
+
+	// applying it twice, to the patched value, is refused
+	if err := be.ApplyPatch([]byte("eric"), patch); err != ErrBadPatch {
+		t.Error(errUnexpected(err))
+	}
+	for _, bad := range [][]byte{nil, {patchVersion}, patch[:len(patch)-1], append(MakePatch(new, new), patchInsert, 1, 'x'), append(MakePatch(new, nil), 7)} {
+		if err := be.ApplyPatch([]byte("eric"), bad); err != ErrBadPatch {
+			t.Error(errUnexpected(bad), err)
+		}
+	}
+	if v, _ := be.Get([]byte("eric")); !bytes.Equal(v, new) {
+		t.Error(errUnexpected(string(v)))
+	}
+	if err := be.ApplyPatch([]byte("eric"), MakePatch(new, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := be.Get([]byte("eric")); v == nil || len(v) != 0 {
+		t.Error(errUnexpected(v))
+	}
+}
+
+func TestBoltDBAsyncBloom(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 30000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = be.Transaction(func(tx *Txn) error {
+		for i := 0; i < 2*warmBloomBatch+500; i++ {
+			if err := tx.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Close()
+
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 30000, AsyncBloom: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	// served while warming, a lookup and writes during the scan
+	last := []byte(fmt.Sprintf("key%d", 2*warmBloomBatch+499))
+	if v, err := be.Get(last); err != nil || string(v) != "value" {
+		t.Fatal(errUnexpected(string(v)), err)
+	}
+	be.Set([]byte("fresh"), []byte("value"))
+	be.Delete([]byte("key0"), false)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for be.keyCache["memcached"].Pessimistic() {
+		if time.Now().After(deadline) {
+			t.Fatal("bloom filter still warming up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	bf := be.keyCache["memcached"]
+	for _, key := range [][]byte{last, []byte("key1"), []byte("fresh")} {
+		if !bf.Test(key) {
+			t.Error(errUnexpected(string(key)))
+		}
+	}
+	if v, _ := be.Get([]byte("key0")); v != nil {
+		t.Error(errUnexpected(string(v)))
+	}
+	if n := bf.ApproxCount(); n < 2*warmBloomBatch {
+		t.Error(errUnexpected(n))
+	}
+}
+
+func TestBoltDBCompactExpirationIndex(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, ManualReaper: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	for _, k := range []string{"alive", "deleted", "persisted", "extended"} {
+		be.putEx(&InternalValue{key: []byte(k), value: []byte("v"), expiration: 3600}, false, true, nil)
+	}
+	be.Delete([]byte("deleted"), false)
+	be.Set([]byte("persisted"), []byte("v"))
+	be.putEx(&InternalValue{key: []byte("extended"), value: []byte("v"), expiration: 7200}, false, true, nil)
+
+	if removed, err := be.CompactExpirationIndex(); err != nil || removed != 3 {
+		t.Fatal(errUnexpected(removed), err)
+	}
+	entries := 0
+	be.expirationdb.View(func(tx *bolt.Tx) error {
+		entries = tx.Bucket([]byte("memcached")).Stats().KeyN
+		return nil
+	})
+	if entries != 2 {
+		t.Error(errUnexpected(entries))
+	}
+	if removed, err := be.CompactExpirationIndex(); err != nil || removed != 0 {
+		t.Error(errUnexpected(removed), err)
+	}
+	if _, err := os.Stat(filename + expirationDBSuffix + compactSuffix); !os.IsNotExist(err) {
+		t.Error(errUnexpected(err))
+	}
+
+	// the new index file takes writes and feeds the reaper
+	be.putEx(&InternalValue{key: []byte("expired"), value: []byte("v"), expiration: -1}, false, true, nil)
+	if n, err := be.reapExpired(time.Now()); err != nil || n != 1 {
+		t.Error(errUnexpected(n), err)
+	}
+	if v, _ := be.Get([]byte("extended")); string(v) != "v" {
+		t.Error(errUnexpected(string(v)))
+	}
+}
+
+func TestBoltDBRepairExpirationIndex(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	opts := BackendOptions{MaxKeysPerBucket: 1000, ManualReaper: true}
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a crash between the commit of the data and the index of its expiration
+	crash := func() {
+		be.indexExpiration("memcached", []byte("gone"), int(time.Now().Unix())-10)
+		be.putEx(&InternalValue{key: []byte("unindexed"), value: []byte("v"), expiration: -1}, false, true, nil)
+		be.expirationdb.Update(func(tx *bolt.Tx) error {
+			index := tx.Bucket([]byte("memcached"))
+			c := index.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				if string(k[8:]) == "unindexed" {
+					return index.Delete(k)
+				}
+			}
+			return nil
+		})
+	}
+	crash()
+	be.putEx(&InternalValue{key: []byte("alive"), value: []byte("v"), expiration: 3600}, false, true, nil)
+	if keys, _ := be.ExpiredKeys(0); len(keys) != 0 {
+		t.Fatal(errUnexpected(keys))
+	}
+
+	if removed, err := be.RepairExpirationIndex(); err != nil || removed != 1 {
+		t.Fatal(errUnexpected(removed), err)
+	}
+	if keys, _ := be.ExpiredKeys(0); len(keys) != 1 || string(keys[0]) != "unindexed" {
+		t.Error(errUnexpected(keys))
+	}
+	if removed, err := be.RepairExpirationIndex(); err != nil || removed != 0 {
+		t.Error(errUnexpected(removed), err)
+	}
+	if n, err := be.reapExpired(time.Now()); err != nil || n != 1 {
+		t.Error(errUnexpected(n), err)
+	}
+	if v, _ := be.Get([]byte("alive")); string(v) != "v" {
+		t.Error(errUnexpected(string(v)))
+	}
+
+	crash()
+	be.Close()
+	opts.RepairExpirationsOnOpen = true
+	be, err = NewKVBoltDBBackendWithOptions(filename, "memcached", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if n, err := be.reapExpired(time.Now()); err != nil || n != 1 {
+		t.Error(errUnexpected(n), err)
+	}
+	if removed, err := be.RepairExpirationIndex(); err != nil || removed != 0 {
+		t.Error(errUnexpected(removed), err)
+	}
+}
+
+func TestBoltDBChangeFeed(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, ManualReaper: true, ChangeLog: true, ChangeLogRetention: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	next := func(ch <-chan Change) Change {
+		select {
+		case c := <-ch:
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("no change")
+		}
+		return Change{}
+	}
+	be.Set([]byte("eric"), []byte("clapton"))
+	be.Set([]byte("jimi"), []byte("hendrix"))
+	be.Delete([]byte("eric"), false)
+
+	// replay, then the live tail
+	feed, err := be.ChangeFeed(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"set eric clapton", "set jimi hendrix", "delete eric "} {
+		c := next(feed)
+		if got := fmt.Sprintf("%s %s %s", c.Op, c.Key, c.Value); c.Cursor != Cursor(i+1) || got != want || c.Bucket != "memcached" {
+			t.Error(errUnexpected(c))
+		}
+	}
+	be.Set([]byte("jimmy"), []byte("page"))
+	if c := next(feed); c.Cursor != 4 || string(c.Key) != "jimmy" {
+		t.Error(errUnexpected(c))
+	}
+	be.CloseChangeFeed(feed)
+	if _, open := <-feed; open {
+		t.Error("feed not closed")
+	}
+
+	resumed, err := be.ChangeFeed(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := next(resumed); c.Cursor != 3 || c.Op != RecordDelete {
+		t.Error(errUnexpected(c))
+	}
+	if c := next(resumed); c.Cursor != 4 {
+		t.Error(errUnexpected(c))
+	}
+
+	// changes past the retention are trimmed, resuming before them fails
+	if _, err := be.reap(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := be.ChangeFeed(1); err != ErrCursorTrimmed {
+		t.Error(errUnexpected(err))
+	}
+	tail, err := be.ChangeFeed(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("eric"), []byte("johnson"))
+	if c := next(tail); c.Cursor != 5 || string(c.Value) != "johnson" {
+		t.Error(errUnexpected(c))
+	}
+	if c := next(resumed); c.Cursor != 5 {
+		t.Error(errUnexpected(c))
+	}
+	be.Close()
+	if _, open := <-tail; open {
+		t.Error("feed not closed by Close")
+	}
+}
+
+func TestBoltDBNextSequence(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := be.NextSequence(nil); err == nil {
+		t.Error("empty sequence name accepted")
+	}
+	var wg sync.WaitGroup
+	seen := make(chan uint64, 200)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				seq, err := be.NextSequence([]byte("orders"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				seen <- seq
+			}
+		}()
+	}
+	wg.Wait()
+	close(seen)
+	unique := make(map[uint64]bool)
+	for seq := range seen {
+		if unique[seq] || seq < 1 || seq > 200 {
+			t.Error(errUnexpected(seq))
+		}
+		unique[seq] = true
+	}
+	if seq, err := be.NextSequence([]byte("users")); err != nil || seq != 1 {
+		t.Error(errUnexpected(seq), err)
+	}
+	be.Flush()
+	be.Close()
+
+	// sequences are durable and left alone by Flush
+	be, err = NewKVBoltDBBackend(filename, "memcached", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if seq, err := be.NextSequence([]byte("orders")); err != nil || seq != 201 {
+		t.Error(errUnexpected(seq), err)
+	}
+	if v, _ := be.Get([]byte("orders")); v != nil {
+		t.Error(errUnexpected(v))
+	}
+}
+
+func TestBoltDBCompression(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, Compress: true, EncryptionKey: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	text := []byte(strings.Repeat("beano clapton bluesbreakers ", 200))
+	noise := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(noise)
+	be.Set([]byte("text"), text)
+	be.Set([]byte("noise"), noise)
+	be.Set([]byte("short"), []byte("clapton"))
+
+	stored := func(key string) *InternalValue {
+		var iv *InternalValue
+		be.db.View(func(tx *bolt.Tx) error {
+			var err error
+			if iv, err = decodeValue([]byte(key), tx.Bucket([]byte("memcached")).Get([]byte(key))); err != nil {
+				t.Error(err)
+			}
+			return nil
+		})
+		return iv
+	}
+	if iv := stored("text"); iv.plainLen != len(text) || len(iv.value) >= len(text)/2 {
+		t.Error(errUnexpected(len(iv.value)))
+	}
+	if iv := stored("noise"); iv.plainLen != 0 {
+		t.Error(errUnexpected(iv.plainLen))
+	}
+	if iv := stored("short"); iv.plainLen != 0 {
+		t.Error(errUnexpected(iv.plainLen))
+	}
+	for key, want := range map[string][]byte{"text": text, "noise": noise, "short": []byte("clapton")} {
+		if v, err := be.Get([]byte(key)); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(v, want) {
+			t.Error(errUnexpected(key))
+		}
+	}
+	if top, err := be.TopKeysBySize(1); err != nil {
+		t.Error(err)
+	} else if len(top) != 1 || string(top[0].Key) != "noise" || top[0].Size != len(noise) {
+		t.Error(errUnexpected(top))
+	}
+
+	be.opts.ShouldCompress = func(value []byte) bool { return false }
+	be.Set([]byte("text"), text)
+	if iv := stored("text"); iv.plainLen != 0 {
+		t.Error(errUnexpected(iv.plainLen))
+	}
+	be.opts.ShouldCompress = func(value []byte) bool { return true }
+	be.Set([]byte("short"), []byte("clapton"))
+	if iv := stored("short"); iv.plainLen != 0 {
+		t.Error(errUnexpected(iv.plainLen))
+	}
+	if v, err := be.Get([]byte("text")); err != nil || !bytes.Equal(v, text) {
+		t.Error(errUnexpected(err))
+	}
+
+	if DefaultShouldCompress(noise) || !DefaultShouldCompress(text) || DefaultShouldCompress([]byte("clapton")) {
+		t.Error("unexpected probe")
+	}
+}
+
+func TestBoltDBMaxSnapshotAge(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, MaxSnapshotAge: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Set([]byte("beano"), []byte("clapton"))
+
+	snap, err := be.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := snap.Get([]byte("beano")); err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(err))
+	}
+	txid := snap.TxID()
+	time.Sleep(150 * time.Millisecond)
+	if _, err := snap.Get([]byte("beano")); err != ErrSnapshotExpired {
+		t.Error(errUnexpected(err))
+	}
+	if _, err := snap.Range([]byte("bea"), 0, nil, false); err != ErrSnapshotExpired {
+		t.Error(errUnexpected(err))
+	}
+	if snap.TxID() != txid {
+		t.Error(errUnexpected(snap.TxID()))
+	}
+	snap.Release()
+
+	// a released snapshot is left alone by the watchdog
+	snap, err = be.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := snap.Get([]byte("beano")); err != bolt.ErrTxClosed {
+		t.Error(errUnexpected(err))
+	}
+
+	// the expired snapshot doesn't hold Close back
+	snap, err = be.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		be.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the expired snapshot")
+	}
+}
+
+func TestBoltDBFilterExisting(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, Tombstones: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("filter:a"), []byte("1"))
+	be.Set([]byte("filter:b"), []byte("2"))
+	be.Set([]byte("filter:c"), []byte("3"))
+	be.Delete([]byte("filter:b"), false)
+	be.ListPush([]byte("filter:list"), []byte("x"))
+
+	candidates := [][]byte{[]byte("filter:c"), []byte("filter:missing"), []byte("filter:b"), []byte("filter:list"), []byte("filter:a"), []byte("filter:c")}
+	existing, err := be.FilterExisting(candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprintf("%s", existing); got != "[filter:c filter:list filter:a filter:c]" {
+		t.Error(errUnexpected(got))
+	}
+	if existing, err := be.FilterExisting(nil); err != nil || len(existing) != 0 {
+		t.Error(errUnexpected(existing))
+	}
+}
+
+func TestBoltDBCircuitBreaker(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, BreakerThreshold: 3, BreakerRetry: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("beano"), []byte("clapton"))
+
+	// errors of the operation don't count
+	for i := 0; i < 5; i++ {
+		if _, err := be.Increment([]byte("beano"), 1, false); err != ErrNotNumeric {
+			t.Fatal(errUnexpected(err))
+		}
+	}
+	if be.CircuitOpen() || !strings.Contains(be.Stats(), "breaker_failures 0") {
+		t.Fatal(errUnexpected(be.Stats()))
+	}
+
+	failure := fmt.Errorf("write failure")
+	for i := 0; i < 3; i++ {
+		be.checkBreaker(failure, nil)
+	}
+	if !be.CircuitOpen() {
+		t.Fatal("expected open circuit")
+	}
+	if err := be.Set([]byte("beano"), []byte("mayall")); err != ErrCircuitOpen {
+		t.Error(errUnexpected(err))
+	}
+	if _, err := be.Delete([]byte("beano"), false); err != ErrCircuitOpen {
+		t.Error(errUnexpected(err))
+	}
+	if v, err := be.Get([]byte("beano")); err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(string(v)), err)
+	}
+	if stats := be.Stats(); !strings.Contains(stats, "breaker_open 1") || !strings.Contains(stats, "breaker_trips 1") {
+		t.Error(errUnexpected(stats))
+	}
+
+	// a probe once BreakerRetry passed, its commit closes the circuit
+	time.Sleep(60 * time.Millisecond)
+	if err := be.Set([]byte("beano"), []byte("mayall")); err != nil {
+		t.Fatal(err)
+	}
+	if be.CircuitOpen() || !strings.Contains(be.Stats(), "breaker_open 0") {
+		t.Error(errUnexpected(be.Stats()))
+	}
+
+	// bolt failing the transactions, those of Transaction and NextSequence count too
+	be.checkBreaker(failure, nil)
+	be.db.Close()
+	if err := be.Transaction(func(tx *Txn) error { return tx.Put([]byte("beano"), []byte("bruce")) }); err != bolt.ErrDatabaseNotOpen {
+		t.Error(errUnexpected(err))
+	}
+	if _, err := be.NextSequence([]byte("orders")); err == nil {
+		t.Error("expected NextSequence to fail")
+	}
+	if err := be.Set([]byte("beano"), []byte("bruce")); err != ErrCircuitOpen {
+		t.Error(errUnexpected(err))
+	}
+}
+
+func TestBoltDBDiskFull(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, DiskFullRetry: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("beano"), []byte("clapton"))
+
+	// bolt formats the resize errors, only the text tells
+	if err := be.checkDiskFull(fmt.Errorf("file resize error: %s", &os.PathError{Op: "truncate", Path: filename, Err: syscall.ENOSPC})); err != ErrDiskFull {
+		t.Fatal(errUnexpected(err))
+	}
+	if !be.DiskFull() {
+		t.Error("expected disk full")
+	}
+	if err := be.Set([]byte("beano"), []byte("mayall")); err != ErrDiskFull {
+		t.Error(errUnexpected(err))
+	}
+	if _, err := be.Increment([]byte("counter"), 1, true); err != ErrDiskFull {
+		t.Error(errUnexpected(err))
+	}
+	if err := be.Preallocate(1 << 30); err != ErrDiskFull {
+		t.Error(errUnexpected(err))
+	}
+	if v, err := be.Get([]byte("beano")); err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(err))
+	}
+
+	be.RetryDiskFull()
+	if err := be.Set([]byte("beano"), []byte("mayall")); err != nil {
+		t.Error(err)
+	}
+	if be.DiskFull() {
+		t.Error("expected writable")
+	}
+	if err := be.checkDiskFull(ErrKeyNotFound); err != ErrKeyNotFound || be.DiskFull() {
+		t.Error(errUnexpected(err))
+	}
+
+	be.opts.DiskFullRetry = 50 * time.Millisecond
+	be.checkDiskFull(&os.PathError{Op: "write", Path: filename, Err: syscall.ENOSPC})
+	if err := be.Set([]byte("beano"), []byte("bruce")); err != ErrDiskFull {
+		t.Error(errUnexpected(err))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := be.Set([]byte("beano"), []byte("bruce")); err != nil {
+		t.Error(err)
+	}
+	if v, _ := be.Get([]byte("beano")); string(v) != "bruce" {
+		t.Error(errUnexpected(string(v)))
+	}
+}
+
+func TestBoltDBPreallocate(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("beano"), []byte("clapton"))
+
+	// over a transaction of placeholder
+	const size = preallocateTxSize + 4<<20
+	if err := be.Preallocate(size); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() < size {
+		t.Error(errUnexpected(fi.Size()))
+	}
+	be.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(metaBucketName)).Bucket([]byte(preallocateBucketName)) != nil {
+			t.Error("placeholder left behind")
+		}
+		return nil
+	})
+
+	// the load fits in the freed pages
+	value := bytes.Repeat([]byte("x"), 4096)
+	for i := 0; i < 1000; i++ {
+		if err := be.Set([]byte(fmt.Sprintf("load:%d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after, _ := os.Stat(filename); after.Size() != fi.Size() {
+		t.Error(errUnexpected(after.Size()))
+	}
+	if v, err := be.Get([]byte("beano")); err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(err))
+	}
+
+	if err := be.Preallocate(1 << 10); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBoltDBDeleteIfValue(t *testing.T) {
+	key := []byte("deleteif")
+	vboltdb.Set(key, []byte("clapton"))
+	if deleted, err := vboltdb.DeleteIfValue(key, []byte("mayall")); err != nil || deleted {
+		t.Error(errUnexpected(err))
+	}
+	if v, _ := vboltdb.Get(key); string(v) != "clapton" {
+		t.Error(errUnexpected(string(v)))
+	}
+	if deleted, err := vboltdb.DeleteIfValue(key, []byte("clapton")); err != nil || !deleted {
+		t.Error(errUnexpected(err))
+	}
+	if v, _ := vboltdb.Get(key); v != nil {
+		t.Error(errUnexpected(string(v)))
+	}
+	if deleted, err := vboltdb.DeleteIfValue(key, []byte("clapton")); err != ErrKeyNotFound || deleted {
+		t.Error(errUnexpected(err))
+	}
+
+	vboltdb.Set(key, []byte{})
+	if deleted, err := vboltdb.DeleteIfValue(key, nil); err != nil || !deleted {
+		t.Error(errUnexpected(err))
+	}
+	vboltdb.ListPush(key, []byte("x"))
+	if _, err := vboltdb.DeleteIfValue(key, []byte("x")); err != ErrWrongType {
+		t.Error(errUnexpected(err))
+	}
+	vboltdb.Delete(key, false)
+}
+
+func TestBoltDBExpirationInheritance(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	// the jitter would move an expiration written again
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, ExpirationJitter: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	key := []byte("ttl:inherit")
+	expiration := func() (int32, int) {
+		meta, err := be.Meta(key)
+		if err != nil || meta == nil {
+			t.Fatal(errUnexpected(err))
+		}
+		return meta.Flags, meta.Expiration
+	}
+
+	if err := be.Append(key, []byte("x")); err != ErrKeyNotFound {
+		t.Error(errUnexpected(err))
+	}
+	if err := be.Prepend(key, []byte("x")); err != ErrKeyNotFound {
+		t.Error(errUnexpected(err))
+	}
+	if v, _ := be.Get(key); v != nil {
+		t.Error(errUnexpected(string(v)))
+	}
+
+	if ok, err := be.ReplaceEx(key, nil, 0, 0); err != nil || ok {
+		t.Error(errUnexpected(err))
+	}
+	be.Set(key, []byte("b"))
+	if ok, err := be.ReplaceEx(key, []byte("b"), 7, 1000); err != nil || !ok {
+		t.Fatal(errUnexpected(err))
+	}
+	flags, exp := expiration()
+	if flags != 7 || exp == 0 {
+		t.Fatal(errUnexpected(exp))
+	}
+
+	if err := be.Append(key, []byte("c")); err != nil {
+		t.Error(errUnexpected(err))
+	}
+	if err := be.Prepend(key, []byte("a")); err != nil {
+		t.Error(errUnexpected(err))
+	}
+	if v, _ := be.Get(key); string(v) != "abc" {
+		t.Error(errUnexpected(string(v)))
+	}
+	if f, e := expiration(); f != 7 || e != exp {
+		t.Errorf("append/prepend changed flags %d to %d, expiration %d to %d", flags, f, exp, e)
+	}
+
+	if err := be.Replace(key, []byte("d")); err != nil {
+		t.Error(errUnexpected(err))
+	}
+	if v, _ := be.Get(key); string(v) != "d" {
+		t.Error(errUnexpected(string(v)))
+	}
+	if _, e := expiration(); e != exp {
+		t.Errorf("replace changed expiration %d to %d", exp, e)
+	}
+
+	if ok, err := be.ReplaceEx(key, []byte("e"), 0, 0); err != nil || !ok {
+		t.Error(errUnexpected(err))
+	}
+	if _, e := expiration(); e != 0 {
+		t.Errorf("expected ReplaceEx to clear the expiration, got %d", e)
+	}
+	if err := be.Replace(key, []byte("f")); err != nil {
+		t.Error(errUnexpected(err))
+	}
+	if _, e := expiration(); e != 0 {
+		t.Errorf("expected replace to keep no expiration, got %d", e)
+	}
+}
+
+func TestBoltDBHotKeys(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, TrackHotKeys: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if _, err := vboltdb.HotKeys(1); err == nil {
+		t.Error("expected error without TrackHotKeys")
+	}
+
+	for i := 0; i < 10; i++ {
+		be.Set([]byte(fmt.Sprintf("hot:%d", i)), []byte("x"))
+	}
+	for i := 0; i < 10; i++ {
+		for j := 0; j < i*10; j++ {
+			be.Get([]byte(fmt.Sprintf("hot:%d", i)))
+		}
+	}
+	be.Get([]byte("hot:missing"))
+	hot, err := be.HotKeys(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hot) != 2 || string(hot[0].Key) != "hot:9" || hot[0].Hits < 90 || string(hot[1].Key) != "hot:8" || hot[0].Bucket != "memcached" {
+		t.Error(errUnexpected(hot))
+	}
+	if hot, _ := be.HotKeys(10); len(hot) != 3 || string(hot[2].Key) != "hot:7" {
+		t.Error(errUnexpected(hot))
+	}
+
+	be.ResetHotKeys()
+	be.Get([]byte("hot:1"))
+	if hot, _ := be.HotKeys(10); len(hot) != 1 || string(hot[0].Key) != "hot:1" || hot[0].Hits != 1 {
+		t.Error(errUnexpected(hot))
+	}
+}
+
+func TestBoltDBPortableSnapshot(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000, EncryptionKey: secret, Tombstones: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("beano"), []byte("clapton"))
+	be.Set([]byte("flagged"), []byte("x"))
+	be.ReplaceEx([]byte("flagged"), []byte("mayall"), 7, 0)
+	be.SetWithContentType([]byte("json"), []byte(`{"a":1}`), ContentTypeJSON)
+	be.ListPush([]byte("list"), []byte("x"))
+	be.SetAdd([]byte("set"), []byte("member"))
+	be.Set([]byte("deleted"), []byte("gone"))
+	be.Delete([]byte("deleted"), false)
+	be.Set([]byte("expiring"), []byte("x"))
+	be.ReplaceEx([]byte("expiring"), []byte("soon"), 0, 3600)
+
+	// the members of sets and hashes don't fit in the records
+	var snapshot bytes.Buffer
+	if err := be.ExportSnapshot(&snapshot); err != ErrWrongType || snapshot.Len() != 0 {
+		t.Fatal(errUnexpected(err))
+	}
+	be.Delete([]byte("set"), false)
+	if err := be.ExportSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(snapshot.Bytes(), []byte(portableMagic)) || bytes.Contains(snapshot.Bytes(), []byte("gone")) {
+		t.Error(errUnexpected(snapshot.String()))
+	}
+
+	other := tempBoltDBFile(t)
+	defer removeBoltDBFiles(other)
+	imported, err := NewKVBoltDBBackendWithOptions(other, "memcached", BackendOptions{MaxKeysPerBucket: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imported.Close()
+	if err := imported.ImportSnapshot(bytes.NewReader(snapshot.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"beano", "flagged", "json", "list", "expiring"} {
+		want, err := be.ExportKey([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := imported.ExportKey([]byte(key))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(got.Value, want.Value) || got.Flags != want.Flags || got.Expiration != want.Expiration || got.Kind != want.Kind || got.ContentType != want.ContentType {
+			t.Error(errUnexpected(got))
+		}
+		if key == "flagged" && got.Flags != 7 || key == "expiring" && got.Expiration == 0 {
+			t.Error(errUnexpected(got))
+		}
+	}
+	if v, _ := imported.Get([]byte("deleted")); v != nil {
+		t.Error(errUnexpected(string(v)))
+	}
+
+	truncated := snapshot.Bytes()[:snapshot.Len()-3]
+	if err := imported.ImportSnapshot(bytes.NewReader(truncated)); err == nil {
+		t.Error("truncated snapshot imported")
+	}
+	corrupt := append([]byte(nil), snapshot.Bytes()...)
+	corrupt[len(portableMagic)+9+6] ^= 0xff
+	if err := imported.ImportSnapshot(bytes.NewReader(corrupt)); err == nil {
+		t.Error("corrupt snapshot imported")
+	}
+	if err := imported.ImportSnapshot(strings.NewReader("not a snapshot at all")); err == nil {
+		t.Error("garbage imported")
+	}
+
+	// several batches
+	for i := 0; i < 2*portableImportBatch+10; i++ {
+		be.Set([]byte(fmt.Sprintf("bulk:%d", i)), []byte(strconv.Itoa(i)))
+	}
+	snapshot.Reset()
+	if err := be.ExportSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.ImportSnapshot(bytes.NewReader(snapshot.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, portableImportBatch, 2*portableImportBatch + 9} {
+		if v, err := imported.Get([]byte(fmt.Sprintf("bulk:%d", i))); err != nil || string(v) != strconv.Itoa(i) {
+			t.Error(errUnexpected(string(v)), err)
+		}
+	}
+}
+
+func TestBoltDBReplaceBloomFalsePositive(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	// the filter claims a key bolt never stored
+	key := []byte("phantom")
+	be.keyCache[be.bucketName].Add(key)
+	if !be.keyCache[be.bucketName].Test(key) {
+		t.Fatal("expected a bloom positive")
+	}
+	if err := be.Replace(key, []byte("clapton")); err == nil {
+		t.Error("Replace stored an absent key")
+	}
+	if stored, err := be.ReplaceEx(key, []byte("clapton"), 0, 0); err != nil || stored {
+		t.Error(errUnexpected(err))
+	}
+	if v, _ := be.Get(key); v != nil {
+		t.Error(errUnexpected(string(v)))
+	}
+	if err := be.Add(key, []byte("clapton")); err != nil {
+		t.Error(err)
+	}
+	if err := be.Replace(key, []byte("mayall")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBoltDBAddRace(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	for _, batch := range []bool{false, true} {
+		be, err := NewKVBoltDBBackendWithOptions(filename, fmt.Sprintf("race%v", batch), BackendOptions{MaxKeysPerBucket: 10000, NoSync: true, BatchWrites: batch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("race:%d", i))
+			counter := []byte(fmt.Sprintf("counter:%d", i))
+			list := []byte(fmt.Sprintf("list:%d", i))
+			var added int32
+			var wg sync.WaitGroup
+			for j := 0; j < 8; j++ {
+				wg.Add(3)
+				go func(j int) {
+					defer wg.Done()
+					if be.Add(key, []byte(strconv.Itoa(j))) == nil {
+						atomic.AddInt32(&added, 1)
+					}
+				}(j)
+				go func() {
+					defer wg.Done()
+					if _, err := be.Increment(counter, 1, true); err != nil {
+						t.Error(err)
+					}
+				}()
+				go func(j int) {
+					defer wg.Done()
+					if _, err := be.ListPush(list, []byte(strconv.Itoa(j))); err != nil {
+						t.Error(err)
+					}
+				}(j)
+			}
+			wg.Wait()
+			if added != 1 {
+				t.Errorf("%d Adds of %s succeeded with BatchWrites %v", added, key, batch)
+			}
+			if v, err := be.Get(counter); err != nil || string(v) != "8" {
+				t.Errorf("counter %s at %q after 8 increments with BatchWrites %v - %v", counter, v, batch, err)
+			}
+			if n, err := be.ListLen(list); err != nil || n != 8 {
+				t.Errorf("list %s of %d items after 8 pushes with BatchWrites %v - %v", list, n, batch, err)
+			}
+		}
+		be.Close()
+	}
+}
+
+func TestMemcachedIncrErrors(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 100, FailPausedWrites: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("counter"), []byte("41"))
+	be.Set([]byte("name"), []byte("mayall"))
+	if _, err := be.ListPush([]byte("list"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go NewMemcachedProtocolServer(false).Parse(server, be)
+	reader := bufio.NewReader(client)
+	send := func(line string) string {
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Write([]byte(line + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimRight(reply, "\r\n")
+	}
+
+	if reply := send("incr counter 1"); reply != "42" {
+		t.Error(errUnexpected(reply))
+	}
+	if reply := send("decr missing 1"); reply != "NOT_FOUND" {
+		t.Error(errUnexpected(reply))
+	}
+	if reply := send("incr name 1"); reply != "CLIENT_ERROR cannot increment or decrement non-numeric value" {
+		t.Error(errUnexpected(reply))
+	}
+	// errors other than a miss aren't reported as one
+	if reply := send("incr list 1"); reply != "SERVER_ERROR "+ErrWrongType.Error() {
+		t.Error(errUnexpected(reply))
+	}
+	be.PauseWrites()
+	if reply := send("incr counter 1"); reply != "SERVER_ERROR "+ErrWritesPaused.Error() {
+		t.Error(errUnexpected(reply))
+	}
+	be.ResumeWrites()
+	if reply := send("incr counter 1"); reply != "43" {
+		t.Error(errUnexpected(reply))
+	}
+}
+
+func TestMemcachedFlushAll(t *testing.T) {
+	filename := tempBoltDBFile(t)
+	defer removeBoltDBFiles(filename)
+	be, err := NewKVBoltDBBackendWithOptions(filename, "memcached", BackendOptions{MaxKeysPerBucket: 100, ManualReaper: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	be.Set([]byte("beano"), []byte("clapton"))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go NewMemcachedProtocolServer(false).Parse(server, be)
+	reader := bufio.NewReader(client)
+	send := func(line string) string {
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Write([]byte(line + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimRight(reply, "\r\n")
+	}
+	stored := func() bool {
+		v, _ := be.Get([]byte("beano"))
+		return v != nil
+	}
+
+	// bad delays are refused without flushing
+	if reply := send("flush_all garbage"); reply != "CLIENT_ERROR bad command line format" || !stored() {
+		t.Error(errUnexpected(reply))
+	}
+	if reply := send("flush_all -1"); reply != "CLIENT_ERROR bad command line format" || !stored() {
+		t.Error(errUnexpected(reply))
+	}
+	if reply := send("flush_all noreply 5"); reply != "ERROR" || !stored() {
+		t.Error(errUnexpected(reply))
+	}
+	if reply := send("flush_all 60"); reply != "OK" || !stored() {
+		t.Error(errUnexpected(reply))
+	}
+	// noreply answers nothing, the next reply is the version's
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte("flush_all noreply\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := send("version"); !strings.HasPrefix(reply, "VERSION") || stored() {
+		t.Error(errUnexpected(reply))
+	}
+
+	be.disabledOps = map[string]bool{OpFlush: true}
+	if reply := send("flush_all"); reply != "SERVER_ERROR "+ErrOperationDisabled.Error() {
+		t.Error(errUnexpected(reply))
+	}
+}
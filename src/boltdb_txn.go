@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+Txn is a write transaction on the current bucket handed to Transaction's fn. Its
+operations see each other's writes and commit or roll back together. It is only
+valid until fn returns
+*/
+type Txn struct {
+	be          *KVBoltDBBackend
+	tx          *bolt.Tx
+	bucket      *bolt.Bucket
+	added       [][]byte
+	removed     [][]byte
+	expirations []*InternalValue
+}
+
+// Get returns the value of key as seen by the transaction, nil if absent
+func (t *Txn) Get(key []byte) ([]byte, error) {
+	key = t.be.normalizeKey(key)
+	iv, err := t.be.liveValue(t.bucket, key)
+	if err != nil || iv == nil {
+		return nil, err
+	}
+	if iv.kind != ValueScalar {
+		return nil, ErrWrongType
+	}
+	return cloneValue(iv.value), nil
+}
+
+// CAS returns the CAS of key as seen by the transaction, 0 if absent
+func (t *Txn) CAS(key []byte) (int64, error) {
+	key = t.be.normalizeKey(key)
+	iv, err := t.be.liveValue(t.bucket, key)
+	if err != nil || iv == nil {
+		return 0, err
+	}
+	return iv.cas, nil
+}
+
+// Put sets key, with the bucket DefaultTTL
+func (t *Txn) Put(key []byte, value []byte) error {
+	key = t.be.normalizeKey(key)
+	cfg := t.be.BucketConfigFor(t.be.bucketName)
+	if limit := cfg.MaxValueSize; limit > 0 && len(value) > limit {
+		return fmt.Errorf("Value for key %s is %d bytes, bucket %s accepts up to %d", printableKey(key), len(value), t.be.bucketName, limit)
+	}
+	iv := &InternalValue{
+		key:        cloneValue(key),
+		expiration: t.be.expirationFor(cfg.DefaultTTL, time.Now()),
+		value:      value,
+	}
+	if err := t.be.putValue(t.tx, t.be.bucketName, t.bucket, iv); err != nil {
+		return err
+	}
+	t.added = append(t.added, iv.key)
+	if iv.expiration != 0 {
+		t.expirations = append(t.expirations, iv)
+	}
+	return nil
+}
+
+// Delete deletes key, returns false if it didn't exist
+func (t *Txn) Delete(key []byte) (bool, error) {
+	if err := t.be.allowOp(OpDelete); err != nil {
+		return false, err
+	}
+	key = t.be.normalizeKey(key)
+	iv, err := t.be.liveValue(t.bucket, key)
+	if err != nil || iv == nil {
+		return false, err
+	}
+	if err := t.be.deleteKey(t.tx, key); err != nil {
+		return false, err
+	}
+	t.removed = append(t.removed, cloneValue(key))
+	return true, nil
+}
+
+/*
+Transaction runs fn in a single write transaction on the current bucket: every
+operation of the Txn commits when fn returns nil, none does if fn returns an error,
+which Transaction returns. Bloom filter updates are applied once it commits. fn
+blocks every other write, it must not call the backend itself
+*/
+func (be *KVBoltDBBackend) Transaction(fn func(tx *Txn) error) error {
+	defer be.slowLog("transaction", nil, time.Now())
+	if err := be.enterWrite(); err != nil {
+		return err
+	}
+	defer be.writes.leave()
+	if !be.allowWrite() {
+		return ErrRateLimited
+	}
+	if err := be.flushPending(); err != nil {
+		return err
+	}
+	if err := be.rlock(); err != nil {
+		return err
+	}
+	defer be.dbMutex.RUnlock()
+
+	var txn *Txn
+	err := be.updateOn(be.db, func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(be.bucketName))
+		if err != nil {
+			return err
+		}
+		txn = &Txn{be: be, tx: tx, bucket: bucket}
+		return fn(txn)
+	})
+	if err != nil {
+		return err
+	}
+
+	bf := be.keyCache[be.bucketName]
+	for _, key := range txn.removed {
+		bf.Remove(key)
+	}
+	for _, key := range txn.added {
+		bf.Add(key)
+	}
+	for _, iv := range txn.expirations {
+		if err := be.indexExpiration(be.bucketName, iv.key, iv.expiration); err != nil {
+			log.Error("Error indexing expiration of key %s - %s", printableKey(iv.key), err)
+		}
+	}
+	return nil
+}
+
+// CASUpdate is a write of MultiCAS: Value replaces the value of Key if its CAS is still CAS
+type CASUpdate struct {
+	Key   []byte
+	Value []byte
+	CAS   int64
+}
+
+// CASMismatchError names the key whose CAS failed a MultiCAS, with its current CAS
+type CASMismatchError struct {
+	Key []byte
+	CAS int64
+}
+
+func (e *CASMismatchError) Error() string {
+	return fmt.Sprintf("CAS mismatch for key %s, now %d", printableKey(e.Key), e.CAS)
+}
+
+/*
+MultiCAS writes every update in a single transaction if all of them still match
+their CAS, an expected CAS of 0 meaning the key must be absent. Values are stored
+like Txn.Put, with the bucket DefaultTTL. If a CAS doesn't match nothing is
+written and it returns false with a *CASMismatchError naming the first such key
+*/
+func (be *KVBoltDBBackend) MultiCAS(updates []CASUpdate) (bool, error) {
+	err := be.Transaction(func(tx *Txn) error {
+		for _, u := range updates {
+			cas, err := tx.CAS(u.Key)
+			if err != nil {
+				return err
+			}
+			if cas != u.CAS {
+				return &CASMismatchError{Key: be.normalizeKey(u.Key), CAS: cas}
+			}
+		}
+		for _, u := range updates {
+			if err := tx.Put(u.Key, u.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// KeyValue is an entry of MultiSet
+type KeyValue struct {
+	Key   []byte
+	Value []byte
+}
+
+/*
+MultiSet stores every entry like Txn.Put, with the bucket DefaultTTL, and returns
+how many were written. By default all of them go in one transaction, written
+together or not at all, which blocks every other write until it commits and holds
+the whole input in bolt's dirty pages: MaxMultiSet rejects larger inputs before
+writing any. With MultiSetBatch they're written in transactions of that many
+entries in order, each one atomic but not the whole: an error leaves the batches
+before it written, and other writes can land between them
+*/
+func (be *KVBoltDBBackend) MultiSet(entries []KeyValue) (int, error) {
+	if limit := be.opts.MaxMultiSet; limit > 0 && len(entries) > limit {
+		return 0, fmt.Errorf("MultiSet of %d entries, accepts up to %d", len(entries), limit)
+	}
+	batch := be.opts.MultiSetBatch
+	if batch <= 0 {
+		batch = len(entries)
+	}
+	written := 0
+	for written < len(entries) {
+		end := written + batch
+		if end > len(entries) {
+			end = len(entries)
+		}
+		err := be.Transaction(func(tx *Txn) error {
+			for _, e := range entries[written:end] {
+				if err := tx.Put(e.Key, e.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
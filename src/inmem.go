@@ -13,6 +13,12 @@ type InmemBackend struct {
 	data inmem.Cache
 }
 
+func init() {
+	RegisterBackend("inmem", func(config BackendConfig) (BackendDatabase, error) {
+		return NewInmemBackend(config.MaxKeys)
+	})
+}
+
 func NewInmemBackend(size int) (*InmemBackend, error) {
 	dd := inmem.NewLocked(size)
 	b := InmemBackend{size: size, data: dd}
@@ -37,20 +43,20 @@ func (be InmemBackend) Replace(key []byte, value []byte) error {
 Incr data, yields error if the represented value doesnt maps to int.
 Starts from 0, no negative values
 */
-func (be InmemBackend) Incr(key []byte, value uint) (int, error) {
-	return be.Increment(key, int(value), false)
+func (be InmemBackend) Incr(key []byte, value uint64) (uint64, error) {
+	return be.Increment(key, signedDelta(value, false), false)
 }
 
 /*
 Decr data, yields error if the represented value doesnt maps to int.
 Stops at 0, no negative values
 */
-func (be InmemBackend) Decr(key []byte, value uint) (int, error) {
-	return be.Increment(key, int(value)*-1, false)
+func (be InmemBackend) Decr(key []byte, value uint64) (uint64, error) {
+	return be.Increment(key, signedDelta(value, true), false)
 }
 
 // Generic get and set for incr/decr tx
-func (be InmemBackend) Increment(key []byte, value int, create_if_not_exists bool) (int, error) {
+func (be InmemBackend) Increment(key []byte, value int64, create_if_not_exists bool) (uint64, error) {
 	return 0, nil
 }
 
@@ -101,3 +107,9 @@ func (be InmemBackend) Range([]byte, int, []byte, bool) (map[string][]byte, erro
 }
 func (be InmemBackend) Close()        {}
 func (be InmemBackend) Stats() string { return "" }
+
+// Version returns the build version
+func (be InmemBackend) Version() string { return buildVersion }
+
+// SetVerbosity adjusts the log level, memcached verbosity levels
+func (be InmemBackend) SetVerbosity(level int) { setVerbosity(level) }
@@ -23,6 +23,16 @@ type LevelDBBackend struct {
 	dbMutex  *sync.RWMutex
 }
 
+func init() {
+	RegisterBackend("leveldb", func(config BackendConfig) (BackendDatabase, error) {
+		be, err := NewLevelDBBackend(config.Filename)
+		if err != nil {
+			return nil, err
+		}
+		return be, nil
+	})
+}
+
 /*
 NewLevelDBBackend receives a filename with path and creates a new Backend instance
 */
@@ -81,46 +91,48 @@ func (be LevelDBBackend) Replace(key []byte, value []byte) error {
 Incr data, yields error if the represented value doesnt maps to int.
 Starts from 0, no negative values
 */
-func (be LevelDBBackend) Incr(key []byte, value uint) (int, error) {
-	return be.Increment(key, int(value), false)
+func (be LevelDBBackend) Incr(key []byte, value uint64) (uint64, error) {
+	return be.Increment(key, signedDelta(value, false), false)
 }
 
 /*
 Decr data, yields error if the represented value doesnt maps to int.
 Stops at 0, no negative values
 */
-func (be LevelDBBackend) Decr(key []byte, value uint) (int, error) {
-	return be.Increment(key, int(value)*-1, false)
+func (be LevelDBBackend) Decr(key []byte, value uint64) (uint64, error) {
+	return be.Increment(key, signedDelta(value, true), false)
 }
 
 /*
 Increment - Generic get and set for incr/decr tx
 */
-func (be LevelDBBackend) Increment(key []byte, value int, createIfNotExists bool) (int, error) {
+func (be LevelDBBackend) Increment(key []byte, value int64, createIfNotExists bool) (uint64, error) {
 	be.dbMutex.Lock()
 	v, err := be.NormalizedGet(key, be.ro)
-	if createIfNotExists == false {
-		if v == nil || err != nil {
-			be.dbMutex.Unlock()
-			return -1, fmt.Errorf("Key %s do not exists, createIfNotExists set to false - %s", string(key), err)
-		}
+	if err != nil {
+		be.dbMutex.Unlock()
+		return 0, err
+	}
+	if v == nil && createIfNotExists == false {
+		be.dbMutex.Unlock()
+		return 0, ErrKeyNotFound
 	}
 	if v == nil {
 		err = be.db.Put(key, []byte("0"), be.wo)
 		be.dbMutex.Unlock()
 		return 0, nil
 	}
-	i, err := strconv.Atoi(string(v))
+	i, err := parseCounter(v)
 	if err != nil {
 		be.dbMutex.Unlock()
-		return -1, fmt.Errorf("Data cannot be incr/decr for key %s - %s", string(key), string(v))
+		return 0, err
 	}
-	i = i + value
-	s := fmt.Sprintf("%d", i)
+	i = applyDelta(i, value)
+	s := strconv.FormatUint(i, 10)
 	err = be.db.Put(key, []byte(s), be.wo)
 	if err != nil {
 		be.dbMutex.Unlock()
-		return -1, fmt.Errorf("Error key %s - %s", string(key), err)
+		return 0, fmt.Errorf("Error key %s - %s", string(key), err)
 	}
 	be.dbMutex.Unlock()
 	return i, nil
@@ -256,3 +268,9 @@ func (be LevelDBBackend) Flush() error { return nil }
 BucketStats implement statuses for db that used the bucket idea (boltdb)
 */
 func (be LevelDBBackend) BucketStats() error { return nil }
+
+// Version returns the build version
+func (be LevelDBBackend) Version() string { return buildVersion }
+
+// SetVerbosity adjusts the log level, memcached verbosity levels
+func (be LevelDBBackend) SetVerbosity(level int) { setVerbosity(level) }
@@ -108,7 +108,7 @@ func TestLevelDBDecr(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	} else if v != 9 {
-		t.Error(errUnexpected(string(v)))
+		t.Error(errUnexpected(v))
 	}
 
 	if v, err := vleveldb.Get(key); err != nil {
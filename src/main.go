@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	logging "github.com/op/go-logging"
 	"github.com/pkg/profile"
@@ -26,9 +27,11 @@ func main() {
 	address := flag.String("s", "127.0.0.1", "Bind Address")
 	port := flag.String("p", "11211", "Bind Port")
 	filename := flag.String("f", "./memcached.db", "path and file for database. for badger it needs to be a directory")
-	backend := flag.String("b", "leveldb", "backend: leveldb, boltdb, inmem or badger")
+	backend := flag.String("b", "leveldb", "backend: "+strings.Join(Backends(), ", "))
 	pf := flag.Bool("q", false, "Enable profiling")
 	dumpLogs := flag.Bool("m", false, "Enable metric dump each 60 seconds")
+	adminSocket := flag.String("a", "", "unix socket path for the admin shell, boltdb only")
+	warmBloom := flag.Bool("w", false, "Build the boltdb bloom filter in the background, serving meanwhile")
 
 	flag.Usage = func() {
 		fmt.Println("Usage: beano [-s ip] [-p port] [-f /path/to/db/file -q -b leveldb|boltdb|inmem|badger]")
@@ -37,9 +40,12 @@ func main() {
 		fmt.Println("default backend: leveldb")
 		fmt.Println("default file: ./memcached.db")
 		fmt.Println("-q enables profiling to /tmp/*.prof")
+		fmt.Println("-a /path/to/admin.sock serves the boltdb admin shell")
+		fmt.Println("-w serves boltdb right away, building the bloom filter in the background")
 		os.Exit(1)
 	}
 	flag.Parse()
+	asyncBloom = *warmBloom
 	if *pf == true {
 		c := profile.Start(profile.CPUProfile, profile.ProfilePath("/tmp"), profile.NoShutdownHook)
 		defer c.Stop()
@@ -49,6 +55,6 @@ func main() {
 
 	initializeMetrics(*filename, *dumpLogs)
 
-	serve(*address, *port, *filename, *backend)
+	serve(*address, *port, *filename, *backend, *adminSocket)
 
 }
@@ -228,6 +228,37 @@ func (ms MemcachedProtocolServer) Parse(conn net.Conn, vdb BackendDatabase) {
 			}
 			break
 
+		case cmd == "append" || cmd == "prepend":
+			if ms.checkRO(buf) {
+				break
+			}
+			appender, ok := vdb.(Appender)
+			if len(args) < 2 || !ok {
+				ms.writeLine(buf, "ERROR")
+				protocolErrors.Inc(1)
+				break
+			}
+
+			// retrieve body
+			body, err := ms.readLine(conn, buf)
+			if len(body) == 0 || err != nil {
+				ms.writeLine(buf, "ERROR")
+				protocolErrors.Inc(1)
+				break
+			}
+			if cmd == "append" {
+				err = appender.Append([]byte(args[1]), []byte(body))
+			} else {
+				err = appender.Prepend([]byte(args[1]), []byte(body))
+			}
+			if err != nil {
+				log.Error("%s: %s", strings.ToUpper(cmd), err)
+				ms.writeLine(buf, "NOT_STORED")
+			} else {
+				ms.writeLine(buf, "STORED")
+			}
+			break
+
 		case cmd == "quit":
 			if len(args) > 1 {
 				ms.writeLine(buf, "ERROR")
@@ -243,7 +274,7 @@ func (ms MemcachedProtocolServer) Parse(conn net.Conn, vdb BackendDatabase) {
 				ms.writeLine(buf, "ERROR")
 				protocolErrors.Inc(1)
 			} else {
-				ms.writeLine(buf, "VERSION BEANO")
+				ms.writeLine(buf, "VERSION "+vdb.Version())
 			}
 			break
 
@@ -251,15 +282,51 @@ func (ms MemcachedProtocolServer) Parse(conn net.Conn, vdb BackendDatabase) {
 			if ms.checkRO(buf) {
 				break
 			}
-			vdb.Flush()
-			ms.writeLine(buf, "OK")
+			// flush_all [delay] [noreply], backends without delayed flushes flush at once
+			params := args[1:]
+			if noreply {
+				params = params[:len(params)-1]
+			}
+			if len(params) > 1 {
+				ms.writeLine(buf, "ERROR")
+				protocolErrors.Inc(1)
+				break
+			}
+			delay := 0
+			if len(params) == 1 {
+				var err error
+				if delay, err = strconv.Atoi(params[0]); err != nil || delay < 0 {
+					ms.writeLine(buf, "CLIENT_ERROR bad command line format")
+					protocolErrors.Inc(1)
+					break
+				}
+			}
+			var err error
+			if delayed, ok := vdb.(DelayedFlusher); ok && delay > 0 {
+				err = delayed.FlushAfter(delay)
+			} else {
+				err = vdb.Flush()
+			}
+			if err != nil {
+				log.Error("FLUSH_ALL: %s", err)
+				ms.writeLine(buf, "SERVER_ERROR "+err.Error())
+			} else if noreply == false {
+				ms.writeLine(buf, "OK")
+			}
 			break
 
 		case cmd == "verbosity":
 			if len(args) < 2 || len(args) > 3 {
 				ms.writeLine(buf, "ERROR")
 				protocolErrors.Inc(1)
+				break
+			}
+			level, err := strconv.Atoi(args[1])
+			if err != nil {
+				ms.writeLine(buf, "ERROR")
+				protocolErrors.Inc(1)
 			} else {
+				vdb.SetVerbosity(level)
 				ms.writeLine(buf, "OK")
 			}
 			break
@@ -310,6 +377,59 @@ func (ms MemcachedProtocolServer) Parse(conn net.Conn, vdb BackendDatabase) {
 			}
 			break
 
+		case cmd == "incr" || cmd == "decr":
+			if ms.checkRO(buf) {
+				break
+			}
+			if len(args) < 3 || len(args) > 4 {
+				ms.writeLine(buf, "ERROR")
+				protocolErrors.Inc(1)
+				break
+			}
+			delta, err := strconv.ParseUint(args[2], 10, 64)
+			if err != nil {
+				ms.writeLine(buf, "CLIENT_ERROR invalid numeric delta argument")
+				protocolErrors.Inc(1)
+				break
+			}
+			var v uint64
+			if cmd == "incr" {
+				v, err = vdb.Incr([]byte(args[1]), delta)
+			} else {
+				v, err = vdb.Decr([]byte(args[1]), delta)
+			}
+			switch {
+			case err == ErrNotNumeric:
+				ms.writeLine(buf, "CLIENT_ERROR cannot increment or decrement non-numeric value")
+			case err == ErrKeyNotFound:
+				if noreply == false {
+					ms.writeLine(buf, "NOT_FOUND")
+				}
+			case err != nil:
+				log.Error("INCR/DECR: %s", err)
+				ms.writeLine(buf, "SERVER_ERROR "+err.Error())
+			case noreply == false:
+				ms.writeLine(buf, strconv.FormatUint(v, 10))
+			}
+			break
+
+		case cmd == "dbstats" && len(args) == 2 && args[1] == "json":
+			// dbstats json, the stats as a single line JSON object
+			statser, ok := vdb.(StatsJSONer)
+			if !ok {
+				ms.writeLine(buf, "SERVER_ERROR stats not available as JSON")
+				break
+			}
+			js, err := statser.StatsJSON()
+			if err != nil {
+				log.Error("DBSTATS: %s", err)
+				ms.writeLine(buf, "SERVER_ERROR "+err.Error())
+				break
+			}
+			ms.writeLine(buf, string(js))
+			ms.writeLine(buf, "OK")
+			break
+
 		case cmd == "dbstats":
 			if len(args) > 1 {
 				ms.writeLine(buf, "ERROR")
@@ -29,9 +29,12 @@ var networkErrors = metrics.NewCounter()    //"network_errors"
 var readonlyErrors = metrics.NewCounter()   //"readonly_errors"
 var responseTiming = metrics.NewTimer()     // response_timing
 
+var replicationApplied = metrics.NewCounter() //"replication_applied"
+var replicationSkipped = metrics.NewCounter() //"replication_skipped"
+
 func initializeMetrics(dbp string, dumpLogs bool) {
 	pid.Set(int64(os.Getpid()))
-	version.Set("BEANO Server")
+	version.Set("BEANO Server " + buildVersion)
 	upSince.Set(time.Now().Format(time.RFC3339))
 	dbPath.Set(dbp)
 
@@ -48,6 +51,8 @@ func initializeMetrics(dbp string, dumpLogs bool) {
 	metrics.Register("network_errors", networkErrors)
 	metrics.Register("readonly_errors", readonlyErrors)
 	metrics.Register("response_timing", responseTiming)
+	metrics.Register("replication_applied", replicationApplied)
+	metrics.Register("replication_skipped", replicationSkipped)
 	if dumpLogs {
 		go metrics.Log(metrics.DefaultRegistry, time.Duration(60*time.Second), logging.NewLogBackend(os.Stdout, "", 0).Logger)
 	}
@@ -9,21 +9,22 @@ import (
 
 var messages chan string
 
+// asyncBloom opens boltdb databases with the AsyncBloom option, set by the -w flag
+var asyncBloom bool
+
+// loadDB opens the registered backend, leveldb for unknown names
 func loadDB(backend string, filename string) BackendDatabase {
-	var vdb BackendDatabase
-	var err error
-	switch backend {
-	case "boltdb":
-		vdb, err = NewKVBoltDBBackend(filename, "memcached", 1000000)
-	case "badger":
-		vdb, err = NewBadgerBackend(filename)
-	case "inmem":
-		vdb, err = NewInmemBackend(1000000)
-	default:
-		fallthrough
-	case "leveldb":
-		vdb, err = NewLevelDBBackend(filename)
+	backendsLock.RLock()
+	_, known := backends[backend]
+	backendsLock.RUnlock()
+	if !known {
+		backend = "leveldb"
 	}
+	vdb, err := OpenBackend(backend, BackendConfig{
+		Filename: filename,
+		MaxKeys:  1000000,
+		Options:  BackendOptions{AsyncBloom: asyncBloom},
+	})
 	if err != nil {
 		log.Error("Error opening db %s", err)
 		return nil
@@ -46,7 +47,7 @@ func switchDBHandler(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte("OK"))
 }
 
-func serve(ip string, port string, filename string, backend string) {
+func serve(ip string, port string, filename string, backend string, adminSocket string) {
 	var err error
 	messages = make(chan string)
 
@@ -61,6 +62,18 @@ func serve(ip string, port string, filename string, backend string) {
 	vdb := loadDB(backend, filename)
 	defer vdb.Close()
 
+	if adminSocket != "" {
+		if be, ok := vdb.(*KVBoltDBBackend); ok {
+			admin, err := be.ServeAdmin(adminSocket)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			defer admin.Close()
+		} else {
+			log.Error("Admin shell needs the boltdb backend, %s in use", backend)
+		}
+	}
+
 	ms := NewMemcachedProtocolServer(false)
 
 	go func() {
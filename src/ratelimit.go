@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+ErrRateLimited is returned by writes when the configured write rate is exceeded
+*/
+var ErrRateLimited = errors.New("Write rate limit exceeded")
+
+/*
+tokenBucket is a token bucket rate limiter, refilled at rate tokens per second
+up to burst tokens
+*/
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+/*
+wait takes a token, sleeping up to timeout for one to be available. Returns
+false, without taking a token, when that would take longer than timeout
+*/
+func (tb *tokenBucket) wait(timeout time.Duration) bool {
+	tb.mutex.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	var delay time.Duration
+	if tb.tokens < 1 {
+		delay = time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+		if delay > timeout {
+			tb.mutex.Unlock()
+			return false
+		}
+	}
+	// reserve the token, a negative balance delays the next callers
+	tb.tokens--
+	tb.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return true
+}
@@ -0,0 +1,23 @@
+package main
+
+import logging "github.com/op/go-logging"
+
+// buildVersion is stamped at build time with -ldflags "-X main.buildVersion=..."
+var buildVersion = "dev"
+
+/*
+setVerbosity maps a memcached verbosity level to the log level: 0 logs warnings
+and errors, 1 adds notices, 2 info and 3 or more debug
+*/
+func setVerbosity(level int) {
+	switch {
+	case level <= 0:
+		logging.SetLevel(logging.WARNING, "beano")
+	case level == 1:
+		logging.SetLevel(logging.NOTICE, "beano")
+	case level == 2:
+		logging.SetLevel(logging.INFO, "beano")
+	default:
+		logging.SetLevel(logging.DEBUG, "beano")
+	}
+}